@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// accessRule 一条访问规则 ipNet 为nil时匹配所有地址.
+type accessRule struct {
+	allow bool
+	ipNet *net.IPNet
+}
+
+// parseCIDR 支持 CIDR 和单个IP 单个IP 按照 /32 或者 /128 处理.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid ip %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+
+	return ipNet, err
+}
+
+// parseAccessRule 规则的格式为 "allow 10.0.0.0/8" "deny 2001:db8::/32" "deny all".
+func parseAccessRule(s string) (accessRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return accessRule{}, errors.Errorf("rule %q must be allow|deny <cidr|all>", s)
+	}
+
+	r := accessRule{allow: fields[0] == "allow"}
+	if fields[1] == "all" {
+		return r, nil
+	}
+
+	ipNet, err := parseCIDR(fields[1])
+	if err != nil {
+		return accessRule{}, err
+	}
+	r.ipNet = ipNet
+
+	return r, nil
+}
+
+// checkAccess 按照顺序匹配 第一条匹配的规则决定是否允许 都不匹配时允许.
+func checkAccess(rules []string, ip net.IP) bool {
+	for _, s := range rules {
+		r, err := parseAccessRule(s)
+		if err != nil {
+			// 配置加载时已经校验过
+			continue
+		}
+
+		if r.ipNet == nil || (ip != nil && r.ipNet.Contains(ip)) {
+			return r.allow
+		}
+	}
+
+	return true
+}
+
+// BanEntry 被封禁的地址 Expires 为nil时永久封禁.
+type BanEntry struct {
+	CIDR    string     `json:"cidr"`
+	Reason  string     `json:"reason,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	ipNet *net.IPNet
+}
+
+func (e *BanEntry) expired(now time.Time) bool {
+	return e.Expires != nil && now.After(*e.Expires)
+}
+
+// BanList 运行时可以修改的封禁列表 修改后保存到文件 被封禁的地址不能建立新的连接.
+type BanList struct {
+	lock    sync.RWMutex
+	file    string
+	entries []*BanEntry
+}
+
+var banList = &BanList{}
+
+// Load 从文件中读取封禁列表 文件不存在时为空 之后的修改都保存到这个文件.
+func (b *BanList) Load(file string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.file = file
+	b.entries = nil
+	if file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*BanEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return errors.Wrap(err, "parse ban file")
+	}
+	for _, e := range entries {
+		if e.ipNet, err = parseCIDR(e.CIDR); err != nil {
+			return errors.Wrap(err, "parse ban file")
+		}
+	}
+	b.entries = entries
+
+	return nil
+}
+
+// save 先写到临时文件再改名 需要持有 b.lock.
+func (b *BanList) save() error {
+	if b.file == "" {
+		return nil
+	}
+
+	entries := b.entries
+	if entries == nil {
+		entries = []*BanEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := b.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.file)
+}
+
+// Add 封禁一个地址或者网段 duration 为0时永久封禁 已经存在时更新.
+func (b *BanList) Add(cidr, reason string, duration time.Duration) error {
+	ipNet, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	e := &BanEntry{CIDR: ipNet.String(), Reason: reason, ipNet: ipNet}
+	if duration > 0 {
+		expires := time.Now().Add(duration)
+		e.Expires = &expires
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.removeExpired()
+	for i, old := range b.entries {
+		if old.CIDR == e.CIDR {
+			b.entries[i] = e
+
+			return b.save()
+		}
+	}
+	b.entries = append(b.entries, e)
+
+	return b.save()
+}
+
+// Remove 解除封禁 返回是否存在.
+func (b *BanList) Remove(cidr string) (bool, error) {
+	ipNet, err := parseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, e := range b.entries {
+		if e.CIDR == ipNet.String() {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+
+			return true, b.save()
+		}
+	}
+
+	return false, nil
+}
+
+// removeExpired 需要持有 b.lock.
+func (b *BanList) removeExpired() {
+	now := time.Now()
+	entries := b.entries[:0]
+	for _, e := range b.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	b.entries = entries
+}
+
+func (b *BanList) Banned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	now := time.Now()
+	for _, e := range b.entries {
+		if !e.expired(now) && e.ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *BanList) List() []BanEntry {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	now := time.Now()
+	list := make([]BanEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		if !e.expired(now) {
+			list = append(list, *e)
+		}
+	}
+
+	return list
+}
+
+// ServeHTTP 管理接口的 ban GET 返回封禁列表 POST ?ip=&duration=&reason= 封禁 DELETE ?ip= 解除封禁.
+func (b *BanList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var duration time.Duration
+		if d := r.URL.Query().Get("duration"); d != "" {
+			var err error
+			if duration, err = time.ParseDuration(d); err != nil {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		if err := b.Add(ip, r.URL.Query().Get("reason"), duration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		logger().Info("ban added", "cidr", ip, "duration", duration)
+	case http.MethodDelete:
+		ok, err := b.Remove(ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		if !ok {
+			http.Error(w, ip+" is not banned", http.StatusNotFound)
+
+			return
+		}
+		logger().Info("ban removed", "cidr", ip)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b.List())
+}
+
+// reloadBanList 封禁文件修改后 新的文件存在时从新文件读取 否则把当前的封禁列表保存到新文件.
+func reloadBanList() {
+	file := conf().Ban.File
+
+	banList.lock.Lock()
+	if banList.file == file {
+		banList.lock.Unlock()
+
+		return
+	}
+	if _, err := os.Stat(file); file == "" || os.IsNotExist(err) {
+		banList.file = file
+		err = banList.save()
+		banList.lock.Unlock()
+		if err != nil {
+			logger().Error("save ban list failed", "err", err)
+		}
+
+		return
+	}
+	banList.lock.Unlock()
+
+	if err := banList.Load(file); err != nil {
+		logger().Error("load ban list failed", "err", err)
+	}
+}
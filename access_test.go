@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckAccess(t *testing.T) {
+	rules := []string{"deny 10.1.0.0/16", "allow 10.0.0.0/8", "allow 2001:db8::/32", "allow 192.168.1.5", "deny all"}
+
+	tests := []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.3.4", false},
+		{"::ffff:10.2.3.4", true},
+		{"192.168.1.5", true},
+		{"192.168.1.6", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := checkAccess(rules, net.ParseIP(tt.ip)); got != tt.allow {
+			t.Errorf("%s: got %v", tt.ip, got)
+		}
+	}
+
+	if !checkAccess(nil, net.ParseIP("1.2.3.4")) {
+		t.Error("no rules should allow")
+	}
+
+	if _, err := parseConfig([]byte("apps:\n  - name: live\n    access:\n      play: [\"permit 1.2.3.4\"]\n")); err == nil {
+		t.Error("invalid rule should fail")
+	}
+}
+
+func TestBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ban.json")
+
+	b := &BanList{}
+	if err = b.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Add("1.2.3.0/24", "spam", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Add("2001:db8::1", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Add("5.6.7.8", "", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// 重新读取文件 封禁列表需要保留
+	b = &BanList{}
+	if err = b.Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, banned := range map[string]bool{"1.2.3.4": true, "1.2.4.1": false, "2001:db8::1": true, "5.6.7.8": false} {
+		if b.Banned(net.ParseIP(ip)) != banned {
+			t.Errorf("%s banned should be %v", ip, banned)
+		}
+	}
+
+	if ok, _ := b.Remove("1.2.3.0/24"); !ok {
+		t.Error("remove failed")
+	}
+	if b.Banned(net.ParseIP("1.2.3.4")) || len(b.List()) != 1 {
+		t.Errorf("list is %+v", b.List())
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientInfo 一个客户端连接的状态.
+type ClientInfo struct {
+	ID          uint64    `json:"id"`
+	Addr        string    `json:"addr"`
+	Vhost       string    `json:"vhost,omitempty"`
+	App         string    `json:"app,omitempty"`
+	State       string    `json:"state"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	ConnectedAt time.Time `json:"connected_at"`
+	FlashVer    string    `json:"flash_ver,omitempty"`
+	SwfURL      string    `json:"swf_url,omitempty"`
+	PageURL     string    `json:"page_url,omitempty"`
+	// 正在发布或者播放的流
+	Streams []ClientStream `json:"streams,omitempty"`
+}
+
+// ClientStream 客户端连接上正在发布或者播放的一路流.
+type ClientStream struct {
+	Vhost      string `json:"vhost,omitempty"`
+	App        string `json:"app"`
+	Name       string `json:"name"`
+	Publishing bool   `json:"publishing"`
+
+	ns         *NetStream
+	stream     *Stream
+	subscriber *Subscriber
+}
+
+// Dropped 播放端因为太慢丢弃的包数.
+func (cs ClientStream) Dropped() uint64 {
+	if cs.subscriber == nil {
+		return 0
+	}
+
+	return cs.stream.Dropped(cs.subscriber)
+}
+
+// clientRegistry 所有的客户端连接 不包括转推和拉流的连接.
+type clientRegistry struct {
+	lock   sync.RWMutex
+	nextID uint64
+	conns  map[uint64]*NetConnection
+	// 已经关闭的连接一共读取和发送的byte数
+	closedBytesIn  uint64
+	closedBytesOut uint64
+}
+
+var clients = &clientRegistry{conns: make(map[uint64]*NetConnection)}
+
+// add 分配连接的ID.
+func (r *clientRegistry) add(nc *NetConnection) {
+	nc.id = atomic.AddUint64(&r.nextID, 1)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.conns[nc.id] = nc
+}
+
+func (r *clientRegistry) remove(nc *NetConnection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.conns, nc.id)
+	r.closedBytesIn += nc.BytesIn()
+	r.closedBytesOut += nc.BytesOut()
+}
+
+// Accepted 一共接收的客户端连接数.
+func (r *clientRegistry) Accepted() uint64 {
+	return atomic.LoadUint64(&r.nextID)
+}
+
+// Bytes 所有客户端连接一共读取和发送的byte数 包括已经关闭的连接.
+func (r *clientRegistry) Bytes() (in, out uint64) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	in, out = r.closedBytesIn, r.closedBytesOut
+	for _, nc := range r.conns {
+		in += nc.BytesIn()
+		out += nc.BytesOut()
+	}
+
+	return in, out
+}
+
+func (r *clientRegistry) Get(id uint64) *NetConnection {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.conns[id]
+}
+
+// List 按照ID排序.
+func (r *clientRegistry) List() []*NetConnection {
+	r.lock.RLock()
+	list := make([]*NetConnection, 0, len(r.conns))
+	for _, nc := range r.conns {
+		list = append(list, nc)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+
+	return list
+}
+
+// AppInfo 一个app的状态 Configured 表示在配置文件中 没有配置但是有流的app也会列出.
+type AppInfo struct {
+	Vhost       string `json:"vhost,omitempty"`
+	Name        string `json:"name"`
+	Configured  bool   `json:"configured"`
+	Streams     int    `json:"streams"`
+	Publishers  int    `json:"publishers"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// AdminStream 管理接口中一路流的状态 包括录制和转推.
+type AdminStream struct {
+	StreamStats
+	Recording string        `json:"recording,omitempty"`
+	Relays    []RelayStatus `json:"relays,omitempty"`
+}
+
+func newAdminStream(s *Stream) AdminStream {
+	return AdminStream{
+		StreamStats: s.Stats(),
+		Recording:   recordManager.Recording(s),
+		Relays:      relayManager.StreamStatus(s),
+	}
+}
+
+// AdminServer 管理接口 路径相对于 admin.path
+//
+//	GET  apps streams clients log/level
+//	POST clients/kick?id=
+//	POST log/level?level=debug|info|warn|error 重新加载配置后恢复为配置中的级别
+//	POST streams/stop?vhost=&app=&stream=
+//	POST record/start?vhost=&app=&stream=&dir=  record/stop?vhost=&app=&stream=
+//	POST relay/add?vhost=&app=&stream=&url=  relay/remove?vhost=&app=&stream=&url=
+//	GET POST DELETE ban 封禁列表 参数见 BanList.ServeHTTP
+type AdminServer struct {
+	prefix string
+}
+
+func newAdminServer(prefix string) *AdminServer {
+	return &AdminServer{prefix: prefix}
+}
+
+// authorized token 在每次请求时读取 重新加载配置后立即生效.
+func (a *AdminServer) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	want := conf().Admin.Token
+
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	route := strings.TrimPrefix(r.URL.Path, a.prefix)
+	if route == "ban" {
+		banList.ServeHTTP(w, r)
+
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		switch route {
+		case "apps":
+			writeJSON(w, listApps())
+		case "streams":
+			writeJSON(w, a.streams())
+		case "clients":
+			writeJSON(w, a.clients())
+		case "log/level":
+			writeJSON(w, map[string]string{"level": logOut.Level().String()})
+		case "relay":
+			// 转推地址中可能带有推流密钥 只在管理接口中提供
+			relayManager.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	switch route {
+	case "clients/kick":
+		a.kick(w, r)
+	case "log/level":
+		level, err := ParseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		logOut.SetLevel(level)
+		logger().Info("log level changed by admin", "level", level)
+		writeJSON(w, map[string]string{"level": level.String()})
+	case "streams/stop", "record/start", "record/stop", "relay/add", "relay/remove":
+		a.streamAction(w, r, route)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// listApps 配置中的app和有流的app 按照配置的顺序.
+func listApps() []AppInfo {
+	var apps []AppInfo
+	index := make(map[string]int)
+	add := func(vhost, name string) *AppInfo {
+		key := vhost + ":" + name
+		if i, ok := index[key]; ok {
+			return &apps[i]
+		}
+		index[key] = len(apps)
+		apps = append(apps, AppInfo{Vhost: vhost, Name: name})
+
+		return &apps[len(apps)-1]
+	}
+
+	c := conf()
+	for _, app := range c.Apps {
+		add("", app.Name).Configured = true
+	}
+	for _, v := range c.Vhosts {
+		for _, app := range v.Apps {
+			add(v.Name, app.Name).Configured = true
+		}
+	}
+
+	// 带有实例的app 例如 live/room1 单独列出
+	for _, s := range streamManager.Streams() {
+		app := add(s.Vhost, s.App)
+		app.Streams++
+		if s.Publisher() != nil {
+			app.Publishers++
+		}
+		app.Subscribers += s.SubscriberCount()
+	}
+
+	return apps
+}
+
+func (a *AdminServer) streams() []AdminStream {
+	streams := streamManager.Streams()
+	list := make([]AdminStream, 0, len(streams))
+	for _, s := range streams {
+		list = append(list, newAdminStream(s))
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return streamKey(list[i].Vhost, list[i].App, list[i].Name) < streamKey(list[j].Vhost, list[j].App, list[j].Name)
+	})
+
+	return list
+}
+
+func (a *AdminServer) clients() []ClientInfo {
+	conns := clients.List()
+	list := make([]ClientInfo, 0, len(conns))
+	for _, nc := range conns {
+		list = append(list, nc.Info())
+	}
+
+	return list
+}
+
+// kick 关闭客户端连接 连接上的发布和播放会被清理.
+func (a *AdminServer) kick(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+
+		return
+	}
+
+	nc := clients.Get(id)
+	if nc == nil {
+		http.Error(w, fmt.Sprintf("client %d not found", id), http.StatusNotFound)
+
+		return
+	}
+
+	info := nc.Info()
+	_ = nc.Close()
+	// nc.log 由连接的goroutine修改 这里使用连接信息重新构造
+	logger().With("conn", info.ID, "remote", info.Addr).Info("kicked by admin")
+	writeJSON(w, info)
+}
+
+// streamAction 只能对正在发布的流操作.
+func (a *AdminServer) streamAction(w http.ResponseWriter, r *http.Request, route string) {
+	q := r.URL.Query()
+	s := streamManager.Get(q.Get("vhost"), q.Get("app"), q.Get("stream"))
+	if s == nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+
+		return
+	}
+	p := s.Publisher()
+	if p == nil {
+		http.Error(w, s.Key()+" is not published", http.StatusNotFound)
+
+		return
+	}
+
+	switch route {
+	case "streams/stop":
+		// 拉流的发布者断开后会重新拉流
+		_ = p.Close()
+		logger().Info("publisher stopped by admin", "stream", s.Key())
+	case "record/start":
+		if _, err := recordManager.Start(s, q.Get("dir")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	case "record/stop":
+		if recordManager.Stop(s) == "" {
+			http.Error(w, s.Key()+" is not recording", http.StatusNotFound)
+
+			return
+		}
+	case "relay/add":
+		if err := relayManager.Add(s, q.Get("url")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	case "relay/remove":
+		if !relayManager.Remove(s, q.Get("url")) {
+			http.Error(w, s.Key()+" is not relayed to "+q.Get("url"), http.StatusNotFound)
+
+			return
+		}
+	}
+
+	writeJSON(w, newAdminStream(s))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminServer(t *testing.T) {
+	defer setConfig(conf())
+
+	c := *conf()
+	c.Admin = AdminConfig{Path: "/api/", Token: "secret"}
+	setConfig(&c)
+
+	addr := startTestServer(t)
+	a := newAdminServer("/api/")
+
+	do := func(method, path, token string, v interface{}) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if v != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return w.Code
+	}
+
+	if code := do(http.MethodGet, "/api/streams", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("no token: %d", code)
+	}
+	if code := do(http.MethodGet, "/api/streams?token=wrong", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", code)
+	}
+
+	// 封禁列表也需要 token
+	if code := do(http.MethodPost, "/api/ban?ip=203.0.113.0/24", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("ban without token: %d", code)
+	}
+	var bans []BanEntry
+	if code := do(http.MethodPost, "/api/ban?ip=203.0.113.0/24&reason=test", "secret", &bans); code != http.StatusOK || !banList.Banned(net.ParseIP("203.0.113.1")) {
+		t.Fatalf("ban: %d %+v", code, bans)
+	}
+	if code := do(http.MethodDelete, "/api/ban?ip=203.0.113.0/24", "secret", nil); code != http.StatusOK || banList.Banned(net.ParseIP("203.0.113.1")) {
+		t.Fatalf("unban: %d", code)
+	}
+
+	// 转推状态中有推流地址 也需要 token
+	if code := do(http.MethodGet, "/api/relay", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("relay without token: %d", code)
+	}
+	var relays []RelayStatus
+	if code := do(http.MethodGet, "/api/relay", "secret", &relays); code != http.StatusOK {
+		t.Fatalf("relay: %d", code)
+	}
+
+	pub, err := DialRtmp(fmt.Sprintf("rtmp://%s/live/admin", addr), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err = pub.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	seq := &AVPacket{Type: RtmpMsgVideo, Payload: []byte{0x17, 0, 0, 0, 0}}
+	if err = pub.WritePacket(seq); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待服务端处理完 publish
+	var streams []AdminStream
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		streams = nil
+		do(http.MethodGet, "/api/streams", "secret", &streams)
+		if len(streams) == 1 && streams[0].Publisher != "" && streams[0].Video != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("streams is %+v", streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := streams[0]; s.App != "live" || s.Name != "admin" || s.Video.Codec != "H.264" {
+		t.Errorf("stream is %+v", s)
+	}
+
+	var clientList []ClientInfo
+	do(http.MethodGet, "/api/clients", "secret", &clientList)
+	var publisher *ClientInfo
+	for i := range clientList {
+		if clientList[i].State == ClientStatePublishing {
+			publisher = &clientList[i]
+		}
+	}
+	if publisher == nil || publisher.App != "live" || publisher.BytesIn == 0 {
+		t.Fatalf("clients is %+v", clientList)
+	}
+
+	var apps []AppInfo
+	do(http.MethodGet, "/api/apps", "secret", &apps)
+	if len(apps) != 1 || apps[0].Name != "live" || apps[0].Publishers != 1 {
+		t.Errorf("apps is %+v", apps)
+	}
+
+	if code := do(http.MethodPost, "/api/record/stop?app=live&stream=admin", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("stop record not started: %d", code)
+	}
+	if code := do(http.MethodPost, "/api/streams/stop?app=live&stream=none", "secret", nil); code != http.StatusNotFound {
+		t.Errorf("stop unknown stream: %d", code)
+	}
+
+	if code := do(http.MethodPost, fmt.Sprintf("/api/clients/kick?id=%d", publisher.ID), "secret", nil); code != http.StatusOK {
+		t.Fatalf("kick: %d", code)
+	}
+	for streamManager.Get("", "live", "admin") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publisher not kicked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
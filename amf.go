@@ -240,6 +240,8 @@ func (amf *AMF) decodeObject() (AMFObject, error) {
 	case AMF0Undefined:
 		return amf.readUndefined()
 	case AMF0Reference:
+	case AMF0MixedArray:
+		return amf.readMixedArray()
 	case AMF0Array:
 		return amf.readArray()
 	case AMF0EndObject:
@@ -257,24 +259,19 @@ func (amf *AMF) decodeObject() (AMFObject, error) {
 
 func (amf *AMF) encodeObject(t AMFObjects) error {
 	// 写入类型名字
-	amf.WriteByte(AMF0Object)
+	if err := amf.WriteByte(AMF0Object); err != nil {
+		return err
+	}
 
 	// 将类型写入
 	for k, v := range t {
 		// 写一个key 写一个值
-		switch vv := v.(type) {
-		case string:
-			if err := amf.writeObjectString(k, vv); err != nil {
-				return err
-			}
-		case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-			if err := amf.writeObjectNumer(k, utils.ToFloat64(vv)); err != nil {
-				return err
-			}
-		case bool:
-			if err := amf.writeObjectBool(k, vv); err != nil {
-				return err
-			}
+		if err := amf.writeObjectKey(k); err != nil {
+			return err
+		}
+
+		if err := amf.writeValue(v); err != nil {
+			return err
 		}
 	}
 
@@ -286,6 +283,78 @@ func (amf *AMF) encodeObject(t AMFObjects) error {
 	return nil
 }
 
+// writeValue 根据值的类型写入对应的AMF0类型.
+func (amf *AMF) writeValue(v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		return amf.writeNull()
+	case string:
+		return amf.writeString(vv)
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return amf.writeNumber(utils.ToFloat64(vv))
+	case bool:
+		return amf.writeBool(vv)
+	case AMFObjects:
+		return amf.encodeObject(vv)
+	case []AMFObject:
+		return amf.writeStrictArray(vv)
+	case []interface{}:
+		values := make([]AMFObject, len(vv))
+		for i := range vv {
+			values[i] = vv[i]
+		}
+
+		return amf.writeStrictArray(values)
+	}
+
+	return errors.Errorf("Not Support Value Type %T", v)
+}
+
+func (amf *AMF) writeNull() error {
+	return amf.WriteByte(AMF0Null)
+}
+
+func (amf *AMF) writeStrictArray(values []AMFObject) error {
+	if err := amf.WriteByte(AMF0Array); err != nil {
+		return err
+	}
+
+	if err := binary.Write(amf, binary.BigEndian, uint32(len(values))); err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		if err := amf.writeValue(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMixedArray ECMA Array 和 Object 一样是键值对 只是多了4byte的size.
+func (amf *AMF) writeMixedArray(t AMFObjects) error {
+	if err := amf.WriteByte(AMF0MixedArray); err != nil {
+		return err
+	}
+
+	if err := binary.Write(amf, binary.BigEndian, uint32(len(t))); err != nil {
+		return err
+	}
+
+	for k, v := range t {
+		if err := amf.writeObjectKey(k); err != nil {
+			return err
+		}
+
+		if err := amf.writeValue(v); err != nil {
+			return err
+		}
+	}
+
+	return amf.writeObjectEnd()
+}
+
 func (amf *AMF) writeObjectEnd() error {
 	_, err := amf.Write(endObj)
 
@@ -372,33 +441,61 @@ func (amf *AMF) readEndObject() (AMFObject, error) {
 
 // 这里的array也是一个map 只不过可以读出来 size
 // 第一个字节是类型
-// 后面4个Byte就是size.
-func (amf *AMF) readArray() (AMFObjects, error) {
+// 后面4个Byte就是size 之后和Object相同 是以 EndObject 结尾的键值对.
+func (amf *AMF) readMixedArray() (AMFObjects, error) {
 	m := newAMFObjects()
 	_, err := amf.ReadByte()
 	if err != nil {
 		return nil, err
 	}
 
+	if _, err = amf.readSize32(); err != nil {
+		return nil, err
+	}
+
+	for {
+		k, err := amf.readObjectKey()
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := amf.decodeObject()
+		if err != nil {
+			return nil, err
+		}
+
+		if v == AMF0EndObject {
+			return m, nil
+		}
+
+		if k != "" {
+			m[k] = v
+		}
+	}
+}
+
+// StrictArray 第一个字节是类型 后面4个Byte是size 然后是 size 个值 没有key.
+func (amf *AMF) readArray() ([]AMFObject, error) {
+	_, err := amf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
 	size, err := amf.readSize32()
 	if err != nil {
 		return nil, err
 	}
+
+	values := make([]AMFObject, 0, size)
 	for i := 0; i < size; i++ {
-		if k, err := amf.readString(); err == nil {
-			if v, err := amf.decodeObject(); err == nil {
-				if k != "" || v != AMF0EndObject {
-					m[k] = v
-
-					continue
-				}
-			}
+		v, err := amf.decodeObject()
+		if err != nil {
+			return nil, err
 		}
-
-		return nil, err
+		values = append(values, v)
 	}
 
-	return m, nil
+	return values, nil
 }
 
 func (amf *AMF) readUndefined() (AMFObject, error) {
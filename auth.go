@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AuthActionConnect = "connect"
+	AuthActionPublish = "publish"
+	AuthActionPlay    = "play"
+)
+
+// AuthRequest 一次需要鉴权的请求 connect 时 Stream 为空.
+type AuthRequest struct {
+	Action     string
+	Vhost      string
+	App        string // 带有实例的app
+	Stream     string
+	TcURL      *TcURL
+	RemoteAddr string
+	// tcUrl 和 connect 中 app 的参数 publish play 时再合并流名中的参数 流名中的优先
+	Query url.Values
+}
+
+// Authenticator 鉴权 返回的错误作为拒绝的原因发送给客户端.
+type Authenticator interface {
+	Authenticate(req *AuthRequest) error
+}
+
+type AuthenticatorFunc func(req *AuthRequest) error
+
+func (f AuthenticatorFunc) Authenticate(req *AuthRequest) error {
+	return f(req)
+}
+
+var (
+	authLock       sync.RWMutex
+	authenticators []Authenticator
+)
+
+// AddAuthenticator 注册鉴权 所有的鉴权都通过才允许.
+func AddAuthenticator(a Authenticator) {
+	authLock.Lock()
+	defer authLock.Unlock()
+
+	authenticators = append(authenticators, a)
+}
+
+func authenticate(req *AuthRequest) error {
+	authLock.RLock()
+	list := authenticators
+	authLock.RUnlock()
+
+	for _, a := range list {
+		if err := a.Authenticate(req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newAuthRequest 流名中的参数和连接的参数合并.
+func newAuthRequest(nc *NetConnection, action, stream, query string) *AuthRequest {
+	q := make(url.Values)
+	if nc.tcURL != nil {
+		for k, v := range nc.tcURL.Query {
+			q[k] = v
+		}
+	}
+
+	streamQuery, _ := url.ParseQuery(query)
+	for k, v := range streamQuery {
+		q[k] = v
+	}
+
+	return &AuthRequest{
+		Action:     action,
+		Vhost:      nc.vhost,
+		App:        nc.appName,
+		Stream:     stream,
+		TcURL:      nc.tcURL,
+		RemoteAddr: nc.RemoteAddr(),
+		Query:      q,
+	}
+}
+
+// signPath 签名的路径 connect 为 /app publish play 为 /app/stream.
+func signPath(app, stream string) string {
+	if stream == "" {
+		return "/" + app
+	}
+
+	return "/" + app + "/" + stream
+}
+
+// SignURL 计算签名 签名的内容为 action:path:expires 使用 HMAC-SHA256.
+func SignURL(secret, action, app, stream string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(action + ":" + signPath(app, stream) + ":" + strconv.FormatInt(expires, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// configAuthenticator 内置的鉴权 按照 auth 配置校验签名和推流密钥 重新加载配置后立即生效.
+type configAuthenticator struct {
+	now func() time.Time
+}
+
+func (a *configAuthenticator) Authenticate(req *AuthRequest) error {
+	cfg := conf().Auth
+
+	if req.Action == AuthActionPublish {
+		if key, ok := cfg.publishKey(req.Vhost, req.App, req.Stream); ok {
+			if !hmac.Equal([]byte(req.Query.Get("key")), []byte(key)) {
+				return errors.New("invalid publish key")
+			}
+
+			// 有推流密钥的流不再校验签名
+			return nil
+		}
+	}
+
+	if cfg.Secret == "" || !cfg.needSign(req.Action) {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(req.Query.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid expires")
+	}
+	if a.now().Unix() > expires {
+		return errors.New("url expired")
+	}
+
+	sign := SignURL(cfg.Secret, req.Action, req.App, req.Stream, expires)
+	if !hmac.Equal([]byte(req.Query.Get("sign")), []byte(sign)) {
+		return errors.New("invalid sign")
+	}
+
+	return nil
+}
+
+// runSign sign 子命令 生成签名的地址
+//
+//	rtmp sign -secret xxx [flags] <rtmp://host/app/stream>
+func runSign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	secret := fs.String("secret", "", "auth.secret in the server config")
+	action := fs.String("action", AuthActionPublish, "connect, publish or play")
+	expires := fs.Duration("expires", time.Hour, "how long the url is valid")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmp sign -secret xxx [flags] <rtmp://host/app/stream>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 || *secret == "" {
+		fs.Usage()
+
+		return errors.New("need secret and url")
+	}
+
+	u, err := ParseRtmpURL(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	exp := time.Now().Add(*expires).Unix()
+	stream, query := splitStreamName(u.Stream)
+	if *action == AuthActionConnect {
+		stream = ""
+	}
+
+	q, _ := url.ParseQuery(query)
+	q.Set("expires", strconv.FormatInt(exp, 10))
+	q.Set("sign", SignURL(*secret, *action, u.App, stream, exp))
+
+	switch *action {
+	case AuthActionConnect:
+		// 签名在 tcUrl 中 推流和播放时使用这个 tcUrl
+		fmt.Println(u.TcURL + "?" + q.Encode())
+	case AuthActionPublish, AuthActionPlay:
+		fmt.Println(u.TcURL + "/" + stream + "?" + q.Encode())
+	default:
+		return errors.Errorf("unknown action %s", *action)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConfigAuthenticator(t *testing.T) {
+	defer setConfig(conf())
+
+	c, err := parseConfig([]byte(`
+auth:
+  secret: s3cret
+  sign: [publish, play]
+  publish_keys:
+    - app: live
+      stream: cam1
+      key: k1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(c)
+
+	now := time.Unix(1700000000, 0)
+	a := &configAuthenticator{now: func() time.Time { return now }}
+
+	signed := func(action, stream string, expires int64) url.Values {
+		return url.Values{
+			"expires": {strconv.FormatInt(expires, 10)},
+			"sign":    {SignURL("s3cret", action, "live", stream, expires)},
+		}
+	}
+	valid := now.Add(time.Minute).Unix()
+
+	tests := []struct {
+		name   string
+		action string
+		stream string
+		query  url.Values
+		ok     bool
+	}{
+		{"connect not signed", AuthActionConnect, "", nil, true},
+		{"publish signed", AuthActionPublish, "s", signed(AuthActionPublish, "s", valid), true},
+		{"play signed", AuthActionPlay, "s", signed(AuthActionPlay, "s", valid), true},
+		{"publish missing", AuthActionPublish, "s", nil, false},
+		{"publish expired", AuthActionPublish, "s", signed(AuthActionPublish, "s", now.Add(-time.Second).Unix()), false},
+		{"sign for other stream", AuthActionPublish, "s", signed(AuthActionPublish, "t", valid), false},
+		{"play sign used to publish", AuthActionPublish, "s", signed(AuthActionPlay, "s", valid), false},
+		{"publish key", AuthActionPublish, "cam1", url.Values{"key": {"k1"}}, true},
+		{"wrong publish key", AuthActionPublish, "cam1", url.Values{"key": {"k2"}}, false},
+	}
+
+	for _, tt := range tests {
+		q := tt.query
+		if q == nil {
+			q = make(url.Values)
+		}
+		err := a.Authenticate(&AuthRequest{Action: tt.action, App: "live", Stream: tt.stream, Query: q})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err is %v", tt.name, err)
+		}
+	}
+}
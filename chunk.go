@@ -61,6 +61,8 @@ type ChunkMessageHeader struct {
 	MessageLength   uint32 // 2byte
 	MessageTypeID   byte   // 1 byte
 	MessageStreamID uint32 // 4byte
+	// 上一个chunk的时间差 fmt=3的新消息需要使用
+	timestampDelta uint32
 }
 
 type ChunkExtendedTimestamp struct {
@@ -101,7 +103,14 @@ func (nc *NetConnection) encodeChunk12(head *ChunkHeader, payload []byte, size i
 	b := mem_pool.GetSlice(12)
 
 	b[0] = byte(RtmpChunkHead12 + head.ChunkBasicHeader.ChunkStreamID)
-	utils.BigEndian.PutUint24(b[1:], head.ChunkMessageHeader.Timestamp)
+	// timestamp 超过3byte时 这里写0xffffff 真正的值写到 ExtendTimestamp
+	if head.ChunkMessageHeader.Timestamp >= RtmpMaxTimestamp {
+		head.ChunkExtendedTimestamp.ExtendTimestamp = head.ChunkMessageHeader.Timestamp
+		utils.BigEndian.PutUint24(b[1:], RtmpMaxTimestamp)
+	} else {
+		head.ChunkExtendedTimestamp.ExtendTimestamp = 0
+		utils.BigEndian.PutUint24(b[1:], head.ChunkMessageHeader.Timestamp)
+	}
 	utils.BigEndian.PutUint24(b[4:], head.ChunkMessageHeader.MessageLength)
 	b[7] = head.ChunkMessageHeader.MessageTypeID
 	// 这里写StreamID的时候一定要注意使用小端
@@ -113,13 +122,8 @@ func (nc *NetConnection) encodeChunk12(head *ChunkHeader, payload []byte, size i
 	mem_pool.RecycleSlice(b)
 
 	// 查看是否需要写 ExtendTimestamp
-	if head.ChunkMessageHeader.Timestamp == 0xffffff {
-		b := mem_pool.GetSlice(4)
-		binary.LittleEndian.PutUint32(b, head.ChunkExtendedTimestamp.ExtendTimestamp)
-		if n, err := nc.writeFull(b); err != nil || n != len(b) {
-			return nil, err
-		}
-		mem_pool.RecycleSlice(b)
+	if err := nc.writeExtendTimestamp(head); err != nil {
+		return nil, err
 	}
 
 	// 开始写入payload
@@ -137,5 +141,25 @@ func (nc *NetConnection) encodeChunk1(head *ChunkHeader, payload []byte, size in
 		return nil, err
 	}
 
+	// fmt=3 的chunk 若消息使用了ExtendTimestamp 也需要带上
+	if err := nc.writeExtendTimestamp(head); err != nil {
+		return nil, err
+	}
+
 	return nc.afterEncodeChunk(payload, size)
 }
+
+func (nc *NetConnection) writeExtendTimestamp(head *ChunkHeader) error {
+	if head.ChunkExtendedTimestamp.ExtendTimestamp == 0 {
+		return nil
+	}
+
+	b := mem_pool.GetSlice(4)
+	defer mem_pool.RecycleSlice(b)
+	binary.BigEndian.PutUint32(b, head.ChunkExtendedTimestamp.ExtendTimestamp)
+	if n, err := nc.writeFull(b); err != nil || n != len(b) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RtmpDefaultPort = "1935"
+
+	// 播放时告诉服务端的缓冲时长 单位毫秒
+	ClientBufferLength = 3000
+	// connect 成功后发送给服务端的 Window Acknowledgement Size
+	ClientWindowAckSize = 2500000
+
+	ClientFlashVersion = "FMLE/3.0 (compatible; mou)"
+)
+
+// RtmpURL rtmp://host[:port]/app[/instance]/stream[?args].
+type RtmpURL struct {
+	Host   string // host:port
+	App    string
+	Stream string // 包括后面的参数
+	TcURL  string
+}
+
+// ParseRtmpURL 解析 rtmp 地址 app 为路径的第一段 剩下的都作为流名.
+func ParseRtmpURL(raw string) (*RtmpURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "rtmp" {
+		return nil, errors.Errorf("not support scheme %s", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), RtmpDefaultPort)
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	i := strings.IndexByte(path, '/')
+	if i <= 0 || i == len(path)-1 {
+		return nil, errors.Errorf("rtmp url %s must be rtmp://host/app/stream", raw)
+	}
+
+	r := &RtmpURL{
+		Host:   host,
+		App:    path[:i],
+		Stream: path[i+1:],
+	}
+	if u.RawQuery != "" {
+		r.Stream += "?" + u.RawQuery
+	}
+	r.TcURL = "rtmp://" + u.Host + "/" + r.App
+
+	return r, nil
+}
+
+// ClientOptions 客户端的连接参数.
+type ClientOptions struct {
+	// 握手和 connect 的超时时间
+	Timeout time.Duration
+	// 使用复杂握手 服务端不支持时会按照简单握手处理
+	ComplexHandshake bool
+	// 覆盖 connect 命令中的属性 值为nil时删除该属性
+	ConnectProperties AMFObjects
+	// connect 命令中 command object 后面的参数 一些服务器用来鉴权
+	ConnectArgs []interface{}
+	// 客户端发送数据使用的 chunk size
+	ChunkSize uint32
+	// 发送给服务端的 Window Acknowledgement Size
+	WindowAckSize uint32
+	// publish 的类型 live record append
+	PublishType string
+}
+
+func defaultClientOptions() *ClientOptions {
+	return &ClientOptions{
+		Timeout:          10 * time.Second,
+		ComplexHandshake: true,
+		ChunkSize:        RtmpServerChunkSize,
+		WindowAckSize:    ClientWindowAckSize,
+		PublishType:      "live",
+	}
+}
+
+// CallError 服务端返回的 _error 或者 level 为 error 的 onStatus.
+type CallError struct {
+	Command string
+	Info    AMFObjects
+}
+
+func (e *CallError) Error() string {
+	return e.Command + " " + statusDescription(e.Info)
+}
+
+// Code 返回 info 中的 code 例如 NetConnection.Connect.Rejected.
+func (e *CallError) Code() string {
+	code, _ := e.Info["code"].(string)
+
+	return code
+}
+
+// RtmpClient 主动连接其他服务器的客户端 复用 NetConnection 的 chunk 读写.
+type RtmpClient struct {
+	*NetConnection
+	url           *RtmpURL
+	opts          *ClientOptions
+	transactionID uint64
+	streamID      uint32
+	readTimeout   time.Duration
+	// 聚合消息拆分出来还没有返回的包
+	pending []*AVPacket
+	// connect 返回的 properties 和 information
+	ServerProperties AMFObjects
+	ServerInfo       AMFObjects
+	// 播放时收到 onStatus 的回调
+	OnStatus func(info AMFObjects)
+}
+
+// DialRtmp 使用默认参数建立连接 完成握手并发送 connect.
+func DialRtmp(rawURL string, timeout time.Duration) (*RtmpClient, error) {
+	opts := defaultClientOptions()
+	opts.Timeout = timeout
+
+	return DialRtmpWithOptions(rawURL, opts)
+}
+
+// DialRtmpWithOptions 建立连接 完成握手并发送 connect opts 为nil时使用默认参数.
+func DialRtmpWithOptions(rawURL string, opts *ClientOptions) (*RtmpClient, error) {
+	if opts == nil {
+		opts = defaultClientOptions()
+	}
+
+	u, err := ParseRtmpURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Host, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &RtmpClient{
+		NetConnection: newNetConnection(conn),
+		url:           u,
+		opts:          opts,
+	}
+	c.appName = u.App
+	c.log = c.log.With("remote", conn.RemoteAddr().String())
+
+	// 握手和 connect 都需要在超时时间内完成
+	_ = conn.SetDeadline(time.Now().Add(opts.Timeout))
+	if err = clientHandshake(c.rw, opts.ComplexHandshake); err != nil {
+		_ = conn.Close()
+
+		return nil, errors.Wrap(err, "handshake")
+	}
+
+	if err = c.connect(); err != nil {
+		_ = conn.Close()
+
+		return nil, errors.Wrap(err, "connect")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+func (c *RtmpClient) nextTransactionID() uint64 {
+	c.transactionID++
+
+	return c.transactionID
+}
+
+func (c *RtmpClient) sendCommand(name string, streamID uint32, args ...interface{}) (uint64, error) {
+	id := c.nextTransactionID()
+	m := &RequestCommandMessage{
+		CommandMessage: CommandMessage{CommandName: name, TransactionID: id},
+		Arguments:      args,
+		StreamID:       streamID,
+	}
+
+	return id, c.writeMessage(RtmpMsgAMF0Command, m)
+}
+
+// waitResult 等待指定事务的 _result 或 _error 中间的其他消息都丢弃.
+func (c *RtmpClient) waitResult(transactionID uint64) (*CallMessage, error) {
+	for {
+		msg, err := c.getMsg()
+		if err != nil {
+			return nil, err
+		}
+
+		call, ok := msg.MsgData.(*CallMessage)
+		if !ok || call.TransactionID != transactionID {
+			continue
+		}
+
+		switch call.CommandName {
+		case CommandResult:
+			return call, nil
+		case CommandError:
+			return nil, &CallError{Command: CommandError, Info: DecodeAMFObject(call.Optional)}
+		}
+	}
+}
+
+// waitStatus 等待 onStatus 返回的 code.
+func (c *RtmpClient) waitStatus() (string, error) {
+	for {
+		msg, err := c.getMsg()
+		if err != nil {
+			return "", err
+		}
+
+		call, ok := msg.MsgData.(*CallMessage)
+		if !ok || call.CommandName != CommandOnStatus {
+			continue
+		}
+
+		info := DecodeAMFObject(call.Optional)
+		if info == nil {
+			continue
+		}
+		code, _ := info["code"].(string)
+		if level, _ := info["level"].(string); level == LevelError {
+			return code, &CallError{Command: CommandOnStatus, Info: info}
+		}
+
+		return code, nil
+	}
+}
+
+func statusDescription(obj interface{}) string {
+	info := DecodeAMFObject(obj)
+	if info == nil {
+		return "unknown error"
+	}
+
+	code, _ := info["code"].(string)
+	desc, _ := info["description"].(string)
+
+	return strings.TrimSpace(code + " " + desc)
+}
+
+func (c *RtmpClient) connect() error {
+	pro := newAMFObjects()
+	pro["app"] = c.url.App
+	pro["type"] = "nonprivate"
+	pro["flashVer"] = ClientFlashVersion
+	pro["tcUrl"] = c.url.TcURL
+	pro["fpad"] = false
+	pro["capabilities"] = 15
+	pro["audioCodecs"] = 3191
+	pro["videoCodecs"] = 252
+	pro["videoFunction"] = 1
+	pro["objectEncoding"] = 0
+	for k, v := range c.opts.ConnectProperties {
+		if v == nil {
+			delete(pro, k)
+
+			continue
+		}
+		pro[k] = v
+	}
+
+	args := append([]interface{}{pro}, c.opts.ConnectArgs...)
+	id, err := c.sendCommand(CommandConnect, 0, args...)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.waitResult(id)
+	if err != nil {
+		return err
+	}
+	c.ServerProperties = DecodeAMFObject(result.Object)
+	c.ServerInfo = DecodeAMFObject(result.Optional)
+
+	if err = c.SendMessage(SendAckWindowSizeMessage, c.opts.WindowAckSize); err != nil {
+		return err
+	}
+
+	return c.SendMessage(SendSetChunkSizeMessage, c.opts.ChunkSize)
+}
+
+// Call 在 NetConnection 上调用服务端的方法 返回 _result 服务端返回 _error 时 err 为 *CallError
+// 等待结果时会读取连接 不能和 ReadPacket 同时使用.
+func (c *RtmpClient) Call(name string, args ...interface{}) (*CallMessage, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	// 第一个参数为 command object 没有时为null
+	if len(args) == 0 {
+		args = []interface{}{nil}
+	}
+
+	id, err := c.sendCommand(name, 0, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.waitResult(id)
+}
+
+func (c *RtmpClient) createStream() error {
+	id, err := c.sendCommand(CommandCreateStream, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.waitResult(id)
+	if err != nil {
+		return err
+	}
+
+	streamID, ok := result.Optional.(float64)
+	if !ok {
+		return errors.New("createStream result has no stream id")
+	}
+	c.streamID = uint32(streamID)
+
+	return nil
+}
+
+// Publish 创建流并开始发布 等到 NetStream.Publish.Start 后返回.
+func (c *RtmpClient) Publish() error {
+	if _, err := c.sendCommand(CommandReleaseStream, 0, nil, c.url.Stream); err != nil {
+		return err
+	}
+	if _, err := c.sendCommand(CommandFCPublish, 0, nil, c.url.Stream); err != nil {
+		return err
+	}
+
+	if err := c.createStream(); err != nil {
+		return err
+	}
+
+	if _, err := c.sendCommand(CommandPublish, c.streamID, nil, c.url.Stream, c.opts.PublishType); err != nil {
+		return err
+	}
+
+	code, err := c.waitStatus()
+	if err != nil {
+		return err
+	}
+	if code != NetStreamPublishStart {
+		return errors.Errorf("publish fail, status is %s", code)
+	}
+
+	return nil
+}
+
+// Receive 播放时通知服务端是否需要音频和视频.
+func (c *RtmpClient) Receive(audio, video bool) error {
+	if _, err := c.sendCommand(CommandReceiveAudio, c.streamID, nil, audio); err != nil {
+		return err
+	}
+
+	_, err := c.sendCommand(CommandReceiveVideo, c.streamID, nil, video)
+
+	return err
+}
+
+// WritePacket 发布时写入一个音视频包.
+func (c *RtmpClient) WritePacket(p *AVPacket) error {
+	if len(p.Payload) == 0 {
+		return nil
+	}
+
+	return c.writeMessage(p.Type, &AVMessage{
+		Timestamp: p.Timestamp,
+		StreamID:  c.streamID,
+		Payload:   p.Payload,
+	})
+}
+
+// discardMessages 发布时服务端发过来的消息需要读掉 不然会把TCP的缓冲区占满.
+func (c *RtmpClient) discardMessages() error {
+	for {
+		if _, err := c.getMsg(); err != nil {
+			return err
+		}
+	}
+}
+
+// SetReadTimeout 播放时每次读取的超时时间 为0表示不超时.
+func (c *RtmpClient) SetReadTimeout(d time.Duration) {
+	c.readTimeout = d
+}
+
+// Play 创建流并开始播放 等到 NetStream.Play.Start 后返回.
+func (c *RtmpClient) Play() error {
+	return c.PlayRange(-2, -1)
+}
+
+// PlayRange 指定开始时间和时长播放 单位为秒
+// start 为 -2 时先找直播流 没有再找点播 -1 只播放直播 duration 为 -1 时播放到结束.
+func (c *RtmpClient) PlayRange(start, duration float64) error {
+	if err := c.createStream(); err != nil {
+		return err
+	}
+
+	if _, err := c.sendCommand(CommandPlay, c.streamID, nil, c.url.Stream, start, duration); err != nil {
+		return err
+	}
+
+	// SetBufferLength 事件数据为 4byte streamID + 4byte 毫秒数
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint16(b, RtmpUserSetBufferLen)
+	binary.BigEndian.PutUint32(b[2:], c.streamID)
+	binary.BigEndian.PutUint32(b[6:], ClientBufferLength)
+	if err := c.writeMessage(RtmpMsgUserControl, &AVMessage{Payload: b}); err != nil {
+		return err
+	}
+
+	// 之前可能会先收到 NetStream.Play.Reset
+	for {
+		code, err := c.waitStatus()
+		if err != nil {
+			return err
+		}
+		if code == NetStreamPlayStart {
+			return nil
+		}
+	}
+}
+
+// ReadPacket 播放时读取一个音视频包 命令等其他消息会被丢弃
+// 服务端通知播放结束时返回 io.EOF.
+func (c *RtmpClient) ReadPacket() (*AVPacket, error) {
+	for {
+		if len(c.pending) > 0 {
+			p := c.pending[0]
+			c.pending = c.pending[1:]
+
+			return p, nil
+		}
+
+		if c.readTimeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+
+		msg, err := c.getMsg()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.MessageTypeID == RtmpMsgAggregate {
+			c.pending = splitAggregate(msg)
+
+			continue
+		}
+
+		if call, ok := msg.MsgData.(*CallMessage); ok {
+			if call.CommandName != CommandOnStatus {
+				continue
+			}
+
+			info := DecodeAMFObject(call.Optional)
+			if c.OnStatus != nil && info != nil {
+				c.OnStatus(info)
+			}
+			code, _ := info["code"].(string)
+			level, _ := info["level"].(string)
+			if level == LevelError || code == NetStreamPlayStop || code == NetStreamPlayUnpublishNotify {
+				return nil, io.EOF
+			}
+
+			continue
+		}
+
+		if p := newAVPacket(msg); p != nil {
+			return p, nil
+		}
+	}
+}
+
+// splitAggregate 聚合消息的内容是连续的FLV tag
+// tag的时间戳是相对于第一个tag的 需要加上消息本身的时间戳.
+func splitAggregate(msg *Chunk) []*AVPacket {
+	var packets []*AVPacket
+
+	r := NewFlvReader(bytes.NewReader(msg.Body))
+	first := true
+	var base uint32
+	for {
+		tag, err := r.ReadTag()
+		if err != nil {
+			break
+		}
+		if first {
+			base = tag.Timestamp
+			first = false
+		}
+
+		tag.Timestamp = msg.Timestamp + tag.Timestamp - base
+		if p := tag.Packet(); p != nil {
+			packets = append(packets, p)
+		}
+	}
+
+	return packets
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"rtmp/mem_pool"
+)
+
+var initPoolOnce sync.Once
+
+// startTestServer 在随机端口上启动服务 返回监听的地址.
+func startTestServer(t *testing.T) string {
+	initPoolOnce.Do(mem_pool.InitPool)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go newNetConnection(conn).HandlerMessage()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientPublishPlay(t *testing.T) {
+	addr := startTestServer(t)
+
+	for _, complex := range []bool{true, false} {
+		opts := defaultClientOptions()
+		opts.ComplexHandshake = complex
+		opts.Timeout = 3 * time.Second
+
+		url := fmt.Sprintf("rtmp://%s/live/client%v", addr, complex)
+		pub, err := DialRtmpWithOptions(url, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := pub.ServerInfo["code"].(string); code != NetConnectionConnectSuccess {
+			t.Fatalf("connect code is %s", code)
+		}
+		if err = pub.Publish(); err != nil {
+			t.Fatal(err)
+		}
+
+		player, err := DialRtmpWithOptions(url, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = player.Play(); err != nil {
+			t.Fatal(err)
+		}
+		player.SetReadTimeout(3 * time.Second)
+
+		sent := &AVPacket{Type: RtmpMsgVideo, Timestamp: 40, Payload: []byte{0x17, 1, 0, 0, 0, 1, 2, 3}}
+		if err = pub.WritePacket(sent); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := player.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != sent.Type || got.Timestamp != sent.Timestamp || string(got.Payload) != string(sent.Payload) {
+			t.Fatalf("got packet %+v", got)
+		}
+
+		_ = player.Close()
+		_ = pub.Close()
+	}
+}
+
+// startCallServer 只处理 connect 和测试用的命令 echo 返回第一个参数 fail 返回 _error.
+func startCallServer(t *testing.T) string {
+	initPoolOnce.Do(mem_pool.InitPool)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		nc := newNetConnection(conn)
+		if _, err = handshake(nc.rw); err != nil {
+			return
+		}
+		reply := func(name string, id uint64, args ...interface{}) {
+			_ = nc.writeMessage(RtmpMsgAMF0Command, &RequestCommandMessage{
+				CommandMessage: CommandMessage{CommandName: name, TransactionID: id},
+				Arguments:      args,
+			})
+		}
+
+		for {
+			msg, err := nc.getMsg()
+			if err != nil {
+				return
+			}
+			call, ok := msg.MsgData.(*CallMessage)
+			if !ok {
+				continue
+			}
+
+			switch call.CommandName {
+			case CommandConnect:
+				reply(CommandResult, call.TransactionID, AMFObjects{"fmsVer": "test"}, AMFObjects{"code": NetConnectionConnectSuccess})
+			case "echo":
+				// 其他事务的结果和 onStatus 都会被跳过
+				reply(CommandResult, call.TransactionID+100, nil, "other")
+				reply(CommandOnStatus, 0, nil, AMFObjects{"level": "status", "code": "Test.Status"})
+				reply(CommandResult, call.TransactionID, nil, call.Optional)
+			case "fail":
+				reply(CommandError, call.TransactionID, nil, AMFObjects{"level": LevelError, "code": "Test.Failed", "description": "bad"})
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientCall(t *testing.T) {
+	addr := startCallServer(t)
+
+	c, err := DialRtmp(fmt.Sprintf("rtmp://%s/live/call", addr), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, _ := c.ServerProperties["fmsVer"].(string); v != "test" {
+		t.Errorf("server properties %v", c.ServerProperties)
+	}
+
+	// connect 的事务ID是1
+	result, err := c.Call("echo", nil, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TransactionID != 2 || result.CommandName != CommandResult || result.Optional != "hello" {
+		t.Errorf("echo result %+v", result)
+	}
+
+	_, err = c.Call("fail")
+	callErr, ok := err.(*CallError)
+	if !ok || callErr.Command != CommandError || callErr.Code() != "Test.Failed" || callErr.Error() != "_error Test.Failed bad" {
+		t.Fatalf("fail error %v", err)
+	}
+
+	// _error 之后连接还可以继续使用
+	if result, err = c.Call("echo", nil, "again"); err != nil || result.TransactionID != 4 || result.Optional != "again" {
+		t.Errorf("echo after error %+v %v", result, err)
+	}
+}
+
+func TestPublishInvalidName(t *testing.T) {
+	addr := startTestServer(t)
+
+	tests := []struct {
+		url string
+		app string
+	}{
+		{url: "rtmp://%s/live/../../tmp/x"},
+		{url: "rtmp://%s/live/a/b"},
+		{url: "rtmp://%s/live/a%%00b"},
+		// app 的实例也会作为录制的路径
+		{url: "rtmp://%s/live/x", app: "live/.."},
+		{url: "rtmp://%s/live/x", app: "live/a\\..\\b"},
+	}
+
+	for _, tt := range tests {
+		opts := defaultClientOptions()
+		opts.Timeout = 3 * time.Second
+		if tt.app != "" {
+			opts.ConnectProperties = AMFObjects{"app": tt.app}
+		}
+
+		url := fmt.Sprintf(tt.url, addr)
+		c, err := DialRtmpWithOptions(url, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Publish()
+		_ = c.Close()
+		if callErr, ok := err.(*CallError); !ok || callErr.Code() != NetStreamPublishBadName {
+			t.Errorf("%s app %q: got %v", url, tt.app, err)
+		}
+	}
+}
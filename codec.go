@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// FLV 视频Tag中的 CodecID
+	FlvCodecH263 = 2
+	FlvCodecVP6  = 4
+	FlvCodecAVC  = 7
+	FlvCodecHEVC = 12
+
+	// FLV 音频Tag中的 SoundFormat
+	FlvCodecMP3   = 2
+	FlvCodecG711A = 7
+	FlvCodecG711U = 8
+	FlvCodecAAC   = 10
+	FlvCodecSpeex = 11
+)
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AVCDecoderConfigurationRecord 视频 sequence header 中的 avcC.
+type AVCDecoderConfigurationRecord struct {
+	ProfileIndication    byte
+	ProfileCompatibility byte
+	LevelIndication      byte
+	NALULengthSize       int
+	SPS                  [][]byte
+	PPS                  [][]byte
+	Width                int
+	Height               int
+	// 原始的 avcC 数据 fMP4 中直接使用
+	Raw []byte
+}
+
+// Codecs 返回 RFC6381 中定义的 codecs 字符串，例如 avc1.64001f.
+func (r *AVCDecoderConfigurationRecord) Codecs() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", r.ProfileIndication, r.ProfileCompatibility, r.LevelIndication)
+}
+
+func ParseAVCDecoderConfigurationRecord(b []byte) (*AVCDecoderConfigurationRecord, error) {
+	/*
+		avcC 构成:
+			configurationVersion(1byte) + AVCProfileIndication(1byte) + profile_compatibility(1byte)
+			+ AVCLevelIndication(1byte) + lengthSizeMinusOne(低2bit)
+			+ numOfSequenceParameterSets(低5bit) + [spsLength(2byte) + sps]...
+			+ numOfPictureParameterSets(1byte) + [ppsLength(2byte) + pps]...
+	*/
+	if len(b) < 7 {
+		return nil, errors.Errorf("avcC too short, len is %d", len(b))
+	}
+
+	r := &AVCDecoderConfigurationRecord{
+		ProfileIndication:    b[1],
+		ProfileCompatibility: b[2],
+		LevelIndication:      b[3],
+		NALULengthSize:       int(b[4]&0x03) + 1,
+		Raw:                  b,
+	}
+
+	off := 6
+	readSets := func(count int) ([][]byte, error) {
+		sets := make([][]byte, 0, count)
+		for i := 0; i < count; i++ {
+			if off+2 > len(b) {
+				return nil, errors.New("avcC parameter set length overflow")
+			}
+			l := int(b[off])<<8 | int(b[off+1])
+			off += 2
+			if off+l > len(b) {
+				return nil, errors.New("avcC parameter set overflow")
+			}
+			sets = append(sets, b[off:off+l])
+			off += l
+		}
+
+		return sets, nil
+	}
+
+	var err error
+	if r.SPS, err = readSets(int(b[5] & 0x1f)); err != nil {
+		return nil, err
+	}
+	if off >= len(b) {
+		return nil, errors.New("avcC missing pps")
+	}
+	ppsCount := int(b[off])
+	off++
+	if r.PPS, err = readSets(ppsCount); err != nil {
+		return nil, err
+	}
+
+	if len(r.SPS) > 0 {
+		if w, h, err := parseSPSResolution(r.SPS[0]); err == nil {
+			r.Width = w
+			r.Height = h
+		}
+	}
+
+	return r, nil
+}
+
+// bitReader 用于读取 SPS 中的 Exp-Golomb 编码.
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) readBit() (uint, error) {
+	if r.pos >= len(r.b)*8 {
+		return 0, errors.New("bitReader no enough bits")
+	}
+	bit := uint(r.b[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+
+	return v, nil
+}
+
+func (r *bitReader) readUE() (uint, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("bitReader invalid exp-golomb")
+		}
+	}
+	v, err := r.readBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+
+	return (1 << uint(zeros)) - 1 + v, nil
+}
+
+func (r *bitReader) readSE() (int, error) {
+	v, err := r.readUE()
+	if err != nil {
+		return 0, err
+	}
+	if v&1 == 1 {
+		return int((v + 1) / 2), nil
+	}
+
+	return -int(v / 2), nil
+}
+
+// removeEmulationPrevention 去掉NALU中的 0x000003 防竞争字节.
+func removeEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if i >= 2 && b[i] == 3 && b[i-1] == 0 && b[i-2] == 0 {
+			continue
+		}
+		out = append(out, b[i])
+	}
+
+	return out
+}
+
+// parseSPSResolution 从 SPS 中解析出图像的宽高.
+func parseSPSResolution(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errors.New("sps too short")
+	}
+	// 跳过 1byte 的NALU header
+	r := &bitReader{b: removeEmulationPrevention(sps[1:])}
+
+	profileIdc, _ := r.readBits(8)
+	_, _ = r.readBits(16)                // constraint_set_flags + level_idc
+	if _, err = r.readUE(); err != nil { // seq_parameter_set_id
+		return
+	}
+
+	chromaFormatIdc := uint(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc, err = r.readUE(); err != nil {
+			return
+		}
+		if chromaFormatIdc == 3 {
+			_, _ = r.readBit() // separate_colour_plane_flag
+		}
+		_, _ = r.readUE()  // bit_depth_luma_minus8
+		_, _ = r.readUE()  // bit_depth_chroma_minus8
+		_, _ = r.readBit() // qpprime_y_zero_transform_bypass_flag
+		scaling, _ := r.readBit()
+		if scaling == 1 {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				present, _ := r.readBit()
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, _ := r.readSE()
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	_, _ = r.readUE() // log2_max_frame_num_minus4
+	pocType, _ := r.readUE()
+	switch pocType {
+	case 0:
+		_, _ = r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		_, _ = r.readBit()
+		_, _ = r.readSE()
+		_, _ = r.readSE()
+		n, _ := r.readUE()
+		for i := uint(0); i < n; i++ {
+			_, _ = r.readSE()
+		}
+	}
+	_, _ = r.readUE()  // max_num_ref_frames
+	_, _ = r.readBit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs, _ := r.readUE()
+	heightMapUnits, _ := r.readUE()
+	frameMbsOnly, err := r.readBit()
+	if err != nil {
+		return
+	}
+	if frameMbsOnly == 0 {
+		_, _ = r.readBit() // mb_adaptive_frame_field_flag
+	}
+	_, _ = r.readBit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	cropping, _ := r.readBit()
+	if cropping == 1 {
+		cropLeft, _ = r.readUE()
+		cropRight, _ = r.readUE()
+		cropTop, _ = r.readUE()
+		cropBottom, err = r.readUE()
+		if err != nil {
+			return
+		}
+	}
+
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if chromaFormatIdc == 1 {
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	} else if chromaFormatIdc == 2 {
+		cropUnitX, cropUnitY = 2, 2-frameMbsOnly
+	}
+
+	width = int((widthMbs+1)*16 - (cropLeft+cropRight)*cropUnitX)
+	height = int((2-frameMbsOnly)*(heightMapUnits+1)*16 - (cropTop+cropBottom)*cropUnitY)
+
+	return width, height, nil
+}
+
+// AudioSpecificConfig 音频 sequence header 中的 AAC 配置.
+type AudioSpecificConfig struct {
+	ObjectType   int
+	SampleRate   int
+	ChannelCount int
+	// 原始的数据 fMP4 的 esds 中直接使用
+	Raw []byte
+}
+
+func (c *AudioSpecificConfig) Codecs() string {
+	return fmt.Sprintf("mp4a.40.%d", c.ObjectType)
+}
+
+func ParseAudioSpecificConfig(b []byte) (*AudioSpecificConfig, error) {
+	/*
+		AudioSpecificConfig 构成:
+			audioObjectType(5bit) + samplingFrequencyIndex(4bit) + channelConfiguration(4bit) + ...
+	*/
+	if len(b) < 2 {
+		return nil, errors.Errorf("AudioSpecificConfig too short, len is %d", len(b))
+	}
+
+	r := &bitReader{b: b}
+	objectType, _ := r.readBits(5)
+	index, _ := r.readBits(4)
+
+	c := &AudioSpecificConfig{
+		ObjectType: int(objectType),
+		Raw:        b,
+	}
+	if index == 0x0f {
+		rate, err := r.readBits(24)
+		if err != nil {
+			return nil, err
+		}
+		c.SampleRate = int(rate)
+	} else if int(index) < len(aacSampleRates) {
+		c.SampleRate = aacSampleRates[index]
+	} else {
+		return nil, errors.Errorf("AudioSpecificConfig invalid sample rate index %d", index)
+	}
+
+	channels, err := r.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+	c.ChannelCount = int(channels)
+
+	return c, nil
+}
+
+var flvVideoCodecNames = map[byte]string{
+	FlvCodecH263: "H.263",
+	3:            "Screen Video",
+	FlvCodecVP6:  "VP6",
+	5:            "VP6 Alpha",
+	6:            "Screen Video 2",
+	FlvCodecAVC:  "H.264",
+	FlvCodecHEVC: "H.265",
+}
+
+var flvAudioCodecNames = map[byte]string{
+	0:             "PCM",
+	1:             "ADPCM",
+	FlvCodecMP3:   "MP3",
+	3:             "PCM LE",
+	4:             "Nellymoser 16k",
+	5:             "Nellymoser 8k",
+	6:             "Nellymoser",
+	FlvCodecG711A: "G.711 A-law",
+	FlvCodecG711U: "G.711 mu-law",
+	FlvCodecAAC:   "AAC",
+	FlvCodecSpeex: "Speex",
+	14:            "MP3 8k",
+}
+
+var avcProfileNames = map[byte]string{
+	66:  "Baseline",
+	77:  "Main",
+	88:  "Extended",
+	100: "High",
+	110: "High 10",
+	122: "High 4:2:2",
+	244: "High 4:4:4",
+}
+
+var aacObjectTypeNames = map[byte]string{
+	1:  "Main",
+	2:  "LC",
+	3:  "SSR",
+	4:  "LTP",
+	5:  "HE-AAC",
+	29: "HE-AACv2",
+}
+
+func codecName(names map[byte]string, id byte) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("unknown(%d)", id)
+}
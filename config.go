@@ -0,0 +1,1105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Config 服务的配置 从 yaml 文件中读取 没有配置的字段使用默认值.
+type Config struct {
+	Rtmp      ServerConfig    `yaml:"rtmp"`
+	Log       LogConfig       `yaml:"log"`
+	Apps      []AppConfig     `yaml:"apps"`
+	Vhosts    []VhostConfig   `yaml:"vhosts"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Hooks     HooksConfig     `yaml:"hooks"`
+	Ban       BanConfig       `yaml:"ban"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Handshake HandshakeConfig `yaml:"handshake"`
+	Rtmps     RtmpsConfig     `yaml:"rtmps"`
+	Rtmpt     RtmptConfig     `yaml:"rtmpt"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Stat      StatConfig      `yaml:"stat"`
+	Dash      DashConfig      `yaml:"dash"`
+	Relay     RelayConfig     `yaml:"relay"`
+	Edge      EdgeConfig      `yaml:"edge"`
+	Pull      PullConfig      `yaml:"pull"`
+}
+
+// ServerConfig RTMP 的监听地址和协议参数.
+type ServerConfig struct {
+	// 可以同时监听多个地址
+	Listen []string `yaml:"listen"`
+	// 服务端发送数据时使用的 ChunkSize app 中可以单独设置
+	ChunkSize uint32 `yaml:"chunk_size"`
+	// connect 之后发送给客户端的 Window Acknowledgement Size 和 Set Peer Bandwidth
+	WindowAckSize uint32 `yaml:"window_ack_size"`
+	PeerBandwidth uint32 `yaml:"peer_bandwidth"`
+	// connect 回复中的 fmsVer 和 capabilities 有些客户端会根据这两个字段判断服务端的类型
+	FmsVer       string  `yaml:"fms_ver"`
+	Capabilities float64 `yaml:"capabilities"`
+	// 没有在 apps 中配置的app 以及 app 中没有设置的字段 都使用这里的设置
+	Defaults AppConfig `yaml:"defaults"`
+	// 只允许 apps 中配置的app 其他的app在 connect 时拒绝
+	RejectUnknownApps bool `yaml:"reject_unknown_apps"`
+	// 在四层负载均衡后面时 从 PROXY 头中获取客户端地址
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+}
+
+// ProxyProtocolConfig 只有 trusted 中的地址发送的 PROXY 头才会使用 没有 PROXY 头的连接按照普通连接处理.
+type ProxyProtocolConfig struct {
+	Enable  bool     `yaml:"enable"`
+	Trusted []string `yaml:"trusted"`
+	// 读取 PROXY 头的超时时间
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (p ProxyProtocolConfig) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, s := range p.Trusted {
+		if ipNet, err := parseCIDR(s); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validateProxyProtocol(path string, p ProxyProtocolConfig) error {
+	if !p.Enable {
+		return nil
+	}
+	if len(p.Trusted) == 0 {
+		return configErrorf(path+".trusted", "need at least one trusted address")
+	}
+	for i, s := range p.Trusted {
+		if _, err := parseCIDR(s); err != nil {
+			return configErrorf(fmt.Sprintf("%s.trusted[%d]", path, i), "%v", err)
+		}
+	}
+	if p.Timeout < 0 {
+		return configErrorf(path+".timeout", "can not be negative")
+	}
+
+	return nil
+}
+
+// VhostConfig 虚拟主机 按照 tcUrl 中的域名选择 每个虚拟主机有自己的app和流
+// 没有匹配的域名使用默认虚拟主机 也就是最外层的 apps 和 rtmp.defaults.
+type VhostConfig struct {
+	Name string `yaml:"name"`
+	// 其他也属于这个虚拟主机的域名 支持 *.example.com
+	Aliases []string `yaml:"aliases"`
+	// 覆盖 rtmp.defaults 中的设置
+	Defaults          AppConfig   `yaml:"defaults"`
+	RejectUnknownApps bool        `yaml:"reject_unknown_apps"`
+	Apps              []AppConfig `yaml:"apps"`
+}
+
+// match 先精确匹配 再匹配通配符.
+func (v *VhostConfig) match(host string) bool {
+	if host == v.Name {
+		return true
+	}
+
+	wildcard := ""
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		wildcard = "*" + host[i:]
+	}
+	for _, alias := range v.Aliases {
+		if alias == host || alias == wildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AppConfig 一个app的设置 没有设置的字段使用 rtmp.defaults 中的值.
+type AppConfig struct {
+	Name string `yaml:"name"`
+	// 是否允许发布和播放
+	Publish *bool `yaml:"publish"`
+	Play    *bool `yaml:"play"`
+	// 为0时使用 rtmp.chunk_size
+	ChunkSize uint32 `yaml:"chunk_size"`
+	// 是否缓存最近的GOP 缓存后播放端可以秒开 但是延迟会大一些
+	GopCache *bool `yaml:"gop_cache"`
+	// 发布的流录制为FLV的目录 为空时不录制
+	Record string `yaml:"record"`
+	// 转推的目标 和 relay.rules 中的一样 可以使用 {app} {stream}
+	Relay []string `yaml:"relay"`
+	// 按照客户端地址限制发布和播放
+	Access AccessConfig `yaml:"access"`
+}
+
+// AccessConfig 按照顺序匹配的规则 例如 "allow 10.0.0.0/8" "deny all" 第一条匹配的规则生效 都不匹配时允许.
+type AccessConfig struct {
+	Publish []string `yaml:"publish"`
+	Play    []string `yaml:"play"`
+}
+
+func (a AppConfig) CanPublish() bool {
+	return a.Publish == nil || *a.Publish
+}
+
+func (a AppConfig) CanPlay() bool {
+	return a.Play == nil || *a.Play
+}
+
+func (a AppConfig) UseGopCache() bool {
+	return a.GopCache == nil || *a.GopCache
+}
+
+// merge 用 a 中设置了的字段覆盖 def 中的值.
+func (a AppConfig) merge(def AppConfig) AppConfig {
+	def.Name = a.Name
+	if a.Publish != nil {
+		def.Publish = a.Publish
+	}
+	if a.Play != nil {
+		def.Play = a.Play
+	}
+	if a.ChunkSize != 0 {
+		def.ChunkSize = a.ChunkSize
+	}
+	if a.GopCache != nil {
+		def.GopCache = a.GopCache
+	}
+	if a.Record != "" {
+		def.Record = a.Record
+	}
+	if a.Relay != nil {
+		def.Relay = a.Relay
+	}
+	if a.Access.Publish != nil {
+		def.Access.Publish = a.Access.Publish
+	}
+	if a.Access.Play != nil {
+		def.Access.Play = a.Access.Play
+	}
+
+	return def
+}
+
+// hasRelays 是否配置了转推.
+func (c *Config) hasRelays() bool {
+	if len(c.Relay.Rules) > 0 || len(c.Rtmp.Defaults.Relay) > 0 {
+		return true
+	}
+
+	for _, a := range c.Apps {
+		if len(a.Relay) > 0 {
+			return true
+		}
+	}
+
+	for _, v := range c.Vhosts {
+		if len(v.Defaults.Relay) > 0 {
+			return true
+		}
+		for _, a := range v.Apps {
+			if len(a.Relay) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MatchVhost 按照域名查找虚拟主机 返回虚拟主机的名字 没有匹配的返回空 也就是默认虚拟主机.
+func (c *Config) MatchVhost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range c.Vhosts {
+		if c.Vhosts[i].match(host) {
+			return c.Vhosts[i].Name
+		}
+	}
+
+	return ""
+}
+
+// vhost 按照名字返回虚拟主机的配置 默认虚拟主机由最外层的配置组成.
+func (c *Config) vhost(name string) *VhostConfig {
+	for i := range c.Vhosts {
+		if c.Vhosts[i].Name == name {
+			return &c.Vhosts[i]
+		}
+	}
+
+	return &VhostConfig{RejectUnknownApps: c.Rtmp.RejectUnknownApps, Apps: c.Apps}
+}
+
+// lookupApp 返回一个app的设置 已经合并了默认值 app 可以带有实例 例如 live/room1 这时使用 live 的设置.
+func (c *Config) lookupApp(vhost, app string) (AppConfig, bool) {
+	name := appBase(app)
+
+	def := c.Rtmp.Defaults
+	if def.ChunkSize == 0 {
+		def.ChunkSize = c.Rtmp.ChunkSize
+	}
+
+	v := c.vhost(vhost)
+	if v.Name != "" {
+		def = v.Defaults.merge(def)
+	}
+
+	for _, a := range v.Apps {
+		if a.Name == name {
+			return a.merge(def), true
+		}
+	}
+
+	def.Name = name
+
+	return def, false
+}
+
+// App 返回虚拟主机中一个app的设置.
+func (c *Config) App(vhost, app string) AppConfig {
+	a, _ := c.lookupApp(vhost, app)
+
+	return a
+}
+
+// AppAllowed 虚拟主机设置了 reject_unknown_apps 时 只允许配置了的app.
+func (c *Config) AppAllowed(vhost, app string) bool {
+	_, ok := c.lookupApp(vhost, app)
+
+	return ok || !c.vhost(vhost).RejectUnknownApps
+}
+
+// appBase 去掉app中的实例 live/room1 返回 live.
+func appBase(app string) string {
+	if i := strings.IndexByte(app, '/'); i >= 0 {
+		return app[:i]
+	}
+
+	return app
+}
+
+// AuthConfig 内置的鉴权 签名的地址为 rtmp://host/app/stream?expires={unix}&sign={hmac}.
+type AuthConfig struct {
+	// 签名密钥 为空时不校验签名
+	Secret string `yaml:"secret"`
+	// 需要签名的操作 connect publish play
+	Sign []string `yaml:"sign"`
+	// 配置了推流密钥的流 推流时需要带上 ?key=xxx 不再校验签名
+	PublishKeys []PublishKey `yaml:"publish_keys"`
+}
+
+type PublishKey struct {
+	// 为空时为默认虚拟主机
+	Vhost  string `yaml:"vhost"`
+	App    string `yaml:"app"`
+	Stream string `yaml:"stream"`
+	Key    string `yaml:"key"`
+}
+
+func (a *AuthConfig) needSign(action string) bool {
+	for _, s := range a.Sign {
+		if s == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *AuthConfig) publishKey(vhost, app, stream string) (string, bool) {
+	for _, k := range a.PublishKeys {
+		if k.Vhost == vhost && k.App == app && k.Stream == stream {
+			return k.Key, true
+		}
+	}
+
+	return "", false
+}
+
+// HooksConfig HTTP 回调 为空的不回调
+// on_connect on_publish on_play 是阻塞的 返回非 2xx 时拒绝 on_publish 返回 3xx 时使用 Location 作为新的流名
+// 其他的是通知 失败后重试.
+type HooksConfig struct {
+	Timeout       time.Duration `yaml:"timeout"`
+	Retries       int           `yaml:"retries"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	OnConnect     string        `yaml:"on_connect"`
+	OnPublish     string        `yaml:"on_publish"`
+	OnPublishDone string        `yaml:"on_publish_done"`
+	OnPlay        string        `yaml:"on_play"`
+	OnPlayDone    string        `yaml:"on_play_done"`
+	OnRecordDone  string        `yaml:"on_record_done"`
+}
+
+// BanConfig 封禁列表 被封禁的地址不能建立新的连接.
+type BanConfig struct {
+	// 封禁列表保存的文件 为空时只保存在内存中 通过管理接口的 ban 修改
+	File string `yaml:"file"`
+}
+
+// LimitsConfig 限制每个连接使用的资源 超过限制时关闭连接 为0时不限制.
+type LimitsConfig struct {
+	// 一个消息的最大长度
+	MaxMessageSize uint32 `yaml:"max_message_size"`
+	// 每个连接同时在接收的消息数 也就是有未接收完的消息的 chunk stream 数
+	MaxPartialMessages int `yaml:"max_partial_messages"`
+	// 客户端通过 Set Chunk Size 可以设置的最大值
+	MaxChunkSize uint32 `yaml:"max_chunk_size"`
+	// 每个连接所有未接收完的消息的长度之和
+	MaxBufferedBytes int `yaml:"max_buffered_bytes"`
+	// 客户端连接数 不包括转推和拉流的连接
+	MaxConnections      int `yaml:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// 握手 和握手之后等待 connect 的时间
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	ConnectTimeout   time.Duration `yaml:"connect_timeout"`
+}
+
+// RateLimitConfig 限制新建连接的速度 rate 为每秒的连接数 burst 为允许的突发连接数 rate 为0时不限制.
+type RateLimitConfig struct {
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+	GlobalRate  float64 `yaml:"global_rate"`
+	GlobalBurst int     `yaml:"global_burst"`
+	// 同时在握手的连接数
+	MaxHandshakes int `yaml:"max_handshakes"`
+	// 同一个IP在 ban_window 内超过限制 ban_after 次后封禁 ban_duration
+	// ban_after 为0时不自动封禁 ban_duration 为0时永久封禁
+	BanAfter    int           `yaml:"ban_after"`
+	BanWindow   time.Duration `yaml:"ban_window"`
+	BanDuration time.Duration `yaml:"ban_duration"`
+}
+
+type HandshakeConfig struct {
+	// 复杂握手校验失败时直接断开 否则退回到简单握手
+	Strict bool `yaml:"strict"`
+	// 校验复杂握手的C2
+	VerifyC2 bool `yaml:"verify_c2"`
+	// 读取 C0C1 的时间 和发送 S0S1S2 之后读取 C2 的时间
+	C0C1Timeout time.Duration `yaml:"c0c1_timeout"`
+	C2Timeout   time.Duration `yaml:"c2_timeout"`
+}
+
+type RtmpsConfig struct {
+	Enable bool   `yaml:"enable"`
+	Listen string `yaml:"listen"`
+	// 第一个证书为默认证书 其他的按照 SNI 选择
+	Certificates []CertConfig `yaml:"certificates"`
+	// 检查证书文件是否修改的间隔 为0时不检查
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// PROXY 头在 TLS 握手之前
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+}
+
+type RtmptConfig struct {
+	Enable bool   `yaml:"enable"`
+	Listen string `yaml:"listen"`
+	// 会话这么长时间没有请求就关闭
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+}
+
+type CertConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// 这个证书对应的域名 支持 *.example.com 为空时使用证书中的域名
+	Hosts []string `yaml:"hosts"`
+}
+
+// LogConfig 日志 修改后重新加载配置立即生效.
+type LogConfig struct {
+	// debug info warn error
+	Level string `yaml:"level"`
+	// text 或者 json
+	Format string `yaml:"format"`
+	// 为空时输出到标准输出 也可以是 stderr 或者文件路径
+	Output string          `yaml:"output"`
+	Sample LogSampleConfig `yaml:"sample"`
+}
+
+// LogSampleConfig 每个 interval 内同一条消息前 initial 条都输出 之后每 thereafter 条输出一条
+// initial 为0时不采样 thereafter 为0时之后的都不输出.
+type LogSampleConfig struct {
+	Initial    int           `yaml:"initial"`
+	Thereafter int           `yaml:"thereafter"`
+	Interval   time.Duration `yaml:"interval"`
+}
+
+type HTTPConfig struct {
+	// 为空时不启动 HTTP 服务
+	Listen string `yaml:"listen"`
+}
+
+// AdminConfig 管理接口 请求需要带上 Authorization: Bearer {token} 或者 ?token={token}.
+type AdminConfig struct {
+	// HTTP 路径前缀 例如 /api/ 为空时不提供
+	Path  string `yaml:"path"`
+	Token string `yaml:"token"`
+}
+
+// MetricsConfig Prometheus 指标 流和app的标签数量可以限制.
+type MetricsConfig struct {
+	// HTTP 路径 为空时不提供
+	Path string `yaml:"path"`
+	// 是否导出每路流的码率和帧率
+	Streams bool `yaml:"streams"`
+	// 最多导出的流数 按照码率从高到低 为0时不限制
+	MaxStreams int `yaml:"max_streams"`
+	// app 标签中保留实例 例如 live/room1 否则记为 live
+	AppInstances bool `yaml:"app_instances"`
+}
+
+// StatConfig 兼容 nginx-rtmp 的 stat 和 control 接口.
+type StatConfig struct {
+	// stat XML 的 HTTP 路径 例如 /stat 为空时不提供
+	Path string `yaml:"path"`
+	// control 的路径前缀 例如 /control/ 为空时不提供
+	ControlPath string `yaml:"control_path"`
+	// 允许访问的地址 规则和 app 的 access 相同 为空时都允许
+	Access []string `yaml:"access"`
+}
+
+type DashConfig struct {
+	Enable bool `yaml:"enable"`
+	// HTTP 路径前缀 例如 /dash/ 那么 MPD 的地址就是 /dash/{app}/{stream}/index.mpd
+	Path string `yaml:"path"`
+	// 每个分片的目标时长 分片只会在关键帧处切分
+	FragmentDuration time.Duration `yaml:"fragment_duration"`
+	// timeShiftBufferDepth 播放列表中保留的时长
+	WindowDuration time.Duration `yaml:"window_duration"`
+	// 使用 SegmentTimeline 否则只使用 $Number$ 和固定的 duration
+	// 不使用 SegmentTimeline 时 推流端的关键帧间隔需要和 FragmentDuration 一致
+	SegmentTimeline bool `yaml:"segment_timeline"`
+}
+
+type RelayConfig struct {
+	// 转推失败后的重试间隔 从 RetryMin 开始每次翻倍 最大为 RetryMax
+	RetryMin time.Duration `yaml:"retry_min"`
+	RetryMax time.Duration `yaml:"retry_max"`
+	Rules    []RelayRule   `yaml:"rules"`
+}
+
+// RelayRule 一个app发布的流 转推到哪些目标 目标地址中可以使用 {app} {stream}.
+type RelayRule struct {
+	App          string   `yaml:"app"`
+	Destinations []string `yaml:"destinations"`
+}
+
+type EdgeConfig struct {
+	// 最后一个播放者离开后 过多久停止回源
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// 回源失败后的重试间隔 从 RetryMin 开始每次翻倍 最大为 RetryMax
+	RetryMin time.Duration `yaml:"retry_min"`
+	RetryMax time.Duration `yaml:"retry_max"`
+	Rules    []EdgeRule    `yaml:"rules"`
+}
+
+// EdgeRule 一个app的流从哪个源站拉取 源站地址中可以使用 {app} {stream}.
+type EdgeRule struct {
+	App    string `yaml:"app"`
+	Origin string `yaml:"origin"`
+}
+
+// PullConfig 一直拉取的流 不管有没有人播放.
+type PullConfig struct {
+	// 拉流失败后的重试间隔 从 RetryMin 开始每次翻倍 最大为 RetryMax
+	RetryMin time.Duration `yaml:"retry_min"`
+	RetryMax time.Duration `yaml:"retry_max"`
+	Streams  []PullStream  `yaml:"streams"`
+}
+
+// PullStream 从 URL 拉流 发布为本地的 App/Stream URL 可以是 rtmp:// 或者 http(s)-flv
+// Vhost 为空时发布到默认虚拟主机.
+type PullStream struct {
+	URL    string `yaml:"url"`
+	Vhost  string `yaml:"vhost"`
+	App    string `yaml:"app"`
+	Stream string `yaml:"stream"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Rtmp: ServerConfig{
+			// 和以前一样默认只监听本机
+			Listen:        []string{"127.0.0.1:1935"},
+			ChunkSize:     RtmpServerChunkSize,
+			WindowAckSize: 512 << 10,
+			PeerBandwidth: 512 << 10,
+			FmsVer:        EngineVersion,
+			Capabilities:  31,
+			ProxyProtocol: ProxyProtocolConfig{
+				Timeout: 5 * time.Second,
+			},
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+			Sample: LogSampleConfig{
+				Initial:    100,
+				Thereafter: 100,
+				Interval:   time.Second,
+			},
+		},
+		Auth: AuthConfig{
+			Sign: []string{AuthActionPublish},
+		},
+		Limits: LimitsConfig{
+			MaxMessageSize:     8 << 20,
+			MaxPartialMessages: 16,
+			MaxChunkSize:       1 << 20,
+			MaxBufferedBytes:   32 << 20,
+			HandshakeTimeout:   10 * time.Second,
+			ConnectTimeout:     10 * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			Burst:       20,
+			GlobalBurst: 200,
+			BanWindow:   time.Minute,
+			BanDuration: 10 * time.Minute,
+		},
+		Handshake: HandshakeConfig{
+			C0C1Timeout: 5 * time.Second,
+			C2Timeout:   5 * time.Second,
+		},
+		Hooks: HooksConfig{
+			Timeout:       3 * time.Second,
+			Retries:       3,
+			RetryInterval: time.Second,
+		},
+		Rtmps: RtmpsConfig{
+			Enable:         false,
+			Listen:         ":1936",
+			ReloadInterval: time.Minute,
+			ProxyProtocol: ProxyProtocolConfig{
+				Timeout: 5 * time.Second,
+			},
+		},
+		Rtmpt: RtmptConfig{
+			Enable:         false,
+			Listen:         ":80",
+			SessionTimeout: 30 * time.Second,
+		},
+		HTTP: HTTPConfig{
+			Listen: ":8080",
+		},
+		Metrics: MetricsConfig{
+			Streams:    true,
+			MaxStreams: 100,
+		},
+		Dash: DashConfig{
+			Enable:           false,
+			Path:             "/dash/",
+			FragmentDuration: 2 * time.Second,
+			WindowDuration:   30 * time.Second,
+			SegmentTimeline:  true,
+		},
+		Relay: RelayConfig{
+			RetryMin: time.Second,
+			RetryMax: 30 * time.Second,
+		},
+		Edge: EdgeConfig{
+			IdleTimeout: 10 * time.Second,
+			RetryMin:    time.Second,
+			RetryMax:    10 * time.Second,
+		},
+		Pull: PullConfig{
+			RetryMin: time.Second,
+			RetryMax: 30 * time.Second,
+		},
+	}
+}
+
+// config 当前使用的配置 重新加载时整体替换 不要修改返回的配置.
+var config atomic.Value
+
+func init() {
+	config.Store(defaultConfig())
+}
+
+func conf() *Config {
+	return config.Load().(*Config)
+}
+
+func setConfig(c *Config) {
+	config.Store(c)
+}
+
+// ConfigError 配置校验失败 Path 为出错的字段 例如 apps[1].chunk_size.
+type ConfigError struct {
+	Path string
+	Msg  string
+	// 字段在配置文件中的行号 配置文件中没有这个字段时为它所在的上一级的行号
+	Line int
+}
+
+func configErrorf(path, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Msg)
+	}
+
+	return e.Path + ": " + e.Msg
+}
+
+// LoadConfig 读取配置文件 path 为空时返回默认配置.
+func LoadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config file")
+	}
+
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	c := defaultConfig()
+
+	// 先解析为 yaml.Node 校验失败时用来查找字段所在的行号
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, errors.Wrap(err, "parse config file")
+	}
+
+	// 不认识的字段多半是写错了 直接报错
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "parse config file")
+	}
+
+	if err := c.validate(); err != nil {
+		if e, ok := err.(*ConfigError); ok {
+			e.Line = nodeLine(&root, e.Path)
+		}
+
+		return nil, errors.Wrap(err, "invalid config")
+	}
+
+	return c, nil
+}
+
+// nodeLine 按照 a.b[1].c 这样的路径查找字段的行号 找不到的部分使用已经找到的最深的节点.
+func nodeLine(root *yaml.Node, path string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, -1
+		if i := strings.IndexByte(part, '['); i >= 0 && strings.HasSuffix(part, "]") {
+			name = part[:i]
+			index, _ = strconv.Atoi(part[i+1 : len(part)-1])
+		}
+
+		next := mappingValue(node, name)
+		if next == nil {
+			return line
+		}
+		node, line = next, next.Line
+
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return line
+			}
+			node, line = node.Content[index], node.Content[index].Line
+		}
+	}
+
+	return line
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			// 行号使用 key 所在的行 值可能在下一行
+			v := *node.Content[i+1]
+			v.Line = node.Content[i].Line
+
+			return &v
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Rtmp.Listen) == 0 {
+		return configErrorf("rtmp.listen", "need at least one address")
+	}
+	for i, addr := range c.Rtmp.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return configErrorf(fmt.Sprintf("rtmp.listen[%d]", i), "%v", err)
+		}
+	}
+	if err := validateChunkSize("rtmp.chunk_size", c.Rtmp.ChunkSize); err != nil {
+		return err
+	}
+	if c.Rtmp.WindowAckSize == 0 {
+		return configErrorf("rtmp.window_ack_size", "can not be 0")
+	}
+	if c.Rtmp.PeerBandwidth == 0 {
+		return configErrorf("rtmp.peer_bandwidth", "can not be 0")
+	}
+	if err := c.validateApp("rtmp.defaults", c.Rtmp.Defaults); err != nil {
+		return err
+	}
+	if err := validateProxyProtocol("rtmp.proxy_protocol", c.Rtmp.ProxyProtocol); err != nil {
+		return err
+	}
+
+	if err := c.validateApps("apps", c.Apps); err != nil {
+		return err
+	}
+
+	hosts := make(map[string]bool)
+	for i, v := range c.Vhosts {
+		path := fmt.Sprintf("vhosts[%d]", i)
+		if v.Name == "" {
+			return configErrorf(path+".name", "can not be empty")
+		}
+		for j, host := range append([]string{v.Name}, v.Aliases...) {
+			p := path + ".name"
+			if j > 0 {
+				p = fmt.Sprintf("%s.aliases[%d]", path, j-1)
+			}
+			if host != strings.ToLower(host) || strings.ContainsAny(host, ":/") {
+				return configErrorf(p, "%s must be a lower case host name without port", host)
+			}
+			if hosts[host] {
+				return configErrorf(p, "host %s is duplicated", host)
+			}
+			hosts[host] = true
+		}
+
+		if err := c.validateApp(path+".defaults", v.Defaults); err != nil {
+			return err
+		}
+		if err := c.validateApps(path+".apps", v.Apps); err != nil {
+			return err
+		}
+	}
+
+	for i, action := range c.Auth.Sign {
+		switch action {
+		case AuthActionConnect, AuthActionPublish, AuthActionPlay:
+		default:
+			return configErrorf(fmt.Sprintf("auth.sign[%d]", i), "must be connect, publish or play")
+		}
+	}
+	for i, k := range c.Auth.PublishKeys {
+		if k.App == "" || k.Stream == "" || k.Key == "" {
+			return configErrorf(fmt.Sprintf("auth.publish_keys[%d]", i), "need app, stream and key")
+		}
+	}
+
+	if c.Limits.MaxPartialMessages < 0 || c.Limits.MaxBufferedBytes < 0 ||
+		c.Limits.MaxConnections < 0 || c.Limits.MaxConnectionsPerIP < 0 {
+		return configErrorf("limits", "limits can not be negative")
+	}
+	if c.Limits.MaxChunkSize != 0 && c.Limits.MaxChunkSize < RtmpDefaultChunkSize {
+		return configErrorf("limits.max_chunk_size", "must be at least %d", RtmpDefaultChunkSize)
+	}
+	if c.Limits.HandshakeTimeout < 0 || c.Limits.ConnectTimeout < 0 {
+		return configErrorf("limits.handshake_timeout", "handshake_timeout and connect_timeout can not be negative")
+	}
+
+	if c.RateLimit.Rate < 0 || c.RateLimit.GlobalRate < 0 {
+		return configErrorf("rate_limit.rate", "rate and global_rate can not be negative")
+	}
+	if c.RateLimit.Rate > 0 && c.RateLimit.Burst < 1 {
+		return configErrorf("rate_limit.burst", "must be at least 1")
+	}
+	if c.RateLimit.GlobalRate > 0 && c.RateLimit.GlobalBurst < 1 {
+		return configErrorf("rate_limit.global_burst", "must be at least 1")
+	}
+	if c.RateLimit.MaxHandshakes < 0 || c.RateLimit.BanAfter < 0 || c.RateLimit.BanDuration < 0 {
+		return configErrorf("rate_limit", "max_handshakes ban_after ban_duration can not be negative")
+	}
+	if c.RateLimit.BanAfter > 0 && c.RateLimit.BanWindow <= 0 {
+		return configErrorf("rate_limit.ban_window", "must be positive")
+	}
+	if c.Handshake.C0C1Timeout < 0 || c.Handshake.C2Timeout < 0 {
+		return configErrorf("handshake.c0c1_timeout", "c0c1_timeout and c2_timeout can not be negative")
+	}
+
+	if c.Hooks.Timeout <= 0 {
+		return configErrorf("hooks.timeout", "must be positive")
+	}
+	if c.Hooks.Retries < 0 || c.Hooks.RetryInterval < 0 {
+		return configErrorf("hooks.retries", "retries and retry_interval can not be negative")
+	}
+	hooks := map[string]string{
+		HookOnConnect: c.Hooks.OnConnect, HookOnPublish: c.Hooks.OnPublish, HookOnPublishDone: c.Hooks.OnPublishDone,
+		HookOnPlay: c.Hooks.OnPlay, HookOnPlayDone: c.Hooks.OnPlayDone, HookOnRecordDone: c.Hooks.OnRecordDone,
+	}
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	// 按照名字的顺序检查 有多个错误时每次报告的都是同一个
+	sort.Strings(names)
+	for _, name := range names {
+		hook := hooks[name]
+		if hook == "" {
+			continue
+		}
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return configErrorf("hooks."+name, "must be a http(s) url")
+		}
+	}
+
+	if c.Rtmps.Enable {
+		if c.Rtmps.Listen == "" {
+			return configErrorf("rtmps.listen", "can not be empty")
+		}
+		if len(c.Rtmps.Certificates) == 0 {
+			return configErrorf("rtmps.certificates", "need at least one certificate")
+		}
+		for i, cert := range c.Rtmps.Certificates {
+			if cert.Cert == "" || cert.Key == "" {
+				return configErrorf(fmt.Sprintf("rtmps.certificates[%d]", i), "need cert and key")
+			}
+		}
+		if err := validateProxyProtocol("rtmps.proxy_protocol", c.Rtmps.ProxyProtocol); err != nil {
+			return err
+		}
+	}
+
+	if c.Rtmpt.Enable {
+		if c.Rtmpt.Listen == "" {
+			return configErrorf("rtmpt.listen", "can not be empty")
+		}
+		if c.Rtmpt.SessionTimeout < time.Second {
+			return configErrorf("rtmpt.session_timeout", "must be at least 1s")
+		}
+	}
+
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		return configErrorf("log.level", "must be debug, info, warn or error")
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return configErrorf("log.format", "must be text or json")
+	}
+	if c.Log.Sample.Initial < 0 || c.Log.Sample.Thereafter < 0 {
+		return configErrorf("log.sample", "can not be negative")
+	}
+	if c.Log.Sample.Initial > 0 && c.Log.Sample.Interval <= 0 {
+		return configErrorf("log.sample.interval", "must be positive")
+	}
+
+	if c.Dash.Enable {
+		if c.HTTP.Listen == "" {
+			return configErrorf("http.listen", "dash need http.listen")
+		}
+		if c.Dash.FragmentDuration < 500*time.Millisecond {
+			return configErrorf("dash.fragment_duration", "must be at least 500ms")
+		}
+		if c.Dash.WindowDuration < c.Dash.FragmentDuration {
+			return configErrorf("dash.window_duration", "must be larger than dash.fragment_duration")
+		}
+	}
+
+	if c.Admin.Path != "" {
+		if c.HTTP.Listen == "" {
+			return configErrorf("http.listen", "admin need http.listen")
+		}
+		if !strings.HasPrefix(c.Admin.Path, "/") || !strings.HasSuffix(c.Admin.Path, "/") {
+			return configErrorf("admin.path", "must start and end with /")
+		}
+		if c.Admin.Token == "" {
+			return configErrorf("admin.token", "can not be empty")
+		}
+	}
+
+	if c.Metrics.Path != "" && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return configErrorf("metrics.path", "must start with /")
+	}
+	if c.Metrics.MaxStreams < 0 {
+		return configErrorf("metrics.max_streams", "can not be negative")
+	}
+
+	if c.Stat.Path != "" || c.Stat.ControlPath != "" {
+		if c.HTTP.Listen == "" {
+			return configErrorf("http.listen", "stat need http.listen")
+		}
+		if c.Stat.Path != "" && !strings.HasPrefix(c.Stat.Path, "/") {
+			return configErrorf("stat.path", "must start with /")
+		}
+		if c.Stat.ControlPath != "" && (!strings.HasPrefix(c.Stat.ControlPath, "/") || !strings.HasSuffix(c.Stat.ControlPath, "/")) {
+			return configErrorf("stat.control_path", "must start and end with /")
+		}
+	}
+	for i, rule := range c.Stat.Access {
+		if _, err := parseAccessRule(rule); err != nil {
+			return configErrorf(fmt.Sprintf("stat.access[%d]", i), "%v", err)
+		}
+	}
+
+	if c.Relay.RetryMin <= 0 || c.Relay.RetryMax < c.Relay.RetryMin {
+		return configErrorf("relay.retry_min", "must be positive and not larger than relay.retry_max")
+	}
+
+	for i, rule := range c.Relay.Rules {
+		path := fmt.Sprintf("relay.rules[%d]", i)
+		if rule.App == "" {
+			return configErrorf(path+".app", "can not be empty")
+		}
+
+		if err := validateRelayURLs(path+".destinations", rule.App, rule.Destinations); err != nil {
+			return err
+		}
+	}
+
+	if c.Edge.RetryMin <= 0 || c.Edge.RetryMax < c.Edge.RetryMin {
+		return configErrorf("edge.retry_min", "must be positive and not larger than edge.retry_max")
+	}
+	if c.Edge.IdleTimeout < 0 {
+		return configErrorf("edge.idle_timeout", "can not be negative")
+	}
+
+	for i, rule := range c.Edge.Rules {
+		path := fmt.Sprintf("edge.rules[%d]", i)
+		if rule.App == "" {
+			return configErrorf(path+".app", "can not be empty")
+		}
+		if _, err := ParseRtmpURL(expandRelayURL(rule.Origin, newStream("", rule.App, "stream"))); err != nil {
+			return configErrorf(path+".origin", "%v", err)
+		}
+	}
+
+	if c.Pull.RetryMin <= 0 || c.Pull.RetryMax < c.Pull.RetryMin {
+		return configErrorf("pull.retry_min", "must be positive and not larger than pull.retry_max")
+	}
+
+	pulls := make(map[string]bool)
+	for i, p := range c.Pull.Streams {
+		path := fmt.Sprintf("pull.streams[%d]", i)
+		if p.App == "" || p.Stream == "" {
+			return configErrorf(path, "need app and stream")
+		}
+
+		if p.Vhost != "" && c.vhost(p.Vhost).Name == "" {
+			return configErrorf(path+".vhost", "vhost %s is not configured", p.Vhost)
+		}
+
+		key := streamKey(p.Vhost, p.App, p.Stream)
+		if pulls[key] {
+			return configErrorf(path, "pull stream %s is duplicated", key)
+		}
+		pulls[key] = true
+
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return configErrorf(path+".url", "%v", err)
+		}
+		switch u.Scheme {
+		case "rtmp":
+			if _, err = ParseRtmpURL(p.URL); err != nil {
+				return configErrorf(path+".url", "%v", err)
+			}
+		case "http", "https":
+		default:
+			return configErrorf(path+".url", "must be rtmp or http(s)-flv")
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateApps(path string, apps []AppConfig) error {
+	names := make(map[string]bool)
+	for i, app := range apps {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if app.Name == "" || strings.ContainsAny(app.Name, "/?") {
+			return configErrorf(p+".name", "can not be empty or contain / ?")
+		}
+		if names[app.Name] {
+			return configErrorf(p+".name", "app %s is duplicated", app.Name)
+		}
+		names[app.Name] = true
+
+		if err := c.validateApp(p, app); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateApp(path string, app AppConfig) error {
+	if app.ChunkSize != 0 {
+		if err := validateChunkSize(path+".chunk_size", app.ChunkSize); err != nil {
+			return err
+		}
+	}
+
+	access := map[string][]string{"publish": app.Access.Publish, "play": app.Access.Play}
+	actions := make([]string, 0, len(access))
+	for action := range access {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		for i, rule := range access[action] {
+			if _, err := parseAccessRule(rule); err != nil {
+				return configErrorf(fmt.Sprintf("%s.access.%s[%d]", path, action, i), "%v", err)
+			}
+		}
+	}
+
+	name := app.Name
+	if name == "" {
+		name = "app"
+	}
+
+	return validateRelayURLs(path+".relay", name, app.Relay)
+}
+
+func validateChunkSize(path string, size uint32) error {
+	if size < RtmpDefaultChunkSize || size > RtmpMaxChunkSize {
+		return configErrorf(path, "must be between %d and %d", RtmpDefaultChunkSize, RtmpMaxChunkSize)
+	}
+
+	return nil
+}
+
+func validateRelayURLs(path, app string, urls []string) error {
+	for i, dest := range urls {
+		if _, err := ParseRtmpURL(expandRelayURL(dest, newStream("", app, "stream"))); err != nil {
+			return configErrorf(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+		}
+	}
+
+	return nil
+}
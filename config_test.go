@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfigApps(t *testing.T) {
+	c, err := parseConfig([]byte(`
+rtmp:
+  listen: [":1935", "127.0.0.1:19350"]
+  chunk_size: 8192
+  defaults:
+    publish: false
+apps:
+  - name: live
+    publish: true
+    gop_cache: false
+  - name: small
+    chunk_size: 1024
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Rtmp.Listen) != 2 {
+		t.Fatalf("listen %v", c.Rtmp.Listen)
+	}
+
+	live := c.App("", "live")
+	if !live.CanPublish() || !live.CanPlay() || live.UseGopCache() || live.ChunkSize != 8192 {
+		t.Errorf("live %+v", live)
+	}
+
+	small := c.App("", "small")
+	if small.CanPublish() || small.ChunkSize != 1024 {
+		t.Errorf("small %+v", small)
+	}
+
+	other := c.App("", "other")
+	if other.CanPublish() || !other.UseGopCache() || other.ChunkSize != 8192 {
+		t.Errorf("other %+v", other)
+	}
+}
+
+func TestParseConfigErrorLine(t *testing.T) {
+	cases := []struct {
+		data string
+		line string
+	}{
+		{"rtmp:\n  chunk_size: 4096\napps:\n  - name: live\n  - name: bad\n    chunk_size: 10\n", "line 6: apps[1].chunk_size"},
+		{"apps:\n  - name: live\n  - name: live\n", "line 3: apps[1].name"},
+		{"rtmp:\n  listen:\n    - \":1935\"\n    - nohost\n", "line 4: rtmp.listen[1]"},
+		{"relay:\n  retry_min: 0s\n", "line 2: relay.retry_min"},
+		{"rtmp:\n  chunk_sise: 4096\n", "line 2: field chunk_sise not found"},
+		{"admin:\n  path: /api/\n", "line 1: admin.token"},
+		{"stat:\n  access:\n    - allow nohost\n", "line 3: stat.access[0]"},
+		{"log:\n  format: xml\n", "line 2: log.format"},
+	}
+
+	for _, c := range cases {
+		_, err := parseConfig([]byte(c.data))
+		if err == nil || !strings.Contains(err.Error(), c.line) {
+			t.Errorf("%q: err is %v, want %s", c.data, err, c.line)
+		}
+	}
+}
+
+func TestParseConfigErrorDeterministic(t *testing.T) {
+	// 多个字段都有错误时 每次报告同一个
+	cases := []struct {
+		data string
+		line string
+	}{
+		{"hooks:\n  on_play: ftp://a\n  on_connect: ftp://b\n  on_record_done: ftp://c\n", "line 3: hooks.on_connect"},
+		{"apps:\n  - name: live\n    access:\n      publish: [\"allow nohost\"]\n      play: [\"deny nohost\"]\n", "line 5: apps[0].access.play[0]"},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			_, err := parseConfig([]byte(c.data))
+			if err == nil || !strings.Contains(err.Error(), c.line) {
+				t.Fatalf("%q: err is %v, want %s", c.data, err, c.line)
+			}
+		}
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old, err := parseConfig([]byte("apps:\n  - name: live\n    record: /tmp/rec\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseConfig([]byte("rtmp:\n  chunk_size: 8192\napps:\n  - name: live\n    relay: [\"rtmp://a/live/{stream}\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, change := range diffConfig(old, c) {
+		got = append(got, change.String())
+	}
+
+	want := []string{
+		"- apps[0].record",
+		"+ apps[0].relay[0]",
+		"~ rtmp.chunk_size",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diff is\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// 日志中不能出现密钥
+	old.Admin.Token = "old-token"
+	c.Admin.Token = "new-token"
+	for _, change := range diffConfig(old, c) {
+		if strings.Contains(change.String(), "-token") || strings.Contains(change.String(), "rtmp://") {
+			t.Errorf("change %q contains a value", change.String())
+		}
+	}
+}
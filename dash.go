@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DashTimescale = 1000 // RTMP 的时间戳单位是毫秒 这里直接使用
+
+	DashRepresentationVideo = "video"
+	DashRepresentationAudio = "audio"
+
+	dashMPDContentType = "application/dash+xml"
+)
+
+type dashSegment struct {
+	Number   uint64
+	Start    uint64
+	Duration uint64
+	Data     []byte
+}
+
+// dashRepresentation 音频或视频的一路输出 每一路都有自己的初始化分片和媒体分片.
+type dashRepresentation struct {
+	ID         string
+	track      *Fmp4Track
+	init       []byte
+	segments   []*dashSegment
+	pending    *Fmp4Sample // 需要等下一个sample到来才知道它的时长
+	samples    []*Fmp4Sample
+	nextNumber uint64
+}
+
+func newDashRepresentation(id string, track *Fmp4Track) *dashRepresentation {
+	return &dashRepresentation{
+		ID:         id,
+		track:      track,
+		init:       track.InitSegment(),
+		nextNumber: 1,
+	}
+}
+
+func (r *dashRepresentation) push(s *Fmp4Sample) {
+	if r.pending != nil {
+		if s.DTS > r.pending.DTS {
+			r.pending.Duration = uint32(s.DTS - r.pending.DTS)
+		}
+		r.samples = append(r.samples, r.pending)
+	}
+	r.pending = s
+}
+
+// duration 当前还没有切分的sample的总时长.
+func (r *dashRepresentation) duration(now uint64) uint64 {
+	if len(r.samples) == 0 || now < r.samples[0].DTS {
+		return 0
+	}
+
+	return now - r.samples[0].DTS
+}
+
+func (r *dashRepresentation) flush(maxSegments int) {
+	if len(r.samples) == 0 {
+		return
+	}
+
+	seg := &dashSegment{
+		Number: r.nextNumber,
+		Start:  r.samples[0].DTS,
+	}
+	for _, s := range r.samples {
+		seg.Duration += uint64(s.Duration)
+	}
+	seg.Data = r.track.MediaSegment(uint32(seg.Number), r.samples)
+
+	r.nextNumber++
+	r.samples = nil
+	r.segments = append(r.segments, seg)
+	if len(r.segments) > maxSegments {
+		r.segments = r.segments[len(r.segments)-maxSegments:]
+	}
+}
+
+func (r *dashRepresentation) segment(number uint64) *dashSegment {
+	for _, seg := range r.segments {
+		if seg.Number == number {
+			return seg
+		}
+	}
+
+	return nil
+}
+
+// bandwidth 根据已经生成的分片估算码率 单位 bit/s.
+func (r *dashRepresentation) bandwidth() int {
+	var size, duration uint64
+	for _, seg := range r.segments {
+		size += uint64(len(seg.Data))
+		duration += seg.Duration
+	}
+
+	if duration == 0 {
+		return 1
+	}
+
+	return int(size * 8 * DashTimescale / duration)
+}
+
+// DashStream 将一路直播流切分为 fMP4 分片 并生成动态的 MPD.
+type DashStream struct {
+	stream *Stream
+	sub    *Subscriber
+	cfg    DashConfig
+	done   chan struct{}
+
+	lock                  sync.RWMutex
+	availabilityStartTime time.Time
+	baseTimestamp         uint32
+	started               bool
+	video                 *dashRepresentation
+	audio                 *dashRepresentation
+}
+
+func newDashStream(s *Stream, cfg DashConfig) *DashStream {
+	return &DashStream{
+		stream: s,
+		sub:    newInternalSubscriber("dash"),
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+}
+
+// maxSegments 内存中保留的分片数 比播放列表中多保留两个 防止播放端请求时已经被删除.
+func (d *DashStream) maxSegments() int {
+	return d.windowSegments() + 2
+}
+
+func (d *DashStream) windowSegments() int {
+	n := int(d.cfg.WindowDuration / d.cfg.FragmentDuration)
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+func (d *DashStream) run() {
+	for {
+		select {
+		case p := <-d.sub.Packets():
+			d.handlePacket(p)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *DashStream) stop() {
+	close(d.done)
+}
+
+func (d *DashStream) handlePacket(p *AVPacket) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if p.IsSequenceHeader() {
+		d.handleSequenceHeader(p)
+
+		return
+	}
+
+	var r *dashRepresentation
+	switch {
+	case p.IsVideo():
+		r = d.video
+		// 每个分片都需要从关键帧开始
+		if r != nil && !d.started && !p.IsKeyFrame() {
+			return
+		}
+	case p.IsAudio():
+		r = d.audio
+		// 有视频时 等视频开始后再开始音频 这样音视频的分片可以对齐
+		if d.video != nil && !d.started {
+			return
+		}
+	}
+	if r == nil {
+		return
+	}
+
+	if !d.started {
+		d.started = true
+		d.baseTimestamp = p.Timestamp
+		d.availabilityStartTime = time.Now()
+	}
+
+	var dts uint64
+	if p.Timestamp > d.baseTimestamp {
+		dts = uint64(p.Timestamp - d.baseTimestamp)
+	}
+
+	s, err := newFmp4Sample(p, dts)
+	if err != nil {
+		return
+	}
+	r.push(s)
+
+	target := uint64(d.cfg.FragmentDuration / time.Millisecond)
+	switch {
+	case r == d.video && s.KeyFrame && r.duration(dts) >= target:
+		r.flush(d.maxSegments())
+		if d.audio != nil {
+			d.audio.flush(d.maxSegments())
+		}
+	case r == d.audio && d.video == nil && r.duration(dts) >= target:
+		r.flush(d.maxSegments())
+	}
+}
+
+func (d *DashStream) handleSequenceHeader(p *AVPacket) {
+	if p.IsVideo() {
+		if len(p.Payload) < 5 {
+			return
+		}
+		avc, err := ParseAVCDecoderConfigurationRecord(p.Payload[5:])
+		if err != nil {
+			logger().Warn("dash parse avc sequence header failed", "err", err)
+
+			return
+		}
+		// 推流端重复发送相同的 sequence header 时不需要重新开始
+		if d.video != nil && bytes.Equal(d.video.track.AVC.Raw, avc.Raw) {
+			return
+		}
+		d.video = newDashRepresentation(DashRepresentationVideo, &Fmp4Track{
+			ID:        Fmp4TrackVideo,
+			Timescale: DashTimescale,
+			AVC:       avc,
+		})
+
+		return
+	}
+
+	aac, err := ParseAudioSpecificConfig(p.Payload[2:])
+	if err != nil {
+		logger().Warn("dash parse aac sequence header failed", "err", err)
+
+		return
+	}
+	if d.audio != nil && bytes.Equal(d.audio.track.AAC.Raw, aac.Raw) {
+		return
+	}
+	d.audio = newDashRepresentation(DashRepresentationAudio, &Fmp4Track{
+		ID:        Fmp4TrackAudio,
+		Timescale: DashTimescale,
+		AAC:       aac,
+	})
+}
+
+func (d *DashStream) representation(id string) *dashRepresentation {
+	switch id {
+	case DashRepresentationVideo:
+		return d.video
+	case DashRepresentationAudio:
+		return d.audio
+	}
+
+	return nil
+}
+
+type mpdRoot struct {
+	XMLName                    xml.Name  `xml:"MPD"`
+	Xmlns                      string    `xml:"xmlns,attr"`
+	Profiles                   string    `xml:"profiles,attr"`
+	Type                       string    `xml:"type,attr"`
+	AvailabilityStartTime      string    `xml:"availabilityStartTime,attr"`
+	PublishTime                string    `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string    `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string    `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string    `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string    `xml:"suggestedPresentationDelay,attr"`
+	Period                     mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID               int               `xml:"id,attr"`
+	ContentType      string            `xml:"contentType,attr"`
+	MimeType         string            `xml:"mimeType,attr"`
+	SegmentAlignment bool              `xml:"segmentAlignment,attr"`
+	StartWithSAP     int               `xml:"startWithSAP,attr"`
+	Representation   mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID                        string             `xml:"id,attr"`
+	Codecs                    string             `xml:"codecs,attr"`
+	Bandwidth                 int                `xml:"bandwidth,attr"`
+	Width                     int                `xml:"width,attr,omitempty"`
+	Height                    int                `xml:"height,attr,omitempty"`
+	AudioSamplingRate         int                `xml:"audioSamplingRate,attr,omitempty"`
+	AudioChannelConfiguration *mpdDescriptor     `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate           mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale       int                 `xml:"timescale,attr"`
+	Initialization  string              `xml:"initialization,attr"`
+	Media           string              `xml:"media,attr"`
+	StartNumber     uint64              `xml:"startNumber,attr"`
+	Duration        uint64              `xml:"duration,attr,omitempty"`
+	SegmentTimeline *mpdSegmentTimeline `xml:"SegmentTimeline,omitempty"`
+}
+
+type mpdSegmentTimeline struct {
+	S []mpdS `xml:"S"`
+}
+
+type mpdS struct {
+	T uint64 `xml:"t,attr"`
+	D uint64 `xml:"d,attr"`
+	R int    `xml:"r,attr,omitempty"`
+}
+
+func mpdDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+func mpdTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// MPD 生成当前的播放列表 还没有生成分片时返回nil.
+func (d *DashStream) MPD(now time.Time) []byte {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if !d.started {
+		return nil
+	}
+
+	m := &mpdRoot{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      mpdTime(d.availabilityStartTime),
+		PublishTime:                mpdTime(now),
+		MinimumUpdatePeriod:        mpdDuration(d.cfg.FragmentDuration),
+		MinBufferTime:              mpdDuration(d.cfg.FragmentDuration),
+		TimeShiftBufferDepth:       mpdDuration(d.cfg.WindowDuration),
+		SuggestedPresentationDelay: mpdDuration(3 * d.cfg.FragmentDuration),
+		Period: mpdPeriod{
+			ID:    "0",
+			Start: "PT0S",
+		},
+	}
+
+	for i, r := range []*dashRepresentation{d.video, d.audio} {
+		if r == nil || len(r.segments) == 0 {
+			continue
+		}
+
+		set := mpdAdaptationSet{
+			ID:               i,
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representation:   d.mpdRepresentation(r),
+		}
+		if r.track.IsVideo() {
+			set.ContentType = "video"
+			set.MimeType = "video/mp4"
+		} else {
+			set.ContentType = "audio"
+			set.MimeType = "audio/mp4"
+		}
+		m.Period.AdaptationSets = append(m.Period.AdaptationSets, set)
+	}
+
+	if len(m.Period.AdaptationSets) == 0 {
+		return nil
+	}
+
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil
+	}
+
+	return append([]byte(xml.Header), b...)
+}
+
+func (d *DashStream) mpdRepresentation(r *dashRepresentation) mpdRepresentation {
+	rep := mpdRepresentation{
+		ID:        r.ID,
+		Bandwidth: r.bandwidth(),
+		SegmentTemplate: mpdSegmentTemplate{
+			Timescale:      DashTimescale,
+			Initialization: "$RepresentationID$/init.mp4",
+			Media:          "$RepresentationID$/$Number$.m4s",
+			StartNumber:    1,
+		},
+	}
+
+	if r.track.IsVideo() {
+		rep.Codecs = r.track.AVC.Codecs()
+		rep.Width = r.track.AVC.Width
+		rep.Height = r.track.AVC.Height
+	} else {
+		rep.Codecs = r.track.AAC.Codecs()
+		rep.AudioSamplingRate = r.track.AAC.SampleRate
+		rep.AudioChannelConfiguration = &mpdDescriptor{
+			SchemeIDURI: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+			Value:       strconv.Itoa(r.track.AAC.ChannelCount),
+		}
+	}
+
+	if !d.cfg.SegmentTimeline {
+		// 只使用 $Number$ 播放端根据 availabilityStartTime 和 duration 计算分片序号
+		rep.SegmentTemplate.Duration = uint64(d.cfg.FragmentDuration / time.Millisecond)
+
+		return rep
+	}
+
+	segments := r.segments
+	if window := d.windowSegments(); len(segments) > window {
+		segments = segments[len(segments)-window:]
+	}
+
+	timeline := &mpdSegmentTimeline{}
+	for _, seg := range segments {
+		// 连续时长相同的分片 使用 r 合并
+		if n := len(timeline.S); n > 0 {
+			last := &timeline.S[n-1]
+			if last.D == seg.Duration && last.T+last.D*uint64(last.R+1) == seg.Start {
+				last.R++
+
+				continue
+			}
+		}
+		timeline.S = append(timeline.S, mpdS{T: seg.Start, D: seg.Duration})
+	}
+	rep.SegmentTemplate.StartNumber = segments[0].Number
+	rep.SegmentTemplate.SegmentTimeline = timeline
+
+	return rep
+}
+
+// DashManager 管理所有正在切片的直播流 同时提供 HTTP 服务.
+type DashManager struct {
+	lock    sync.RWMutex
+	streams map[string]*DashStream
+	cfg     DashConfig
+}
+
+func newDashManager(cfg DashConfig) *DashManager {
+	return &DashManager{
+		streams: make(map[string]*DashStream),
+		cfg:     cfg,
+	}
+}
+
+func (m *DashManager) onPublish(s *Stream) {
+	d := newDashStream(s, m.cfg)
+
+	m.lock.Lock()
+	if old, ok := m.streams[s.Key()]; ok {
+		old.stop()
+		streamManager.Unsubscribe(old.stream, old.sub)
+	}
+	m.streams[s.Key()] = d
+	m.lock.Unlock()
+
+	d.stream = streamManager.Subscribe(s.Vhost, s.App, s.Name, d.sub)
+	go d.run()
+}
+
+func (m *DashManager) onUnpublish(s *Stream) {
+	m.lock.Lock()
+	d, ok := m.streams[s.Key()]
+	if ok {
+		delete(m.streams, s.Key())
+	}
+	m.lock.Unlock()
+
+	if ok {
+		d.stop()
+		streamManager.Unsubscribe(d.stream, d.sub)
+	}
+}
+
+func (m *DashManager) get(key string) *DashStream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.streams[key]
+}
+
+// ServeHTTP 支持的路径:
+//
+//	{path}{app}/{stream}/index.mpd
+//	{path}{app}/{stream}/{video|audio}/init.mp4
+//	{path}{app}/{stream}/{video|audio}/{number}.m4s
+func (m *DashManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	path := strings.TrimPrefix(r.URL.Path, m.cfg.Path)
+
+	if strings.HasSuffix(path, "/index.mpd") {
+		d := m.get(strings.TrimSuffix(path, "/index.mpd"))
+		if d == nil {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		b := d.MPD(time.Now())
+		if b == nil {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", dashMPDContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(b)
+
+		return
+	}
+
+	// 从后往前解析 app 中可能带有 /
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+	file := path[i+1:]
+	j := strings.LastIndexByte(path[:i], '/')
+	if j <= 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+	repID := path[j+1 : i]
+
+	d := m.get(path[:j])
+	if d == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	// 只在查找时加锁 写响应时不能阻塞切片
+	d.lock.RLock()
+	rep := d.representation(repID)
+	var data []byte
+	if rep != nil && file == "init.mp4" {
+		data = rep.init
+	} else if rep != nil && strings.HasSuffix(file, ".m4s") {
+		number, err := strconv.ParseUint(strings.TrimSuffix(file, ".m4s"), 10, 64)
+		if err == nil {
+			if seg := rep.segment(number); seg != nil {
+				data = seg.Data
+			}
+		}
+	}
+	d.lock.RUnlock()
+
+	if data == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if repID == DashRepresentationVideo {
+		w.Header().Set("Content-Type", "video/mp4")
+	} else {
+		w.Header().Set("Content-Type", "audio/mp4")
+	}
+	_, _ = w.Write(data)
+}
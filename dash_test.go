@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var (
+	testSPS = []byte{
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03,
+		0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0x20, 0xf1, 0x83, 0x19, 0x60,
+	}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func testAVCSequenceHeader() []byte {
+	b := []byte{0x17, 0, 0, 0, 0, 1, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0, byte(len(testSPS))}
+	b = append(b, testSPS...)
+	b = append(b, 1, 0, byte(len(testPPS)))
+
+	return append(b, testPPS...)
+}
+
+func testVideoFrame(key bool) []byte {
+	b := []byte{0x27, 1, 0, 0, 0, 0, 0, 0, 4, 0x41, 1, 2, 3}
+	if key {
+		b[0] = 0x17
+		b[9] = 0x65
+	}
+
+	return b
+}
+
+func TestParseAVCDecoderConfigurationRecord(t *testing.T) {
+	r, err := ParseAVCDecoderConfigurationRecord(testAVCSequenceHeader()[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Width != 1280 || r.Height != 720 {
+		t.Fatalf("resolution is %dx%d", r.Width, r.Height)
+	}
+
+	if r.Codecs() != "avc1.64001f" {
+		t.Fatalf("codecs is %s", r.Codecs())
+	}
+}
+
+func TestDashStreamSegment(t *testing.T) {
+	d := newDashStream(newStream("", "live", "test"), DashConfig{
+		FragmentDuration: time.Second,
+		WindowDuration:   10 * time.Second,
+		SegmentTimeline:  true,
+	})
+
+	d.handlePacket(&AVPacket{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()})
+	d.handlePacket(&AVPacket{Type: RtmpMsgAudio, Payload: []byte{0xaf, 0, 0x12, 0x10}})
+
+	// 25fps 每秒一个关键帧 一共3秒
+	for i := 0; i <= 75; i++ {
+		ts := uint32(i * 40)
+		d.handlePacket(&AVPacket{Type: RtmpMsgVideo, Timestamp: ts, Payload: testVideoFrame(i%25 == 0)})
+		d.handlePacket(&AVPacket{Type: RtmpMsgAudio, Timestamp: ts, Payload: []byte{0xaf, 1, 0x21}})
+	}
+
+	if n := len(d.video.segments); n != 3 {
+		t.Fatalf("video segments is %d", n)
+	}
+
+	seg := d.video.segments[1]
+	if seg.Number != 2 || seg.Start != 1000 || seg.Duration != 1000 {
+		t.Fatalf("segment is %d %d %d", seg.Number, seg.Start, seg.Duration)
+	}
+
+	if string(seg.Data[4:8]) != "moof" {
+		t.Fatalf("segment must start with moof")
+	}
+	moofSize := binary.BigEndian.Uint32(seg.Data)
+	if string(seg.Data[moofSize+4:moofSize+8]) != "mdat" {
+		t.Fatalf("mdat must follow moof")
+	}
+
+	mpd := d.MPD(time.Now())
+	for _, s := range []string{`type="dynamic"`, `<S t="0" d="1000" r="2">`, `codecs="mp4a.40.2"`} {
+		if !bytes.Contains(mpd, []byte(s)) {
+			t.Fatalf("mpd missing %s\n%s", s, mpd)
+		}
+	}
+}
+
+// 推流端重复发送相同的 sequence header 时已经生成的分片不能丢掉 不同的 sequence header 重新开始.
+func TestDashStreamRepeatedSequenceHeader(t *testing.T) {
+	d := newDashStream(newStream("", "live", "test"), DashConfig{
+		FragmentDuration: time.Second,
+		WindowDuration:   10 * time.Second,
+	})
+
+	d.handlePacket(&AVPacket{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()})
+	d.handlePacket(&AVPacket{Type: RtmpMsgAudio, Payload: []byte{0xaf, 0, 0x12, 0x10}})
+	for i := 0; i <= 50; i++ {
+		d.handlePacket(&AVPacket{Type: RtmpMsgVideo, Timestamp: uint32(i * 40), Payload: testVideoFrame(i%25 == 0)})
+	}
+	video, audio := d.video, d.audio
+	if n := len(video.segments); n != 2 {
+		t.Fatalf("video segments is %d", n)
+	}
+
+	d.handlePacket(&AVPacket{Type: RtmpMsgVideo, Timestamp: 2040, Payload: testAVCSequenceHeader()})
+	d.handlePacket(&AVPacket{Type: RtmpMsgAudio, Timestamp: 2040, Payload: []byte{0xaf, 0, 0x12, 0x10}})
+	if d.video != video || d.audio != audio || len(d.video.segments) != 2 {
+		t.Fatal("same sequence header restarted the representation")
+	}
+
+	// 44.1kHz 换成 48kHz
+	d.handlePacket(&AVPacket{Type: RtmpMsgAudio, Timestamp: 2080, Payload: []byte{0xaf, 0, 0x11, 0x90}})
+	if d.audio == audio {
+		t.Fatal("new sequence header did not restart the representation")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DumpStatusInterval 录制时打印状态的间隔.
+const DumpStatusInterval = 5 * time.Second
+
+// lastFlvTimestamp 读取已有的FLV 返回最后一个tag的时间戳和完整的tag结束的位置
+// 最后一个tag不完整时 续录需要从这个位置开始覆盖.
+func lastFlvTimestamp(f *os.File) (uint32, int64, error) {
+	r := NewFlvReader(f)
+	if _, _, err := r.ReadHeader(); err != nil {
+		return 0, 0, err
+	}
+
+	var last uint32
+	end := int64(FlvHeaderSize + 4)
+	for {
+		tag, err := r.ReadTag()
+		if err != nil {
+			break
+		}
+		if tag.Type == FlvTagAudio || tag.Type == FlvTagVideo {
+			last = tag.Timestamp
+		}
+		end += int64(FlvTagHeaderSize + len(tag.Data) + 4)
+	}
+
+	return last, end, nil
+}
+
+type dumpStats struct {
+	start   time.Time
+	bytes   int64
+	audio   int
+	video   int
+	lastTs  uint32
+	printed time.Time
+}
+
+func (s *dumpStats) print(force bool) {
+	if !force && time.Since(s.printed) < DumpStatusInterval {
+		return
+	}
+	s.printed = time.Now()
+
+	elapsed := time.Since(s.start).Seconds()
+	kbps := 0.0
+	if elapsed > 0 {
+		kbps = float64(s.bytes) * 8 / 1000 / elapsed
+	}
+	fmt.Fprintf(os.Stderr, "time=%.1fs media=%.1fs size=%dKB video=%d audio=%d bitrate=%.0fkbps\n",
+		elapsed, float64(s.lastTs)/1000, s.bytes/1024, s.video, s.audio, kbps)
+}
+
+// runDump dump 子命令 播放一路流写成FLV文件或者输出到标准输出
+//
+//	rtmp dump [flags] <rtmp://host/app/stream> <file.flv|->
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	duration := fs.Duration("duration", 0, "stop after this much media time, 0 means until the stream ends")
+	start := fs.Duration("start", 0, "start position for VOD streams")
+	resume := fs.Bool("resume", false, "append to an existing file and seek to where it ends")
+	audioOnly := fs.Bool("audio-only", false, "only record audio")
+	videoOnly := fs.Bool("video-only", false, "only record video")
+	live := fs.Bool("live", false, "only play live stream, do not fall back to VOD")
+	timeout := fs.Duration("timeout", 10*time.Second, "connect timeout, also the timeout for reading packets")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmp dump [flags] <rtmp://host/app/stream> <file.flv|->")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+
+		return errors.New("need url and output")
+	}
+	url, output := fs.Arg(0), fs.Arg(1)
+
+	if *audioOnly && *videoOnly {
+		return errors.New("audio-only and video-only can not be used together")
+	}
+
+	var out *os.File
+	var resumeTs uint32
+	resumed := false
+	switch {
+	case output == "-":
+		if *resume {
+			return errors.New("can not resume stdout")
+		}
+		out = os.Stdout
+		// 数据输出到标准输出 其他的打印都改到标准错误
+		os.Stdout = os.Stderr
+	case *resume:
+		f, err := os.OpenFile(output, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		last, end, err := lastFlvTimestamp(f)
+		if err != nil {
+			return errors.Wrap(err, "read "+output)
+		}
+		if err = f.Truncate(end); err != nil {
+			return err
+		}
+		if _, err = f.Seek(end, io.SeekStart); err != nil {
+			return err
+		}
+		out, resumeTs, resumed = f, last, true
+		*start = time.Duration(last) * time.Millisecond
+		fmt.Fprintln(os.Stderr, "resume from ", *start)
+	default:
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	opts := defaultClientOptions()
+	opts.Timeout = *timeout
+	client, err := DialRtmpWithOptions(url, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	fmt.Fprintln(os.Stderr, "connected ", url, " ", statusDescription(client.ServerInfo))
+
+	client.OnStatus = func(info AMFObjects) {
+		fmt.Fprintln(os.Stderr, "status ", statusDescription(info))
+	}
+
+	playStart, playDuration := -2.0, -1.0
+	if *live {
+		playStart = -1
+	}
+	if *start > 0 {
+		playStart = start.Seconds()
+	}
+	if *duration > 0 {
+		playDuration = duration.Seconds()
+	}
+	if err = client.PlayRange(playStart, playDuration); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "playing ", url)
+
+	if *audioOnly || *videoOnly {
+		if err = client.Receive(!*videoOnly, !*audioOnly); err != nil {
+			return err
+		}
+	}
+	client.SetReadTimeout(*timeout)
+
+	w := NewFlvWriter(out)
+	if !resumed {
+		if err = w.WriteHeader(!*videoOnly, !*audioOnly); err != nil {
+			return err
+		}
+	}
+
+	stats := &dumpStats{start: time.Now(), printed: time.Now()}
+	defer stats.print(true)
+
+	// 输出的时间戳为 ts - base + offset 从0开始 续录时接在原来的后面
+	var base, offset, first uint32
+	baseSet := false
+	for {
+		p, err := client.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if (*audioOnly && p.IsVideo()) || (*videoOnly && p.IsAudio()) {
+			continue
+		}
+
+		ts := stats.lastTs
+		if p.IsAudio() || p.IsVideo() {
+			if !baseSet {
+				base = p.Timestamp
+				// 点播 seek 之后时间戳就是文件中的位置 直接使用
+				if resumed && base > resumeTs {
+					base = 0
+				} else if resumed {
+					offset = resumeTs + 1
+				}
+				first = p.Timestamp - base + offset
+				baseSet = true
+			}
+			if p.Timestamp < base {
+				p.Timestamp = base
+			}
+			ts = p.Timestamp - base + offset
+		}
+
+		if err = w.WriteTag(&FlvTag{Type: p.Type, Timestamp: ts, Data: p.Payload}); err != nil {
+			return err
+		}
+
+		stats.bytes += int64(len(p.Payload))
+		switch {
+		case p.IsVideo():
+			stats.video++
+			stats.lastTs = ts
+		case p.IsAudio():
+			stats.audio++
+			stats.lastTs = ts
+		}
+		stats.print(false)
+
+		if *duration > 0 && baseSet && time.Duration(ts-first)*time.Millisecond >= *duration {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EdgeManager 边缘节点 播放本地没有发布的流时 从源站拉流
+// 最后一个播放者离开 IdleTimeout 后停止拉流.
+type EdgeManager struct {
+	lock    sync.Mutex
+	pullers map[string]*edgePull
+}
+
+type edgePull struct {
+	puller *Puller
+	// 没有播放者时的停止计时
+	idle *time.Timer
+}
+
+var edgeManager = newEdgeManager()
+
+func newEdgeManager() *EdgeManager {
+	return &EdgeManager{
+		pullers: make(map[string]*edgePull),
+	}
+}
+
+func (m *EdgeManager) origin(s *Stream) string {
+	for _, rule := range conf().Edge.Rules {
+		if rule.App == appBase(s.App) {
+			return expandRelayURL(rule.Origin, s)
+		}
+	}
+
+	return ""
+}
+
+// onSubscribe 流没有发布者时开始回源 回源建立之前播放者会一直等待 发布后就会收到数据.
+func (m *EdgeManager) onSubscribe(s *Stream) {
+	origin := m.origin(s)
+	if origin == "" {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if e, ok := m.pullers[s.Key()]; ok {
+		if e.idle != nil {
+			e.idle.Stop()
+			e.idle = nil
+		}
+
+		return
+	}
+
+	if s.Publisher() != nil {
+		return
+	}
+
+	cfg := conf().Edge
+	p := newPuller(s.Vhost, s.App, s.Name, origin, cfg.RetryMin, cfg.RetryMax)
+	m.pullers[s.Key()] = &edgePull{puller: p}
+	go p.run()
+}
+
+// onUnsubscribe 只按照播放者计算 DASH 录制和转推的订阅者不会让回源一直保持.
+func (m *EdgeManager) onUnsubscribe(s *Stream) {
+	if s.PlayerCount() > 0 {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.pullers[s.Key()]
+	if !ok || e.idle != nil {
+		return
+	}
+
+	key, vhost, app, name := s.Key(), s.Vhost, s.App, s.Name
+	e.idle = time.AfterFunc(conf().Edge.IdleTimeout, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		// 计时期间又有新的播放者 这时 onSubscribe 已经把 idle 置空了
+		if m.pullers[key] != e || e.idle == nil {
+			return
+		}
+		if cur := streamManager.Get(vhost, app, name); cur != nil && cur.PlayerCount() > 0 {
+			e.idle = nil
+
+			return
+		}
+
+		delete(m.pullers, key)
+		e.puller.stop()
+	})
+}
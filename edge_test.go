@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEdgeIdleTeardown(t *testing.T) {
+	defer setConfig(conf())
+
+	// 关闭的端口 回源一直失败重试
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	c := *conf()
+	c.Edge = EdgeConfig{
+		IdleTimeout: 20 * time.Millisecond,
+		RetryMin:    time.Second,
+		RetryMax:    time.Second,
+		Rules:       []EdgeRule{{App: "edgetest", Origin: fmt.Sprintf("rtmp://%s/{app}/{stream}", l.Addr())}},
+	}
+	setConfig(&c)
+
+	m := newEdgeManager()
+	pulling := func() *edgePull {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		return m.pullers[streamKey("", "edgetest", "idle")]
+	}
+
+	player := newSubscriber("player")
+	s := streamManager.Subscribe("", "edgetest", "idle", player)
+	m.onSubscribe(s)
+	e := pulling()
+	if e == nil {
+		t.Fatal("edge pull not started")
+	}
+
+	// DASH 录制 转推的订阅者不会让回源一直保持
+	dash := newInternalSubscriber("dash")
+	streamManager.Subscribe("", "edgetest", "idle", dash)
+	defer streamManager.Unsubscribe(s, dash)
+
+	streamManager.Unsubscribe(s, player)
+	m.onUnsubscribe(s)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for pulling() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("edge pull not stopped with only internal subscribers")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !e.puller.stopped() {
+		t.Error("puller not stopped")
+	}
+}
+
+func TestEdgeIdleKeepPlayer(t *testing.T) {
+	defer setConfig(conf())
+
+	c := *conf()
+	c.Edge = EdgeConfig{
+		IdleTimeout: 20 * time.Millisecond,
+		RetryMin:    time.Second,
+		RetryMax:    time.Second,
+		Rules:       []EdgeRule{{App: "edgetest", Origin: "rtmp://127.0.0.1:1/{app}/{stream}"}},
+	}
+	setConfig(&c)
+
+	m := newEdgeManager()
+	a, b := newSubscriber("a"), newSubscriber("b")
+	s := streamManager.Subscribe("", "edgetest", "keep", a)
+	m.onSubscribe(s)
+	streamManager.Subscribe("", "edgetest", "keep", b)
+	m.onSubscribe(s)
+	defer streamManager.Unsubscribe(s, b)
+
+	streamManager.Unsubscribe(s, a)
+	m.onUnsubscribe(s)
+	time.Sleep(60 * time.Millisecond)
+
+	m.lock.Lock()
+	e := m.pullers[s.Key()]
+	m.lock.Unlock()
+	if e == nil || e.puller.stopped() {
+		t.Fatal("edge pull stopped while a player remains")
+	}
+	e.puller.stop()
+}
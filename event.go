@@ -11,5 +11,17 @@ const (
 	LevelWrong  = "warning"
 
 	// NetConnect
-	NetConnectionConnectSuccess = "NetConnection.Connect.Success"
+	NetConnectionConnectSuccess  = "NetConnection.Connect.Success"
+	NetConnectionConnectRejected = "NetConnection.Connect.Rejected"
+
+	// NetStream
+	NetStreamPublishStart        = "NetStream.Publish.Start"
+	NetStreamPublishBadName      = "NetStream.Publish.BadName"
+	NetStreamUnpublishSuccess    = "NetStream.Unpublish.Success"
+	NetStreamPlayReset           = "NetStream.Play.Reset"
+	NetStreamPlayStart           = "NetStream.Play.Start"
+	NetStreamPlayStop            = "NetStream.Play.Stop"
+	NetStreamPlayFailed          = "NetStream.Play.Failed"
+	NetStreamPlayStreamNotFound  = "NetStream.Play.StreamNotFound"
+	NetStreamPlayUnpublishNotify = "NetStream.Play.UnpublishNotify"
 )
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FlvHeaderSize    = 9
+	FlvTagHeaderSize = 11
+
+	FlvTagAudio      = RtmpMsgAudio
+	FlvTagVideo      = RtmpMsgVideo
+	FlvTagScriptData = RtmpMsgAMF0Data
+)
+
+// FlvTag 一个FLV tag 类型和RTMP的消息类型是一致的.
+type FlvTag struct {
+	Type      byte
+	Timestamp uint32
+	Data      []byte
+}
+
+// Packet 转换为 AVPacket 不需要的脚本数据返回nil.
+func (t *FlvTag) Packet() *AVPacket {
+	msg := &Chunk{
+		ChunkHeader: &ChunkHeader{},
+		Body:        t.Data,
+	}
+	msg.MessageTypeID = t.Type
+	msg.Timestamp = t.Timestamp
+	if t.Type == FlvTagScriptData {
+		msg.MsgData = decodeDataAMF0(t.Data)
+	}
+
+	return newAVPacket(msg)
+}
+
+// FlvReader 读取FLV文件或者HTTP-FLV的数据.
+type FlvReader struct {
+	r      io.Reader
+	header [FlvTagHeaderSize]byte
+}
+
+func NewFlvReader(r io.Reader) *FlvReader {
+	return &FlvReader{r: r}
+}
+
+// ReadHeader 读取FLV头 和后面的 PreviousTagSize0.
+func (r *FlvReader) ReadHeader() (hasAudio, hasVideo bool, err error) {
+	h := make([]byte, FlvHeaderSize)
+	if _, err = io.ReadFull(r.r, h); err != nil {
+		return false, false, err
+	}
+
+	if !bytes.Equal(h[:3], []byte("FLV")) {
+		return false, false, errors.New("not flv")
+	}
+
+	// DataOffset 一般就是9 若是更大需要跳过多出来的部分
+	offset := binary.BigEndian.Uint32(h[5:])
+	if offset < FlvHeaderSize {
+		return false, false, errors.Errorf("invalid flv data offset %d", offset)
+	}
+	if _, err = io.CopyN(ioutil.Discard, r.r, int64(offset-FlvHeaderSize)+4); err != nil {
+		// 和 io.ReadFull 一样 读了一部分就结束的返回 ErrUnexpectedEOF
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return false, false, err
+	}
+
+	return h[4]&0x04 != 0, h[4]&0x01 != 0, nil
+}
+
+// ReadTag 读取一个tag 以及后面的 PreviousTagSize.
+func (r *FlvReader) ReadTag() (*FlvTag, error) {
+	h := r.header[:]
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		return nil, err
+	}
+
+	// 1byte类型 + 3byte长度 + 3byte时间戳 + 1byte扩展时间戳(时间戳的高8位) + 3byte streamID
+	size := uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3])
+	tag := &FlvTag{
+		Type:      h[0] & 0x1f,
+		Timestamp: uint32(h[7])<<24 | uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6]),
+		Data:      make([]byte, size),
+	}
+
+	if _, err := io.ReadFull(r.r, tag.Data); err != nil {
+		return nil, err
+	}
+
+	var prev [4]byte
+	if _, err := io.ReadFull(r.r, prev[:]); err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// FlvWriter 写FLV文件.
+type FlvWriter struct {
+	w io.Writer
+}
+
+func NewFlvWriter(w io.Writer) *FlvWriter {
+	return &FlvWriter{w: w}
+}
+
+// WriteHeader 写入FLV头 和 PreviousTagSize0.
+func (w *FlvWriter) WriteHeader(hasAudio, hasVideo bool) error {
+	h := []byte{'F', 'L', 'V', 1, 0, 0, 0, 0, FlvHeaderSize, 0, 0, 0, 0}
+	if hasAudio {
+		h[4] |= 0x04
+	}
+	if hasVideo {
+		h[4] |= 0x01
+	}
+
+	_, err := w.w.Write(h)
+
+	return err
+}
+
+// WriteTag 写入一个tag 以及后面的 PreviousTagSize.
+func (w *FlvWriter) WriteTag(t *FlvTag) error {
+	size := len(t.Data)
+	b := make([]byte, FlvTagHeaderSize+size+4)
+	b[0] = t.Type
+	b[1], b[2], b[3] = byte(size>>16), byte(size>>8), byte(size)
+	b[4], b[5], b[6], b[7] = byte(t.Timestamp>>16), byte(t.Timestamp>>8), byte(t.Timestamp), byte(t.Timestamp>>24)
+	copy(b[FlvTagHeaderSize:], t.Data)
+	binary.BigEndian.PutUint32(b[FlvTagHeaderSize+size:], uint32(FlvTagHeaderSize+size))
+
+	_, err := w.w.Write(b)
+
+	return err
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"rtmp/mem_pool"
+)
+
+func flvTestHeader(offset uint32) []byte {
+	h := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(h[5:], offset)
+	h = append(h, make([]byte, offset-FlvHeaderSize)...)
+
+	return append(h, 0, 0, 0, 0)
+}
+
+// flvTestTag 按照FLV格式拼一个tag 时间戳的高8位在扩展字节中.
+func flvTestTag(typ byte, ts uint32, data []byte) []byte {
+	size := len(data)
+	b := []byte{typ, byte(size >> 16), byte(size >> 8), byte(size), byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24), 0, 0, 0}
+	b = append(b, data...)
+	var prev [4]byte
+	binary.BigEndian.PutUint32(prev[:], uint32(FlvTagHeaderSize+size))
+
+	return append(b, prev[:]...)
+}
+
+func testOnMetaData() []byte {
+	initPoolOnce.Do(mem_pool.InitPool)
+
+	amf := NewAMFEncode()
+	_ = amf.writeString(DataOnMetaData)
+	_ = amf.writeMixedArray(AMFObjects{"width": float64(1280)})
+
+	return append([]byte(nil), amf.Bytes()...)
+}
+
+func TestFlvReaderTags(t *testing.T) {
+	tags := []FlvTag{
+		{Type: FlvTagScriptData, Data: testOnMetaData()},
+		{Type: FlvTagVideo, Data: testAVCSequenceHeader()},
+		{Type: FlvTagAudio, Timestamp: 23, Data: []byte{0xaf, 0x01, 1, 2}},
+		// 超过24位的时间戳
+		{Type: FlvTagVideo, Timestamp: 0x01020304, Data: testVideoFrame(true)},
+	}
+
+	for _, offset := range []uint32{FlvHeaderSize, FlvHeaderSize + 4} {
+		b := flvTestHeader(offset)
+		for _, tag := range tags {
+			b = append(b, flvTestTag(tag.Type, tag.Timestamp, tag.Data)...)
+		}
+
+		r := NewFlvReader(bytes.NewReader(b))
+		hasAudio, hasVideo, err := r.ReadHeader()
+		if err != nil || !hasAudio || !hasVideo {
+			t.Fatalf("offset %d: header %v %v %v", offset, hasAudio, hasVideo, err)
+		}
+		for i, want := range tags {
+			tag, err := r.ReadTag()
+			if err != nil {
+				t.Fatalf("offset %d: tag %d: %v", offset, i, err)
+			}
+			if tag.Type != want.Type || tag.Timestamp != want.Timestamp || !bytes.Equal(tag.Data, want.Data) {
+				t.Errorf("offset %d: tag %d is %+v", offset, i, tag)
+			}
+		}
+		if _, err = r.ReadTag(); err != io.EOF {
+			t.Errorf("offset %d: read after last tag: %v", offset, err)
+		}
+	}
+}
+
+func TestFlvTagPacket(t *testing.T) {
+	meta := testOnMetaData()
+
+	p := (&FlvTag{Type: FlvTagScriptData, Data: meta}).Packet()
+	if p == nil || p.Type != RtmpMsgAMF0Data || !bytes.Equal(p.Payload, meta) {
+		t.Errorf("metadata packet is %+v", p)
+	}
+
+	p = (&FlvTag{Type: FlvTagVideo, Timestamp: 40, Data: testVideoFrame(true)}).Packet()
+	if p == nil || p.Type != RtmpMsgVideo || p.Timestamp != 40 {
+		t.Errorf("video packet is %+v", p)
+	}
+
+	// 不需要的脚本数据
+	amf := NewAMFEncode()
+	_ = amf.writeString("onCuePoint")
+	if p = (&FlvTag{Type: FlvTagScriptData, Data: amf.Bytes()}).Packet(); p != nil {
+		t.Errorf("cue point packet is %+v", p)
+	}
+}
+
+func TestFlvReaderTruncated(t *testing.T) {
+	header := flvTestHeader(FlvHeaderSize)
+	tag := flvTestTag(FlvTagVideo, 0, testAVCSequenceHeader())
+
+	cases := []struct {
+		name string
+		b    []byte
+	}{
+		{"header", header[:5]},
+		{"previous tag size 0", header[:FlvHeaderSize+2]},
+		{"tag header", append(header, tag[:6]...)},
+		{"tag data", append(header, tag[:FlvTagHeaderSize+3]...)},
+		{"previous tag size", append(header, tag[:len(tag)-1]...)},
+	}
+
+	for _, c := range cases {
+		r := NewFlvReader(bytes.NewReader(c.b))
+		_, _, err := r.ReadHeader()
+		if err == nil {
+			_, err = r.ReadTag()
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+
+	if _, _, err := NewFlvReader(bytes.NewReader([]byte("FLA\x01\x05\x00\x00\x00\x09"))).ReadHeader(); err == nil {
+		t.Error("not flv accepted")
+	}
+
+	bad := append([]byte(nil), header...)
+	bad[8] = 4
+	if _, _, err := NewFlvReader(bytes.NewReader(bad)).ReadHeader(); err == nil {
+		t.Error("invalid data offset accepted")
+	}
+}
+
+func TestFlvWriterRoundTrip(t *testing.T) {
+	tags := []*FlvTag{
+		{Type: FlvTagScriptData, Data: testOnMetaData()},
+		{Type: FlvTagVideo, Data: testAVCSequenceHeader()},
+		{Type: FlvTagAudio, Timestamp: 23, Data: []byte{0xaf, 0x01, 1, 2}},
+		{Type: FlvTagVideo, Timestamp: 0x01020304, Data: testVideoFrame(true)},
+	}
+
+	var buf bytes.Buffer
+	w := NewFlvWriter(&buf)
+	if err := w.WriteHeader(true, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// FLV头 和 PreviousTagSize0
+	b := buf.Bytes()
+	if want := []byte{'F', 'L', 'V', 1, 0x04, 0, 0, 0, 9, 0, 0, 0, 0}; !bytes.Equal(b[:len(want)], want) {
+		t.Fatalf("header %x", b[:len(want)])
+	}
+	// 每个tag后面的 PreviousTagSize 是tag头加数据的长度
+	pos := FlvHeaderSize + 4
+	for i, tag := range tags {
+		pos += FlvTagHeaderSize + len(tag.Data)
+		if size := binary.BigEndian.Uint32(b[pos:]); size != uint32(FlvTagHeaderSize+len(tag.Data)) {
+			t.Errorf("tag %d previous tag size %d", i, size)
+		}
+		pos += 4
+	}
+	if pos != len(b) {
+		t.Errorf("wrote %d bytes, want %d", len(b), pos)
+	}
+
+	r := NewFlvReader(bytes.NewReader(b))
+	hasAudio, hasVideo, err := r.ReadHeader()
+	if err != nil || !hasAudio || hasVideo {
+		t.Fatalf("header %v %v %v", hasAudio, hasVideo, err)
+	}
+	for i, want := range tags {
+		tag, err := r.ReadTag()
+		if err != nil {
+			t.Fatalf("tag %d: %v", i, err)
+		}
+		if tag.Type != want.Type || tag.Timestamp != want.Timestamp || !bytes.Equal(tag.Data, want.Data) {
+			t.Errorf("tag %d is %+v", i, tag)
+		}
+		if i == 0 {
+			p := tag.Packet()
+			if p == nil {
+				t.Fatal("metadata not decoded")
+			}
+			data := decodeDataAMF0(p.Payload)
+			if meta, ok := data.Values[0].(AMFObjects); data.Name != DataOnMetaData || !ok || meta["width"] != float64(1280) {
+				t.Errorf("metadata %+v", data)
+			}
+		}
+	}
+	if _, err = r.ReadTag(); err != io.EOF {
+		t.Errorf("read after last tag: %v", err)
+	}
+}
+
+func TestLastFlvTimestamp(t *testing.T) {
+	f, err := ioutil.TempFile("", "dump*.flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewFlvWriter(f)
+	_ = w.WriteHeader(true, true)
+	_ = w.WriteTag(&FlvTag{Type: FlvTagVideo, Timestamp: 40, Data: testVideoFrame(true)})
+	_ = w.WriteTag(&FlvTag{Type: FlvTagAudio, Timestamp: 63, Data: []byte{0xaf, 0x01, 1, 2}})
+	_ = w.WriteTag(&FlvTag{Type: FlvTagScriptData, Timestamp: 70, Data: testOnMetaData()})
+	complete, _ := f.Seek(0, io.SeekCurrent)
+	// 录制中断 最后一个tag只写了一部分
+	var partial bytes.Buffer
+	_ = NewFlvWriter(&partial).WriteTag(&FlvTag{Type: FlvTagVideo, Timestamp: 80, Data: testVideoFrame(false)})
+	_, _ = f.Write(partial.Bytes()[:FlvTagHeaderSize+2])
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	last, end, err := lastFlvTimestamp(f)
+	if err != nil || last != 63 || end != complete {
+		t.Errorf("got %d %d %v, want 63 %d", last, end, err, complete)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	Fmp4TrackVideo = 1
+	Fmp4TrackAudio = 2
+
+	// trun 中的 sample_flags
+	fmp4KeyFrameFlags    = 0x02000000 // sample_depends_on = 2
+	fmp4NonKeyFrameFlags = 0x01010000 // sample_depends_on = 1 , sample_is_non_sync_sample = 1
+)
+
+var fmp4Matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// mp4Writer 用于写 ISO BMFF 的 box 嵌套的box通过栈记录起始位置 结束时回填size.
+type mp4Writer struct {
+	bytes.Buffer
+	stack []int
+}
+
+func (w *mp4Writer) u8(v byte) {
+	w.WriteByte(v)
+}
+
+func (w *mp4Writer) u16(v uint16) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *mp4Writer) u24(v uint32) {
+	w.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (w *mp4Writer) u32(v uint32) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *mp4Writer) u64(v uint64) {
+	_ = binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *mp4Writer) zeros(n int) {
+	w.Write(make([]byte, n))
+}
+
+func (w *mp4Writer) startBox(typ string) {
+	w.stack = append(w.stack, w.Len())
+	w.u32(0)
+	w.WriteString(typ)
+}
+
+func (w *mp4Writer) startFullBox(typ string, version byte, flags uint32) {
+	w.startBox(typ)
+	w.u8(version)
+	w.u24(flags)
+}
+
+func (w *mp4Writer) endBox() {
+	start := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.Bytes()[start:], uint32(w.Len()-start))
+}
+
+// Fmp4Track fMP4中的一路轨道 DASH中音视频分别使用单独的轨道和初始化分片.
+type Fmp4Track struct {
+	ID        uint32
+	Timescale uint32
+	AVC       *AVCDecoderConfigurationRecord
+	AAC       *AudioSpecificConfig
+}
+
+func (t *Fmp4Track) IsVideo() bool {
+	return t.AVC != nil
+}
+
+// Fmp4Sample 一个音频帧或视频帧 时间的单位都是 Track 的 Timescale.
+type Fmp4Sample struct {
+	DTS      uint64
+	Duration uint32
+	CTS      int32
+	KeyFrame bool
+	Data     []byte
+}
+
+// newFmp4Sample 将RTMP中的音视频数据转换为fMP4的sample 去掉FLV Tag的头部.
+func newFmp4Sample(p *AVPacket, dts uint64) (*Fmp4Sample, error) {
+	s := &Fmp4Sample{
+		DTS:      dts,
+		KeyFrame: true,
+	}
+
+	switch p.Type {
+	case RtmpMsgVideo:
+		// FrameType|CodecID(1byte) + AVCPacketType(1byte) + CompositionTime(3byte) + NALUs
+		if len(p.Payload) < 5 {
+			return nil, errors.New("video packet too short")
+		}
+		s.KeyFrame = p.IsKeyFrame()
+		cts := int32(uint32(p.Payload[2])<<16|uint32(p.Payload[3])<<8|uint32(p.Payload[4])) << 8 >> 8
+		s.CTS = cts
+		s.Data = p.Payload[5:]
+	case RtmpMsgAudio:
+		// SoundFormat|SoundRate|SoundSize|SoundType(1byte) + AACPacketType(1byte) + AAC raw
+		if len(p.Payload) < 2 {
+			return nil, errors.New("audio packet too short")
+		}
+		s.Data = p.Payload[2:]
+	default:
+		return nil, errors.Errorf("not support packet type %d", p.Type)
+	}
+
+	return s, nil
+}
+
+// InitSegment 生成初始化分片 ftyp + moov.
+func (t *Fmp4Track) InitSegment() []byte {
+	w := &mp4Writer{}
+
+	w.startBox("ftyp")
+	w.WriteString("iso5")
+	w.u32(1)
+	w.WriteString("iso5")
+	w.WriteString("iso6")
+	w.WriteString("mp41")
+	w.WriteString("dash")
+	w.endBox()
+
+	w.startBox("moov")
+	t.writeMvhd(w)
+	t.writeTrak(w)
+	w.startBox("mvex")
+	w.startFullBox("trex", 0, 0)
+	w.u32(t.ID)
+	w.u32(1) // default_sample_description_index
+	w.u32(0) // default_sample_duration
+	w.u32(0) // default_sample_size
+	w.u32(0) // default_sample_flags
+	w.endBox()
+	w.endBox()
+	w.endBox()
+
+	return w.Bytes()
+}
+
+func (t *Fmp4Track) writeMvhd(w *mp4Writer) {
+	w.startFullBox("mvhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.Timescale)
+	w.u32(0)          // duration
+	w.u32(0x00010000) // rate 1.0
+	w.u16(0x0100)     // volume 1.0
+	w.zeros(10)
+	for _, v := range fmp4Matrix {
+		w.u32(v)
+	}
+	w.zeros(24)     // pre_defined
+	w.u32(t.ID + 1) // next_track_ID
+	w.endBox()
+}
+
+func (t *Fmp4Track) writeTrak(w *mp4Writer) {
+	w.startBox("trak")
+
+	// flags: track_enabled | track_in_movie
+	w.startFullBox("tkhd", 0, 3)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.ID)
+	w.u32(0) // reserved
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate_group
+	if t.IsVideo() {
+		w.u16(0)
+	} else {
+		w.u16(0x0100)
+	}
+	w.u16(0)
+	for _, v := range fmp4Matrix {
+		w.u32(v)
+	}
+	if t.IsVideo() {
+		w.u32(uint32(t.AVC.Width) << 16)
+		w.u32(uint32(t.AVC.Height) << 16)
+	} else {
+		w.u32(0)
+		w.u32(0)
+	}
+	w.endBox()
+
+	w.startBox("mdia")
+	w.startFullBox("mdhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(t.Timescale)
+	w.u32(0)      // duration
+	w.u16(0x55c4) // language und
+	w.u16(0)
+	w.endBox()
+
+	w.startFullBox("hdlr", 0, 0)
+	w.u32(0)
+	if t.IsVideo() {
+		w.WriteString("vide")
+	} else {
+		w.WriteString("soun")
+	}
+	w.zeros(12)
+	if t.IsVideo() {
+		w.WriteString("VideoHandler")
+	} else {
+		w.WriteString("SoundHandler")
+	}
+	w.u8(0)
+	w.endBox()
+
+	w.startBox("minf")
+	if t.IsVideo() {
+		w.startFullBox("vmhd", 0, 1)
+		w.zeros(8) // graphicsmode + opcolor
+		w.endBox()
+	} else {
+		w.startFullBox("smhd", 0, 0)
+		w.zeros(4) // balance + reserved
+		w.endBox()
+	}
+
+	w.startBox("dinf")
+	w.startFullBox("dref", 0, 0)
+	w.u32(1)
+	w.startFullBox("url ", 0, 1)
+	w.endBox()
+	w.endBox()
+	w.endBox()
+
+	w.startBox("stbl")
+	w.startFullBox("stsd", 0, 0)
+	w.u32(1)
+	if t.IsVideo() {
+		t.writeAvc1(w)
+	} else {
+		t.writeMp4a(w)
+	}
+	w.endBox()
+	// fMP4 中 sample 的信息都在 moof 里面 这里都是空的
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.startFullBox(typ, 0, 0)
+		w.u32(0)
+		w.endBox()
+	}
+	w.startFullBox("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.endBox()
+	w.endBox() // stbl
+
+	w.endBox() // minf
+	w.endBox() // mdia
+	w.endBox() // trak
+}
+
+func (t *Fmp4Track) writeAvc1(w *mp4Writer) {
+	w.startBox("avc1")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.AVC.Width))
+	w.u16(uint16(t.AVC.Height))
+	w.u32(0x00480000) // horizresolution 72 dpi
+	w.u32(0x00480000) // vertresolution 72 dpi
+	w.u32(0)
+	w.u16(1) // frame_count
+	w.zeros(32)
+	w.u16(0x0018) // depth
+	w.u16(0xffff) // pre_defined = -1
+
+	w.startBox("avcC")
+	w.Write(t.AVC.Raw)
+	w.endBox()
+
+	w.endBox()
+}
+
+func (t *Fmp4Track) writeMp4a(w *mp4Writer) {
+	w.startBox("mp4a")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.AAC.ChannelCount))
+	w.u16(16) // samplesize
+	w.u16(0)
+	w.u16(0)
+	w.u32(uint32(t.AAC.SampleRate) << 16)
+
+	// esds 中的描述符 每个描述符都是 tag(1byte) + size + 内容
+	asc := t.AAC.Raw
+	decoderSpecificInfo := append([]byte{0x05, byte(len(asc))}, asc...)
+	decoderConfig := []byte{
+		0x04, byte(13 + len(decoderSpecificInfo)),
+		0x40,    // objectTypeIndication: Audio ISO/IEC 14496-3
+		0x15,    // streamType: AudioStream
+		0, 0, 0, // bufferSizeDB
+		0, 0, 0, 0, // maxBitrate
+		0, 0, 0, 0, // avgBitrate
+	}
+	decoderConfig = append(decoderConfig, decoderSpecificInfo...)
+	slConfig := []byte{0x06, 0x01, 0x02}
+
+	esLen := 3 + len(decoderConfig) + len(slConfig)
+	w.startFullBox("esds", 0, 0)
+	w.u8(0x03)
+	w.u8(byte(esLen))
+	w.u16(uint16(t.ID)) // ES_ID
+	w.u8(0)
+	w.Write(decoderConfig)
+	w.Write(slConfig)
+	w.endBox()
+
+	w.endBox()
+}
+
+// MediaSegment 生成一个媒体分片 moof + mdat.
+func (t *Fmp4Track) MediaSegment(sequence uint32, samples []*Fmp4Sample) []byte {
+	w := &mp4Writer{}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	w.startBox("moof")
+	w.startFullBox("mfhd", 0, 0)
+	w.u32(sequence)
+	w.endBox()
+
+	w.startBox("traf")
+	// flags: default-base-is-moof
+	w.startFullBox("tfhd", 0, 0x020000)
+	w.u32(t.ID)
+	w.endBox()
+
+	w.startFullBox("tfdt", 1, 0)
+	w.u64(samples[0].DTS)
+	w.endBox()
+
+	// flags: data-offset | sample-duration | sample-size | sample-flags | sample-composition-time-offsets
+	flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400)
+	if t.IsVideo() {
+		flags |= 0x000800
+	}
+	// version 1 的 composition time offset 是有符号的
+	w.startFullBox("trun", 1, flags)
+	w.u32(uint32(len(samples)))
+	dataOffsetPos := w.Len()
+	w.u32(0)
+	mdatSize := 8
+	for _, s := range samples {
+		w.u32(s.Duration)
+		w.u32(uint32(len(s.Data)))
+		if s.KeyFrame {
+			w.u32(fmp4KeyFrameFlags)
+		} else {
+			w.u32(fmp4NonKeyFrameFlags)
+		}
+		if t.IsVideo() {
+			w.u32(uint32(s.CTS))
+		}
+		mdatSize += len(s.Data)
+	}
+	w.endBox() // trun
+	w.endBox() // traf
+	w.endBox() // moof
+
+	// data_offset 是相对于moof开始的位置 指向mdat中的数据
+	binary.BigEndian.PutUint32(w.Bytes()[dataOffsetPos:], uint32(w.Len()+8))
+
+	w.u32(uint32(mdatSize))
+	w.WriteString("mdat")
+	for _, s := range samples {
+		w.Write(s.Data)
+	}
+
+	return w.Bytes()
+}
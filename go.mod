@@ -6,4 +6,5 @@ require (
 	github.com/funny/slab v0.0.0-20180511031532-b1fad5e5d478
 	github.com/funny/utest v0.0.0-20161029064919-43870a374500 // indirect
 	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v3 v3.0.1
 )
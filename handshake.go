@@ -7,9 +7,9 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"math/rand"
+	"time"
 )
 
 const (
@@ -32,7 +32,19 @@ const (
 	C1S1KeyOffsetMax  = 764 - C1S1KeyDataSize - C1S1KeyOffsetSize
 )
 
+// handshakeStartTime 握手中的时间是相对于服务端启动时间的毫秒数.
+var handshakeStartTime = time.Now()
+
+func handshakeEpoch() uint32 {
+	return uint32(time.Since(handshakeStartTime) / time.Millisecond)
+}
+
 var (
+	// RtmpServerVersion S1 中的版本号.
+	RtmpServerVersion = []byte{0x0d, 0x0e, 0x0a, 0x0d}
+	// RtmpClientVersion C1 中的版本号 和 Flash Player 一致.
+	RtmpClientVersion = []byte{0x80, 0x00, 0x07, 0x02}
+
 	FMSKey = []byte{
 		0x47, 0x65, 0x6e, 0x75, 0x69, 0x6e, 0x65, 0x20,
 		0x41, 0x64, 0x6f, 0x62, 0x65, 0x20, 0x46, 0x6c,
@@ -56,26 +68,38 @@ var (
 	} // 62
 )
 
-func handshake(conn *bufio.ReadWriter) error {
+// handshake 若是 RTMPE 握手 返回协商出来的密钥 否则为nil.
+func handshake(conn *bufio.ReadWriter) (*rtmpeCipher, error) {
 	// 首先读取C0C1 ；一般会将C0C1放到一起发送
 	c0c1, err := ReadByteToBuf(conn, C0C1Len)
 	// c0c1 := make([]byte , C0C1Len) // C0 1个字节 C1 1537个字节
 	// n , err := conn.Read(c0c1)
 	if err != nil {
-		return err
-	}
+		countHandshake(HandshakeUnknown, err)
 
-	if c0c1[0] != RtmpHandShakVersion {
-		fmt.Println("The Client Version is not support, client ver is ", c0c1[0])
-		return errors.New("The Client Version is not support ")
+		return nil, err
 	}
+
 	// 判断C1
 	if len(c0c1[1:]) != HandshakDataLen {
-		return errors.New("S1 illegal")
+		return nil, errors.New("S1 illegal")
 	}
 	// 获取c1
 	c1 := make([]byte, HandshakDataLen)
 	copy(c1, c0c1[1:])
+
+	switch c0c1[0] {
+	case RtmpHandShakVersion:
+	case RtmpeHandShakVersion, RtmpeXteaHandShakVersion, RtmpeBlowfishHandShakVersion:
+		c, err := rtmpeHandshake(conn, c0c1[0], c1)
+		countHandshake(HandshakeRtmpe, err)
+
+		return c, err
+	default:
+		logger().Debug("handshake version not supported", "version", c0c1[0])
+		countHandshakeResult(HandshakeUnknown, HandshakeFailure)
+		return nil, errors.New("The Client Version is not support ")
+	}
 	/*
 		C1构成(左闭右闭)： 0~3为时间戳  4字节
 						4~8为协议标识 4字节  若为0 则表示使用 simple_handshake
@@ -84,24 +108,33 @@ func handshake(conn *bufio.ReadWriter) error {
 	*/
 	// 这里 & 0xff 主要是为了防止c1[4] 太大 超过1byte，&0xff就可以将未超过的部分保留下来,超过的部分截断为0
 	if c1[4]&0xff == 0 {
-		return simpleHandshake(conn, c1)
+		err = simpleHandshake(conn, c1)
+		countHandshake(HandshakeSimple, err)
+
+		return nil, err
 	}
 
-	return complexHandshake(conn, c1)
+	return nil, complexHandshake(conn, c1)
 }
 
 func simpleHandshake(conn *bufio.ReadWriter, c1 []byte) error {
 	/*
 
 		s1 共占 1536byte
-			前四个字节为时间 可以直接给0
+			前四个字节为时间 后面四个字节为0 剩下的为随机数据
+		s2 为 c1 的拷贝 只是 4~8 字节为读到 c1 的时间
 	*/
 	s1 := make([]byte, HandshakDataLen-4)
-	s2 := c1
+	for i := 4; i < len(s1); i++ {
+		s1[i] = byte(rand.Int() % 256)
+	}
+	s2 := make([]byte, HandshakDataLen)
+	copy(s2, c1)
+	binary.BigEndian.PutUint32(s2[C1S1TimeSize:], handshakeEpoch())
 	buf := &bytes.Buffer{}
 
 	buf.WriteByte(RtmpHandShakVersion)
-	err := binary.Write(buf, binary.BigEndian, uint32(0))
+	err := binary.Write(buf, binary.BigEndian, handshakeEpoch())
 	if err != nil {
 		return err
 	}
@@ -119,30 +152,133 @@ func simpleHandshake(conn *bufio.ReadWriter, c1 []byte) error {
 	return err
 }
 
-func complexHandshake(conn *bufio.ReadWriter, c1 []byte) error {
-	// 校验本次C1是否合法
-	_, digestData, ok, err := validateClient(c1)
+// clientHandshake 客户端发起握手 complex 为 true 时使用复杂握手
+// 服务端不支持复杂握手时(S1校验失败) 按照简单握手处理 C2 直接回复 S1.
+func clientHandshake(conn *bufio.ReadWriter, complex bool) error {
+	c1 := make([]byte, HandshakDataLen)
+	binary.BigEndian.PutUint32(c1, handshakeEpoch())
+	for i := C1S1TimeSize + C1S1VersionSize; i < HandshakDataLen; i++ {
+		c1[i] = byte(rand.Int() % 256)
+	}
+
+	var c1Digest []byte
+	if complex {
+		// version 不为0 表示使用复杂握手 C1 使用 scheme0 并用 FPKey 签名
+		copy(c1[C1S1TimeSize:], RtmpClientVersion)
+		offset := digestOffset(c1, handshakeScheme0)
+		digest, err := calcDigest(c1, offset, FPKey[:30])
+		if err != nil {
+			return err
+		}
+		copy(c1[offset:], digest)
+		c1Digest = digest
+	}
+
+	if err := conn.WriteByte(RtmpHandShakVersion); err != nil {
+		return err
+	}
+	if _, err := conn.Write(c1); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	s0s1s2, err := ReadByteToBuf(conn, 1+2*HandshakDataLen)
 	if err != nil {
 		return err
 	}
 
+	if s0s1s2[0] != RtmpHandShakVersion {
+		return errors.New("The Server Version is not support ")
+	}
+
+	s1 := s0s1s2[1 : 1+HandshakDataLen]
+	s2 := s0s1s2[1+HandshakDataLen:]
+
+	// C2 为 S1 的拷贝
+	c2 := s1
+	if complex {
+		if c2, err = createC2(c1Digest, s1, s2); err != nil {
+			return err
+		}
+	}
+
+	if _, err = conn.Write(c2); err != nil {
+		return err
+	}
+
+	return conn.Flush()
+}
+
+// createC2 校验 S1 S2 并生成 C2 服务端不支持复杂握手时返回 S1.
+func createC2(c1Digest, s1, s2 []byte) ([]byte, error) {
+	scheme, ok := validateDigest(s1, FMSKey[:36])
 	if !ok {
-		return errors.New("ValiDataClient Failed")
+		return s1, nil
 	}
 
-	// 构造s1
-	s1 := createS1()
+	s2Hash, err := HMACSha256(c1Digest, FMSKey[:68])
+	if err != nil {
+		return nil, err
+	}
+	s2Digest, err := HMACSha256(s2[:HandshakDataLen-C1S1DigestDataSize], s2Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(s2Digest, s2[HandshakDataLen-C1S1DigestDataSize:]) {
+		return nil, errors.New("S2 digest invalid")
+	}
+
+	s1Offset := digestOffset(s1, scheme)
+	c2Hash, err := HMACSha256(s1[s1Offset:s1Offset+C1S1DigestDataSize], FPKey[:62])
+	if err != nil {
+		return nil, err
+	}
 
-	s1DigestOffset := getDigestDataOffset(s1)
-	s1DigestPart1 := s1[:s1DigestOffset]
-	s1DigestPart2 := s1[s1DigestOffset+C1S1DigestDataSize:]
+	c2 := createS2()
+	c2Digest, err := HMACSha256(c2, c2Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(c2, c2Digest...), nil
+}
+
+// complexHandshake 退回到简单握手时 统计为 complex fallback 和简单握手的结果.
+func complexHandshake(conn *bufio.ReadWriter, c1 []byte) (err error) {
+	fallback := false
+	defer func() {
+		if !fallback {
+			countHandshake(HandshakeComplex, err)
+		}
+	}()
+
+	// 校验本次C1是否合法 两种格式都尝试
+	scheme, digestData, ok, err := validateClient(c1)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		// 有些客户端 version 不为0 但是并不支持复杂握手 这时退回到简单握手
+		if conf().Handshake.Strict {
+			return errors.New("ValiDataClient Failed")
+		}
+		logger().Debug("complex handshake digest invalid, fallback to simple handshake")
+		fallback = true
+		countHandshakeResult(HandshakeComplex, HandshakeFallback)
+		err = simpleHandshake(conn, c1)
+		countHandshake(HandshakeSimple, err)
+
+		return err
+	}
 
-	s1Buf := &bytes.Buffer{}
-	s1Buf.Write(s1DigestPart1)
-	s1Buf.Write(s1DigestPart2)
-	s1Part1Part2 := s1Buf.Bytes()
+	// 构造s1 使用和客户端相同的格式
+	s1 := createS1()
 
-	s1Hash, err := HMACSha256(s1Part1Part2, FMSKey[:36])
+	s1DigestOffset := digestOffset(s1, scheme)
+	s1Hash, err := calcDigest(s1, s1DigestOffset, FMSKey[:36])
 	if err != nil {
 		return err
 	}
@@ -174,21 +310,46 @@ func complexHandshake(conn *bufio.ReadWriter, c1 []byte) error {
 		return err
 	}
 	conn.Flush()
-	// 跳过C2
-	_, err = ReadByteToBuf(conn, HandshakDataLen)
-	fmt.Println("complexHandshake Finish")
 
-	return err
+	c2, err := ReadByteToBuf(conn, HandshakDataLen)
+	if err != nil {
+		return err
+	}
+
+	// C2 的最后32byte 是使用 S1 的 digest 计算出来的
+	if conf().Handshake.VerifyC2 {
+		if err = validateC2(c2, s1Hash); err != nil {
+			return err
+		}
+	}
+	logger().Debug("complex handshake finished")
+
+	return nil
+}
+
+func validateC2(c2 []byte, s1Digest []byte) error {
+	c2Hash, err := HMACSha256(s1Digest, FPKey[:62])
+	if err != nil {
+		return err
+	}
+
+	c2Digest, err := HMACSha256(c2[:HandshakDataLen-C1S1DigestDataSize], c2Hash)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(c2Digest, c2[HandshakDataLen-C1S1DigestDataSize:]) {
+		return errors.New("C2 digest invalid")
+	}
+
+	return nil
 }
 
 func createS1() []byte {
-	//
-	//s1Time := make([]byte , 4)
-	//binary.BigEndian.PutUint64(s1Time , uint64(time.Now().Unix()))
-	//s1Version := make([]byte , 4)
-	//binary.BigEndian.PutUint64(s1Version , StmpHandShakVersion)
-	s1Time := []byte{0, 0, 0, 0}
-	s1Version := []byte{1, 1, 1, 1}
+	// time 为服务端启动以来的毫秒数 version 为服务端的版本号
+	s1Time := make([]byte, C1S1TimeSize)
+	binary.BigEndian.PutUint32(s1Time, handshakeEpoch())
+	s1Version := RtmpServerVersion
 	digestLen := HandshakDataLen - C1S1TimeSize - C1S1VersionSize
 	s1KeyDigest := make([]byte, digestLen)
 
@@ -219,35 +380,17 @@ func createS2() []byte {
 	return buf.Bytes()
 }
 
-// 分别返回 keyData , digestData , 是否校验digestData成功，错误.
-func validateClient(c1 []byte) ([]byte, []byte, bool, error) {
-	digestDataOffset := getDigestDataOffset(c1)
-	keyDataOffset := getKeyOffset(c1)
-
-	// 校验digest
-	digestData := c1[digestDataOffset : digestDataOffset+C1S1DigestDataSize]
-	digestPart1 := c1[:digestDataOffset]
-	digestPart2 := c1[digestDataOffset+C1S1DigestDataSize:]
-
-	buf := &bytes.Buffer{}
-	buf.Write(digestPart1)
-	buf.Write(digestPart2)
-
-	c1Part1Part2 := buf.Bytes()
-
-	tmpHash, err := HMACSha256(c1Part1Part2, FPKey[:30])
-	ok := false
-	if err != nil {
-		return nil, nil, ok, err
-	}
-
-	if bytes.Equal(digestData, tmpHash) {
-		ok = true
+// 分别返回 C1的格式 , digestData , 是否校验digestData成功，错误.
+func validateClient(c1 []byte) (int, []byte, bool, error) {
+	scheme, ok := validateDigest(c1, FPKey[:30])
+	if !ok {
+		return 0, nil, false, nil
 	}
 
-	keyData := c1[keyDataOffset : keyDataOffset+C1S1KeyDataSize]
+	digestDataOffset := digestOffset(c1, scheme)
+	digestData := c1[digestDataOffset : digestDataOffset+C1S1DigestDataSize]
 
-	return keyData, digestData, ok, nil
+	return scheme, digestData, true, nil
 }
 
 // HMACSha256 利用HASH算法 以一个秘钥和一个massage 为输入，生成一个摘要 返回
@@ -285,7 +428,7 @@ func getDigestDataOffset(c1 []byte) int {
 func ReadByteToBuf(conn io.Reader, size int) ([]byte, error) {
 	buf := make([]byte, size)
 
-	_, err := conn.Read(buf)
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return buf, err
 	}
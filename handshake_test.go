@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestComplexHandshake(t *testing.T) {
+	defer setConfig(conf())
+
+	tests := []struct {
+		name    string
+		scheme  int
+		invalid bool
+		strict  bool
+		fail    bool
+	}{
+		{name: "scheme0", scheme: handshakeScheme0},
+		{name: "scheme1", scheme: handshakeScheme1},
+		{name: "fallback", invalid: true},
+		{name: "strict", invalid: true, strict: true, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *conf()
+			c.Handshake = HandshakeConfig{Strict: tt.strict, VerifyC2: true}
+			setConfig(&c)
+
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := handshake(bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)))
+				result <- err
+				server.Close()
+			}()
+
+			c1 := make([]byte, HandshakDataLen)
+			_, _ = rand.Read(c1)
+			c1[4] = 9
+			offset := digestOffset(c1, tt.scheme)
+			if !tt.invalid {
+				digest, _ := calcDigest(c1, offset, FPKey[:30])
+				copy(c1[offset:], digest)
+			}
+			c1Digest := c1[offset : offset+C1S1DigestDataSize]
+
+			if _, err := client.Write(append([]byte{RtmpHandShakVersion}, c1...)); err != nil {
+				t.Fatal(err)
+			}
+
+			s0s1s2 := make([]byte, 1+2*HandshakDataLen)
+			if _, err := io.ReadFull(client, s0s1s2); err != nil {
+				if tt.fail {
+					if err = <-result; err == nil {
+						t.Fatal("strict handshake should fail")
+					}
+
+					return
+				}
+				t.Fatal(err)
+			}
+
+			s1 := s0s1s2[1 : 1+HandshakDataLen]
+			s2 := s0s1s2[1+HandshakDataLen:]
+			c2 := make([]byte, HandshakDataLen)
+
+			if tt.invalid {
+				// 简单握手 S2 为 C1 的拷贝
+				if !bytes.Equal(s2[8:], c1[8:]) {
+					t.Fatal("S2 is not echo of C1")
+				}
+				copy(c2, s1)
+			} else {
+				scheme, ok := validateDigest(s1, FMSKey[:36])
+				if !ok || scheme != tt.scheme {
+					t.Fatalf("S1 digest invalid, scheme %d", scheme)
+				}
+
+				s2Hash, _ := HMACSha256(c1Digest, FMSKey[:68])
+				s2Digest, _ := HMACSha256(s2[:HandshakDataLen-C1S1DigestDataSize], s2Hash)
+				if !bytes.Equal(s2Digest, s2[HandshakDataLen-C1S1DigestDataSize:]) {
+					t.Fatal("S2 digest invalid")
+				}
+
+				s1Offset := digestOffset(s1, scheme)
+				c2Hash, _ := HMACSha256(s1[s1Offset:s1Offset+C1S1DigestDataSize], FPKey[:62])
+				_, _ = rand.Read(c2)
+				c2Digest, _ := HMACSha256(c2[:HandshakDataLen-C1S1DigestDataSize], c2Hash)
+				copy(c2[HandshakDataLen-C1S1DigestDataSize:], c2Digest)
+			}
+
+			if _, err := client.Write(c2); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-result; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HookOnConnect     = "on_connect"
+	HookOnPublish     = "on_publish"
+	HookOnPublishDone = "on_publish_done"
+	HookOnPlay        = "on_play"
+	HookOnPlayDone    = "on_play_done"
+	HookOnRecordDone  = "on_record_done"
+)
+
+// HookEvent 回调时 POST 的 JSON.
+type HookEvent struct {
+	Action   string            `json:"action"`
+	Vhost    string            `json:"vhost,omitempty"`
+	App      string            `json:"app"`
+	Stream   string            `json:"stream,omitempty"`
+	ClientIP string            `json:"client_ip,omitempty"`
+	TcURL    string            `json:"tc_url,omitempty"`
+	Args     map[string]string `json:"args,omitempty"`
+	BytesIn  uint64            `json:"bytes_in"`
+	BytesOut uint64            `json:"bytes_out"`
+	// on_record_done 录制的文件
+	Path string `json:"path,omitempty"`
+}
+
+// HookRedirect on_publish 返回 3xx 时 使用 Location 作为新的流名.
+type HookRedirect struct {
+	Stream string
+}
+
+func (r *HookRedirect) Error() string {
+	return "redirect to " + r.Stream
+}
+
+var hookClient = &http.Client{
+	// 3xx 由调用者处理 不跟随跳转
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func newHookEvent(action string, req *AuthRequest) *HookEvent {
+	e := &HookEvent{
+		Action:   action,
+		Vhost:    req.Vhost,
+		App:      req.App,
+		Stream:   req.Stream,
+		ClientIP: clientIP(req.RemoteAddr),
+		Args:     make(map[string]string),
+	}
+	if req.TcURL != nil {
+		e.TcURL = fmt.Sprintf("%s://%s:%d/%s", req.TcURL.Scheme, req.TcURL.Host, req.TcURL.Port, req.TcURL.FullApp())
+	}
+	for k := range req.Query {
+		e.Args[k] = req.Query.Get(k)
+	}
+
+	return e
+}
+
+// postHook 发送一次回调 返回状态码和 Location.
+func postHook(hookURL string, e *HookEvent, timeout time.Duration) (int, string, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := *hookClient
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode, resp.Header.Get("Location"), nil
+}
+
+// webhookAuthenticator on_connect on_publish on_play 是阻塞的回调 返回非 2xx 时拒绝.
+type webhookAuthenticator struct{}
+
+func (webhookAuthenticator) Authenticate(req *AuthRequest) error {
+	cfg := conf().Hooks
+
+	var action, hookURL string
+	switch req.Action {
+	case AuthActionConnect:
+		action, hookURL = HookOnConnect, cfg.OnConnect
+	case AuthActionPublish:
+		action, hookURL = HookOnPublish, cfg.OnPublish
+	case AuthActionPlay:
+		action, hookURL = HookOnPlay, cfg.OnPlay
+	}
+	if hookURL == "" {
+		return nil
+	}
+
+	code, location, err := postHook(hookURL, newHookEvent(action, req), cfg.Timeout)
+	if err != nil {
+		logger().Warn("hook failed", "action", action, "err", err)
+
+		return errors.Errorf("%s failed", action)
+	}
+
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 300 && code < 400 && action == HookOnPublish && location != "":
+		// Location 可以是流名 路径或者一个地址 都使用路径的最后一段
+		if u, err := url.Parse(location); err == nil {
+			location = u.Path[strings.LastIndexByte(u.Path, '/')+1:]
+			if u.RawQuery != "" {
+				location += "?" + u.RawQuery
+			}
+		}
+		name, _ := splitStreamName(location)
+		if name == "" {
+			return errors.Errorf("%s redirect to empty stream", action)
+		}
+
+		return &HookRedirect{Stream: name}
+	}
+
+	return errors.Errorf("%s rejected with status %d", action, code)
+}
+
+// notifyHook 非阻塞的回调 失败后按照配置重试 不影响流程.
+func notifyHook(action string, e *HookEvent) {
+	cfg := conf().Hooks
+
+	var hookURL string
+	switch action {
+	case HookOnPublishDone:
+		hookURL = cfg.OnPublishDone
+	case HookOnPlayDone:
+		hookURL = cfg.OnPlayDone
+	case HookOnRecordDone:
+		hookURL = cfg.OnRecordDone
+	}
+	if hookURL == "" {
+		return
+	}
+
+	e.Action = action
+	go func() {
+		for i := 0; ; i++ {
+			code, _, err := postHook(hookURL, e, cfg.Timeout)
+			if err == nil && code >= 200 && code < 300 {
+				return
+			}
+			if err == nil {
+				err = errors.Errorf("status %d", code)
+			}
+
+			if i >= cfg.Retries {
+				logger().Warn("hook failed", "action", action, "url", hookURL, "err", err)
+
+				return
+			}
+			time.Sleep(cfg.RetryInterval)
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	defer setConfig(conf())
+
+	var lock sync.Mutex
+	var events []HookEvent
+	failures := 2
+	done := make(chan struct{}, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e HookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+
+		lock.Lock()
+		events = append(events, e)
+		lock.Unlock()
+
+		switch {
+		case e.Action == HookOnPublish && e.Stream == "redirect":
+			w.Header().Set("Location", "renamed?x=1")
+			w.WriteHeader(http.StatusFound)
+		case e.Action == HookOnPublish && e.Args["token"] != "ok":
+			w.WriteHeader(http.StatusForbidden)
+		case e.Action == HookOnPublishDone:
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusInternalServerError)
+
+				return
+			}
+			done <- struct{}{}
+		}
+	}))
+	defer srv.Close()
+
+	c := *conf()
+	c.Hooks = HooksConfig{
+		Timeout:       time.Second,
+		Retries:       2,
+		RetryInterval: 10 * time.Millisecond,
+		OnPublish:     srv.URL + "/publish",
+		OnPublishDone: srv.URL + "/publish_done",
+	}
+	setConfig(&c)
+
+	req := func(stream, token string) *AuthRequest {
+		return &AuthRequest{
+			Action:     AuthActionPublish,
+			App:        "live",
+			Stream:     stream,
+			RemoteAddr: "10.0.0.1:5000",
+			Query:      url.Values{"token": {token}},
+		}
+	}
+
+	var a webhookAuthenticator
+	if err := a.Authenticate(req("s", "ok")); err != nil {
+		t.Errorf("2xx should allow, err is %v", err)
+	}
+	if err := a.Authenticate(req("s", "bad")); err == nil {
+		t.Error("4xx should reject")
+	}
+	err := a.Authenticate(req("redirect", "ok"))
+	if r, ok := err.(*HookRedirect); !ok || r.Stream != "renamed" {
+		t.Errorf("3xx should redirect, err is %v", err)
+	}
+	// 没有配置的回调直接通过
+	if err = a.Authenticate(&AuthRequest{Action: AuthActionPlay, Query: url.Values{}}); err != nil {
+		t.Error(err)
+	}
+
+	notifyHook(HookOnPublishDone, newHookEvent(HookOnPublishDone, req("s", "ok")))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("on_publish_done was not retried")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if e := events[0]; e.App != "live" || e.Stream != "s" || e.ClientIP != "10.0.0.1" || e.Args["token"] != "ok" {
+		t.Errorf("event is %+v", e)
+	}
+	if len(events) != 6 {
+		t.Errorf("got %d events, want 6", len(events))
+	}
+}
+
+func TestWebhookRedirectLocation(t *testing.T) {
+	defer setConfig(conf())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e HookEvent
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		w.Header().Set("Location", e.Args["location"])
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer srv.Close()
+
+	c := *conf()
+	c.Hooks = HooksConfig{Timeout: time.Second, OnPublish: srv.URL + "/publish"}
+	setConfig(&c)
+
+	// 流名 相对路径 绝对路径和地址都使用最后一段
+	tests := []struct {
+		location string
+		stream   string
+	}{
+		{"new", "new"},
+		{"new?x=1", "new"},
+		{"live/new", "new"},
+		{"/live/new", "new"},
+		{"rtmp://origin/live/new?x=1", "new"},
+		{"/live/", ""},
+	}
+
+	var a webhookAuthenticator
+	for _, tt := range tests {
+		err := a.Authenticate(&AuthRequest{
+			Action: AuthActionPublish,
+			App:    "live",
+			Stream: "s",
+			Query:  url.Values{"location": {tt.location}},
+		})
+		if tt.stream == "" {
+			if _, ok := err.(*HookRedirect); ok || err == nil {
+				t.Errorf("%s: got %v, want error", tt.location, err)
+			}
+
+			continue
+		}
+		if r, ok := err.(*HookRedirect); !ok || r.Stream != tt.stream {
+			t.Errorf("%s: got %v, want %s", tt.location, err, tt.stream)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// 超过限制的原因 用于统计.
+const (
+	LimitMessageSize      = "message_size"
+	LimitPartialMessages  = "partial_messages"
+	LimitChunkSize        = "chunk_size"
+	LimitBufferedBytes    = "buffered_bytes"
+	LimitConnections      = "connections"
+	LimitConnectionsPerIP = "connections_per_ip"
+	LimitHandshakeTimeout = "handshake_timeout"
+	LimitConnectTimeout   = "connect_timeout"
+	LimitRate             = "rate"
+	LimitGlobalRate       = "global_rate"
+	LimitHandshakes       = "handshakes"
+	LimitC0C1Timeout      = "c0c1_timeout"
+	LimitC2Timeout        = "c2_timeout"
+)
+
+var limitViolations = map[string]*uint64{
+	LimitMessageSize:      new(uint64),
+	LimitPartialMessages:  new(uint64),
+	LimitChunkSize:        new(uint64),
+	LimitBufferedBytes:    new(uint64),
+	LimitConnections:      new(uint64),
+	LimitConnectionsPerIP: new(uint64),
+	LimitHandshakeTimeout: new(uint64),
+	LimitConnectTimeout:   new(uint64),
+	LimitRate:             new(uint64),
+	LimitGlobalRate:       new(uint64),
+	LimitHandshakes:       new(uint64),
+	LimitC0C1Timeout:      new(uint64),
+	LimitC2Timeout:        new(uint64),
+}
+
+// globalLimits 所有客户端共享的限制 超过时不一定是这个IP的问题 不计入自动封禁.
+var globalLimits = map[string]bool{
+	LimitConnections: true,
+	LimitGlobalRate:  true,
+	LimitHandshakes:  true,
+}
+
+// limitError 记录一次超过限制 返回的错误会关闭连接 同一个IP多次超过限制时自动封禁.
+func limitError(nc *NetConnection, reason, format string, args ...interface{}) error {
+	atomic.AddUint64(limitViolations[reason], 1)
+	autoBan.record(nc.ClientIP(), reason)
+	err := errors.Errorf("%s limit: %s", reason, fmt.Sprintf(format, args...))
+	nc.log.Warn("limit exceeded, closing connection", "reason", reason, "err", err)
+
+	return err
+}
+
+// LimitViolations 启动以来每种限制被触发的次数.
+func LimitViolations() map[string]uint64 {
+	m := make(map[string]uint64, len(limitViolations))
+	for reason, n := range limitViolations {
+		m[reason] = atomic.LoadUint64(n)
+	}
+
+	return m
+}
+
+// connCounter 统计客户端连接数 总数和每个IP的连接数.
+type connCounter struct {
+	lock  sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var connections = &connCounter{perIP: make(map[string]int)}
+
+// acquire 没有超过限制时计数 超过时返回原因 成功后需要调用 release.
+func (c *connCounter) acquire(ip net.IP, cfg LimitsConfig) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cfg.MaxConnections > 0 && c.total >= cfg.MaxConnections {
+		return LimitConnections
+	}
+	key := ip.String()
+	if cfg.MaxConnectionsPerIP > 0 && ip != nil && c.perIP[key] >= cfg.MaxConnectionsPerIP {
+		return LimitConnectionsPerIP
+	}
+
+	c.total++
+	c.perIP[key]++
+
+	return ""
+}
+
+func (c *connCounter) release(ip net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := ip.String()
+	c.total--
+	if c.perIP[key]--; c.perIP[key] <= 0 {
+		delete(c.perIP, key)
+	}
+}
+
+// Count 当前的客户端连接数.
+func (c *connCounter) Count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.total
+}
+
+// isTimeout 读写超过 SetDeadline 设置的时间.
+func isTimeout(err error) bool {
+	e, ok := errors.Cause(err).(net.Error)
+
+	return ok && e.Timeout()
+}
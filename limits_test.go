@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"rtmp/mem_pool"
+)
+
+// chunkType0 生成 fmt=0 的chunk 头 body 不超过 128 字节.
+func testChunk(csid byte, typeID byte, msgLen int, body []byte) []byte {
+	b := []byte{csid, 0, 0, 0, byte(msgLen >> 16), byte(msgLen >> 8), byte(msgLen), typeID, 0, 0, 0, 0}
+
+	return append(b, body...)
+}
+
+func TestReadChunkLimits(t *testing.T) {
+	initPoolOnce.Do(mem_pool.InitPool)
+	limits := LimitsConfig{MaxMessageSize: 1024, MaxPartialMessages: 2, MaxChunkSize: 4096, MaxBufferedBytes: 1 << 20}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{"message too large", testChunk(3, RtmpMsgVideo, 2048, make([]byte, 128)), LimitMessageSize},
+		{"too many partial messages", append(append(
+			testChunk(3, RtmpMsgVideo, 512, make([]byte, 128)),
+			testChunk(4, RtmpMsgVideo, 512, make([]byte, 128))...),
+			testChunk(5, RtmpMsgVideo, 512, make([]byte, 128))...), LimitPartialMessages},
+		{"chunk size too large", testChunk(2, RtmpMsgChunkSize, 4, []byte{0, 1, 0, 0}), LimitChunkSize},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		nc := newNetConnection(server)
+		nc.limits = limits
+
+		go func() {
+			_, _ = client.Write(tt.data)
+		}()
+
+		before := LimitViolations()[tt.reason]
+		_, err := nc.getMsg()
+		if err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: err is %v", tt.name, err)
+		}
+		if LimitViolations()[tt.reason] != before+1 {
+			t.Errorf("%s: violation not counted", tt.name)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// 没有超过限制的消息可以正常读取 分成多个chunk
+	client, server := net.Pipe()
+	defer client.Close()
+	nc := newNetConnection(server)
+	nc.limits = limits
+	go func() {
+		data := testChunk(3, RtmpMsgVideo, 200, make([]byte, 128))
+		data = append(data, 0xc3)
+		_, _ = client.Write(append(data, make([]byte, 72)...))
+	}()
+	msg, err := nc.getMsg()
+	if err != nil || len(msg.Body) != 200 || nc.bufferedBytes != 0 {
+		t.Errorf("err is %v, buffered %d", err, nc.bufferedBytes)
+	}
+}
+
+func TestConnCounter(t *testing.T) {
+	c := &connCounter{perIP: make(map[string]int)}
+	cfg := LimitsConfig{MaxConnections: 3, MaxConnectionsPerIP: 2}
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	for _, ip := range []net.IP{a, a, b} {
+		if reason := c.acquire(ip, cfg); reason != "" {
+			t.Fatalf("acquire %s: %s", ip, reason)
+		}
+	}
+	if reason := c.acquire(b, cfg); reason != LimitConnections {
+		t.Errorf("total limit: %q", reason)
+	}
+
+	c.release(b)
+	if reason := c.acquire(a, cfg); reason != LimitConnectionsPerIP {
+		t.Errorf("per ip limit: %q", reason)
+	}
+	if reason := c.acquire(b, cfg); reason != "" || c.Count() != 3 {
+		t.Errorf("after release: %q %d", reason, c.Count())
+	}
+}
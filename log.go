@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LogLevel 日志级别 低于当前级别的日志不输出.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l >= LogDebug && int(l) < len(logLevelNames) {
+		return logLevelNames[l]
+	}
+
+	return strconv.Itoa(int(l))
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+
+	return LogInfo, errors.Errorf("unknown log level %q", s)
+}
+
+// Logger 带有级别和字段的日志 字段为 名字 值 名字 值...
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+	// With 返回带有这些字段的Logger 例如每个连接的 conn remote app
+	With(kv ...interface{}) Logger
+	// Enabled 调用频繁的日志先判断 避免构造字段
+	Enabled(level LogLevel) bool
+}
+
+// 采样时同一条消息按照 级别和消息 hash 到这些计数中的一个
+const logSampleBuckets = 4096
+
+type logSampleCounter struct {
+	resetAt int64
+	n       uint64
+}
+
+// logOutput 所有Logger共用的输出 级别 格式和输出在运行时可以修改.
+type logOutput struct {
+	level int32
+	json  int32
+
+	lock   sync.Mutex
+	w      io.Writer
+	closer io.Closer
+
+	sample  atomic.Value // LogSampleConfig
+	counter [logSampleBuckets]logSampleCounter
+	now     func() time.Time
+}
+
+func newLogOutput(w io.Writer) *logOutput {
+	o := &logOutput{level: int32(LogInfo), w: w, now: time.Now}
+	o.sample.Store(LogSampleConfig{})
+
+	return o
+}
+
+var (
+	logOut  = newLogOutput(os.Stdout)
+	rootLog = &fieldLogger{out: logOut}
+)
+
+// logger 全局的Logger 没有连接信息的日志使用.
+func logger() Logger {
+	return rootLog
+}
+
+func (o *logOutput) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&o.level))
+}
+
+// SetLevel 运行时修改日志级别 重新加载配置后恢复为配置中的级别.
+func (o *logOutput) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&o.level, int32(level))
+}
+
+// apply 按照配置修改输出 输出的文件改变时重新打开.
+func (o *logOutput) apply(c LogConfig) error {
+	level, err := ParseLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer
+	var closer io.Closer
+	switch c.Output {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(c.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "open log output")
+		}
+		w, closer = f, f
+	}
+
+	o.lock.Lock()
+	old := o.closer
+	o.w, o.closer = w, closer
+	o.lock.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+
+	var useJSON int32
+	if c.Format == "json" {
+		useJSON = 1
+	}
+	atomic.StoreInt32(&o.json, useJSON)
+	o.sample.Store(c.Sample)
+	o.SetLevel(level)
+
+	return nil
+}
+
+// sampled 每个 interval 内同一条消息前 initial 条都输出 之后每 thereafter 条输出一条.
+func (o *logOutput) sampled(level LogLevel, msg string) bool {
+	cfg := o.sample.Load().(LogSampleConfig)
+	if cfg.Initial <= 0 {
+		return true
+	}
+
+	// FNV-1a 不需要分配内存
+	h := (uint32(2166136261) ^ uint32(level)) * 16777619
+	for i := 0; i < len(msg); i++ {
+		h = (h ^ uint32(msg[i])) * 16777619
+	}
+	c := &o.counter[h%logSampleBuckets]
+
+	now := o.now().UnixNano()
+	if resetAt := atomic.LoadInt64(&c.resetAt); now > resetAt {
+		if atomic.CompareAndSwapInt64(&c.resetAt, resetAt, now+int64(cfg.Interval)) {
+			atomic.StoreUint64(&c.n, 0)
+		}
+	}
+
+	n := atomic.AddUint64(&c.n, 1)
+	if n <= uint64(cfg.Initial) {
+		return true
+	}
+
+	return cfg.Thereafter > 0 && (n-uint64(cfg.Initial))%uint64(cfg.Thereafter) == 0
+}
+
+func (o *logOutput) write(level LogLevel, msg string, fields, kv []interface{}) {
+	if level < o.Level() || !o.sampled(level, msg) {
+		return
+	}
+
+	var buf bytes.Buffer
+	t := o.now()
+	if atomic.LoadInt32(&o.json) == 1 {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, t.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for _, fs := range [][]interface{}{fields, kv} {
+			for i := 0; i < len(fs); i += 2 {
+				buf.WriteByte(',')
+				writeJSONValue(&buf, fmt.Sprint(fs[i]))
+				buf.WriteByte(':')
+				writeJSONValue(&buf, logValue(fs, i+1))
+			}
+		}
+		buf.WriteString("}\n")
+	} else {
+		buf.WriteString(t.Format("2006-01-02T15:04:05.000Z07:00"))
+		buf.WriteByte(' ')
+		buf.WriteString(strings.ToUpper(level.String()))
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+		for _, fs := range [][]interface{}{fields, kv} {
+			for i := 0; i < len(fs); i += 2 {
+				buf.WriteByte(' ')
+				buf.WriteString(fmt.Sprint(fs[i]))
+				buf.WriteByte('=')
+				buf.WriteString(textValue(logValue(fs, i+1)))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+
+	o.lock.Lock()
+	_, _ = o.w.Write(buf.Bytes())
+	o.lock.Unlock()
+}
+
+// logValue 字段的值 错误和 Duration 等使用字符串 缺少值时使用 !MISSING.
+func logValue(kv []interface{}, i int) interface{} {
+	if i >= len(kv) {
+		return "!MISSING"
+	}
+
+	switch v := kv[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// textValue 包含空格 引号 等号的字符串加上引号.
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if _, ok := v.(string); ok && (s == "" || strings.ContainsAny(s, " \t\n\"=")) {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+type fieldLogger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+func (l *fieldLogger) Debug(msg string, kv ...interface{}) {
+	l.out.write(LogDebug, msg, l.fields, kv)
+}
+
+func (l *fieldLogger) Info(msg string, kv ...interface{}) {
+	l.out.write(LogInfo, msg, l.fields, kv)
+}
+
+func (l *fieldLogger) Warn(msg string, kv ...interface{}) {
+	l.out.write(LogWarn, msg, l.fields, kv)
+}
+
+func (l *fieldLogger) Error(msg string, kv ...interface{}) {
+	l.out.write(LogError, msg, l.fields, kv)
+}
+
+func (l *fieldLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+
+	return &fieldLogger{out: l.out, fields: append(fields, kv...)}
+}
+
+func (l *fieldLogger) Enabled(level LogLevel) bool {
+	return level >= l.out.Level()
+}
+
+// reloadLog 重新加载配置后 日志的级别 格式和输出立即生效.
+func reloadLog() {
+	if err := logOut.apply(conf().Log); err != nil {
+		logger().Error("apply log config failed", "err", err)
+	}
+}
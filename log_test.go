@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(c LogConfig) (*fieldLogger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	o := newLogOutput(&buf)
+	o.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	if err := o.apply(c); err != nil {
+		panic(err)
+	}
+	o.w = &buf
+
+	return &fieldLogger{out: o}, &buf
+}
+
+func TestLoggerText(t *testing.T) {
+	l, buf := newTestLogger(LogConfig{Level: "info"})
+	nc := l.With("conn", 1, "remote", "127.0.0.1:1935")
+	nc.Debug("hidden")
+	nc.With("app", "live").Warn("handle command failed", "err", errors.New("bad name"), "retry", time.Second, "n")
+
+	want := `2026-01-02T03:04:05.000Z WARN handle command failed conn=1 remote=127.0.0.1:1935 app=live err="bad name" retry=1s n=!MISSING` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %q\nwant %q", buf.String(), want)
+	}
+
+	l.out.SetLevel(LogDebug)
+	if !nc.Enabled(LogDebug) {
+		t.Error("debug not enabled after SetLevel")
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	l, buf := newTestLogger(LogConfig{Level: "debug", Format: "json"})
+	l.With("conn", 2).Debug("message received", "type", "video", "length", 100)
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if v["level"] != "debug" || v["msg"] != "message received" || v["conn"] != float64(2) || v["length"] != float64(100) {
+		t.Errorf("got %v", v)
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":"2026-01-02T03:04:05Z","level":"debug"`) {
+		t.Errorf("field order: %s", buf.String())
+	}
+}
+
+func TestLoggerSample(t *testing.T) {
+	l, buf := newTestLogger(LogConfig{
+		Level:  "debug",
+		Sample: LogSampleConfig{Initial: 2, Thereafter: 3, Interval: time.Second},
+	})
+
+	for i := 0; i < 10; i++ {
+		l.Debug("message received")
+		l.Info("connection closed")
+	}
+	// 前2条 之后第5条 第8条
+	if n := strings.Count(buf.String(), "message received"); n != 4 {
+		t.Errorf("sampled %d messages\n%s", n, buf.String())
+	}
+
+	now := time.Now().Add(2 * time.Second)
+	l.out.now = func() time.Time { return now }
+	buf.Reset()
+	l.Debug("message received")
+	if buf.Len() == 0 {
+		t.Error("sample not reset after interval")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if l, err := ParseLogLevel("WARN"); err != nil || l != LogWarn {
+		t.Errorf("got %v %v", l, err)
+	}
+	if _, err := ParseLogLevel("trace"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
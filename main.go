@@ -1,46 +1,201 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"rtmp/mem_pool"
+	"time"
 )
 
 func main() {
 	mem_pool.InitPool()
 
-	l, err := net.Listen("tcp", "127.0.0.1:1935")
+	// 子命令 作为客户端使用
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "push":
+			run = runPush
+		case "dump":
+			run = runDump
+		case "probe":
+			run = runProbe
+		case "sign":
+			run = runSign
+		}
+
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Println(os.Args[1], " err is ", err.Error())
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
+	configPath := flag.String("c", "", "config file path")
+	flag.Parse()
+
+	c, err := LoadConfig(*configPath)
 	if err != nil {
-		fmt.Println("listen err is ", err.Error())
+		logger().Error("load config failed", "err", err)
 
 		return
 	}
-	fmt.Println("Net is Listen Addr is ", l.Addr().String())
+	setConfig(c)
+	if err = logOut.apply(conf().Log); err != nil {
+		logger().Error("apply log config failed", "err", err)
+
+		return
+	}
+	onReload(reloadLog)
+
+	if err = banList.Load(conf().Ban.File); err != nil {
+		logger().Error("load ban list failed", "err", err)
+
+		return
+	}
+	onReload(reloadBanList)
+
+	AddAuthenticator(&configAuthenticator{now: time.Now})
+	AddAuthenticator(webhookAuthenticator{})
+	startHTTPServer()
+	startRelay()
+	startRecord()
+	startEdge()
+	startPulls()
+	go watchReload(*configPath)
+
+	if conf().Rtmps.Enable {
+		if err = listenRtmps(conf().Rtmps); err != nil {
+			logger().Error("rtmps listen failed", "err", err)
+
+			return
+		}
+	}
+
+	if conf().Rtmpt.Enable {
+		if err = listenRtmpt(conf().Rtmpt); err != nil {
+			logger().Error("rtmpt listen failed", "err", err)
+
+			return
+		}
+	}
+
+	// 所有地址都监听成功后再开始接收连接
+	listeners := make([]net.Listener, 0, len(conf().Rtmp.Listen))
+	for _, addr := range conf().Rtmp.Listen {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			logger().Error("rtmp listen failed", "addr", addr, "err", err)
+
+			return
+		}
+		logger().Info("rtmp listening", "addr", l.Addr().String())
+		listeners = append(listeners, newProxyListener(l, func() ProxyProtocolConfig { return conf().Rtmp.ProxyProtocol }))
+	}
+
+	for _, l := range listeners[1:] {
+		go serve(l)
+	}
+	serve(listeners[0])
+}
+
+// serve 接收连接 每个连接在单独的goroutine中处理.
+func serve(l net.Listener) {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println("Accept Err is ", err.Error())
+			logger().Warn("accept failed", "err", err)
 
 			continue
 		}
-		if err = conn.(*net.TCPConn).SetNoDelay(false); err != nil {
-			fmt.Println("Set No Delay Fail")
+		if tcp, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+			if err = tcp.SetNoDelay(false); err != nil {
+				logger().Warn("set no delay failed", "err", err)
 
-			continue
+				continue
+			}
 		}
-		fmt.Println("Success")
 		// nc := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-		nc := &NetConnection{
-			conn:           conn,
-			rw:             bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
-			writeChunkSize: RtmpDefaultChunkSize,
-			readChunkSize:  RtmpDefaultChunkSize,
-			rtmpHeader:     make(map[uint32]*ChunkHeader),
-			rtmpBody:       make(map[uint32][]byte),
-			bandwith:       RtmpMaxChunkSize << 3,
-		}
+		// 不在这里获取地址 PROXY 头要在连接的协程中读取
+		nc := newNetConnection(conn)
 
 		go nc.HandlerMessage()
 	}
 }
+
+// startHTTPServer 启动 HTTP 服务 DASH 转推状态等功能都挂在这个服务上.
+func startHTTPServer() {
+	mux := http.NewServeMux()
+	handlers := 0
+
+	if conf().Dash.Enable {
+		dashManager := newDashManager(conf().Dash)
+		streamManager.OnPublish(dashManager.onPublish)
+		streamManager.OnUnpublish(dashManager.onUnpublish)
+		mux.Handle(conf().Dash.Path, dashManager)
+		handlers++
+	}
+
+	if conf().Admin.Path != "" {
+		mux.Handle(conf().Admin.Path, newAdminServer(conf().Admin.Path))
+		handlers++
+	}
+
+	if conf().Metrics.Path != "" {
+		mux.Handle(conf().Metrics.Path, metricsHandler{})
+		handlers++
+	}
+
+	if conf().Stat.Path != "" {
+		mux.Handle(conf().Stat.Path, statHandler{})
+		handlers++
+	}
+
+	if conf().Stat.ControlPath != "" {
+		mux.Handle(conf().Stat.ControlPath, newControlHandler(conf().Stat.ControlPath))
+		handlers++
+	}
+
+	if handlers == 0 || conf().HTTP.Listen == "" {
+		return
+	}
+
+	go func() {
+		logger().Info("http listening", "addr", conf().HTTP.Listen)
+		if err := http.ListenAndServe(conf().HTTP.Listen, mux); err != nil {
+			logger().Error("http listen failed", "err", err)
+		}
+	}()
+}
+
+// startRelay 流发布后按照配置转推 没有配置转推时也注册 重新加载配置后可以增加转推.
+func startRelay() {
+	streamManager.OnPublish(relayManager.onPublish)
+	streamManager.OnUnpublish(relayManager.onUnpublish)
+	onReload(relayManager.reload)
+}
+
+// startRecord 配置了录制目录的app 发布的流会录制为FLV.
+func startRecord() {
+	streamManager.OnPublish(recordManager.onPublish)
+	streamManager.OnUnpublish(recordManager.onUnpublish)
+	onReload(recordManager.reload)
+}
+
+// startEdge 配置了回源规则时 播放本地没有的流会从源站拉取.
+func startEdge() {
+	streamManager.OnSubscribe(edgeManager.onSubscribe)
+	streamManager.OnUnsubscribe(edgeManager.onUnsubscribe)
+}
+
+// startPulls 配置中的流一直拉取 断开后会重试.
+func startPulls() {
+	pullManager.reload()
+	onReload(pullManager.reload)
+}
@@ -1,9 +1,27 @@
 package mem_pool
 
-import "github.com/funny/slab"
+import (
+	"sync/atomic"
+
+	"github.com/funny/slab"
+)
 
 var bitPool *slab.ChanPool
 
+// 内存池的使用统计 按照 cap 计算
+var (
+	allocs     uint64
+	frees      uint64
+	allocBytes uint64
+)
+
+// Stats 内存池的使用情况.
+type Stats struct {
+	Allocs     uint64
+	Frees      uint64
+	AllocBytes uint64
+}
+
 func InitPool() {
 	// 最小的Chunk为16 最大的为 64kb ，增长系数为 2
 	// 每个page的大小
@@ -11,16 +29,29 @@ func InitPool() {
 }
 
 func GetSlice(s int) []byte {
-	return bitPool.Alloc(s)
+	b := bitPool.Alloc(s)
+	atomic.AddUint64(&allocs, 1)
+	atomic.AddUint64(&allocBytes, uint64(cap(b)))
+
+	return b
 }
 
 func RecycleSlice(slice []byte) {
 	for i := 0; i < len(slice); i++ {
 		slice[i] = 0
 	}
+	atomic.AddUint64(&frees, 1)
 	bitPool.Free(slice)
 }
 
+func GetStats() Stats {
+	return Stats{
+		Allocs:     atomic.LoadUint64(&allocs),
+		Frees:      atomic.LoadUint64(&frees),
+		AllocBytes: atomic.LoadUint64(&allocBytes),
+	}
+}
+
 //
 //func GetSlice(n int) []byte {
 //
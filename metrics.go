@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"rtmp/mem_pool"
+)
+
+// 握手的类型和结果 用于统计.
+const (
+	HandshakeSimple  = "simple"
+	HandshakeComplex = "complex"
+	HandshakeRtmpe   = "rtmpe"
+	// 没有读取到 C0C1 或者版本不支持
+	HandshakeUnknown = "unknown"
+
+	HandshakeSuccess = "success"
+	HandshakeFailure = "failure"
+	// 复杂握手校验失败 退回到简单握手
+	HandshakeFallback = "fallback"
+)
+
+var (
+	handshakeTypes   = []string{HandshakeSimple, HandshakeComplex, HandshakeRtmpe, HandshakeUnknown}
+	handshakeResults = []string{HandshakeSuccess, HandshakeFailure, HandshakeFallback}
+	// 启动时创建所有的组合 之后只读 计数使用原子操作
+	handshakeCounts = func() map[[2]string]*uint64 {
+		m := make(map[[2]string]*uint64)
+		for _, t := range handshakeTypes {
+			for _, r := range handshakeResults {
+				m[[2]string{t, r}] = new(uint64)
+			}
+		}
+
+		return m
+	}()
+
+	// 按照消息类型统计收到的消息数
+	messageCounts [256]uint64
+	// 格式错误的chunk 例如消息长度在接收过程中被修改 消息无法解析
+	chunkParseErrors uint64
+)
+
+var messageTypeNames = map[byte]string{
+	RtmpMsgChunkSize:   "set_chunk_size",
+	RtmpMsgAbort:       "abort",
+	RtmpMsgAck:         "ack",
+	RtmpMsgUserControl: "user_control",
+	RtmpMsgAckSize:     "window_ack_size",
+	RtmpMsgBandWidth:   "set_peer_bandwidth",
+	RtmpMsgEdge:        "edge",
+	RtmpMsgAudio:       "audio",
+	RtmpMsgVideo:       "video",
+	RtmpMsgAMF3Data:    "amf3_data",
+	RtmpMsgAMF0Data:    "amf0_data",
+	RtmpMsgAMF3Command: "amf3_command",
+	RtmpMsgAMF0Command: "amf0_command",
+	RtmpMsgAggregate:   "aggregate",
+}
+
+// messageTypeName 没有名字的消息类型使用数字.
+func messageTypeName(t byte) string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(t))
+}
+
+func countHandshake(typ string, err error) {
+	if err != nil {
+		countHandshakeResult(typ, HandshakeFailure)
+	} else {
+		countHandshakeResult(typ, HandshakeSuccess)
+	}
+}
+
+func countHandshakeResult(typ, result string) {
+	atomic.AddUint64(handshakeCounts[[2]string{typ, result}], 1)
+}
+
+func countMessage(t byte) {
+	atomic.AddUint64(&messageCounts[t], 1)
+}
+
+// metricsWriter 输出 Prometheus 的文本格式.
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample labels 为 名字 值 名字 值...
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(m.w, name)
+	if len(labels) > 0 {
+		parts := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			parts = append(parts, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		fmt.Fprint(m.w, "{"+strings.Join(parts, ",")+"}")
+	}
+	fmt.Fprintln(m.w, " "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// metricsHandler 以 Prometheus 的文本格式输出指标.
+type metricsHandler struct{}
+
+func (metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, conf().Metrics)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// metricsApp app 标签 默认去掉实例 防止标签太多.
+func metricsApp(app string, cfg MetricsConfig) string {
+	if cfg.AppInstances {
+		return app
+	}
+
+	return appBase(app)
+}
+
+func writeMetrics(w io.Writer, cfg MetricsConfig) {
+	m := &metricsWriter{w: w}
+
+	states := map[string]uint64{
+		ClientStateHandshake: 0, ClientStateConnecting: 0, ClientStateConnected: 0,
+		ClientStatePublishing: 0, ClientStatePlaying: 0,
+	}
+	for _, nc := range clients.List() {
+		states[nc.Info().State]++
+	}
+	m.family("rtmp_connections", "gauge", "Client connections by state.")
+	for _, state := range sortedKeys(states) {
+		m.sample("rtmp_connections", float64(states[state]), "state", state)
+	}
+
+	m.family("rtmp_handshakes_in_progress", "gauge", "Connections that are handshaking.")
+	m.sample("rtmp_handshakes_in_progress", float64(Handshaking()))
+
+	m.family("rtmp_handshakes_total", "counter", "Handshakes by type and result.")
+	for _, t := range handshakeTypes {
+		for _, r := range handshakeResults {
+			if n := atomic.LoadUint64(handshakeCounts[[2]string{t, r}]); n > 0 {
+				m.sample("rtmp_handshakes_total", float64(n), "type", t, "result", r)
+			}
+		}
+	}
+
+	in, out := clients.Bytes()
+	m.family("rtmp_received_bytes_total", "counter", "Bytes received from clients.")
+	m.sample("rtmp_received_bytes_total", float64(in))
+	m.family("rtmp_sent_bytes_total", "counter", "Bytes sent to clients.")
+	m.sample("rtmp_sent_bytes_total", float64(out))
+
+	m.family("rtmp_messages_received_total", "counter", "Messages received by type.")
+	for t := range messageCounts {
+		n := atomic.LoadUint64(&messageCounts[t])
+		if n == 0 {
+			continue
+		}
+		m.sample("rtmp_messages_received_total", float64(n), "type", messageTypeName(byte(t)))
+	}
+
+	m.family("rtmp_chunk_parse_errors_total", "counter", "Malformed chunks and messages.")
+	m.sample("rtmp_chunk_parse_errors_total", float64(atomic.LoadUint64(&chunkParseErrors)))
+
+	violations := LimitViolations()
+	m.family("rtmp_limit_violations_total", "counter", "Connections closed for exceeding a limit.")
+	for _, reason := range sortedKeys(violations) {
+		m.sample("rtmp_limit_violations_total", float64(violations[reason]), "reason", reason)
+	}
+	m.family("rtmp_auto_bans_total", "counter", "Addresses banned automatically for repeated limit violations.")
+	m.sample("rtmp_auto_bans_total", float64(autoBan.AutoBans()))
+	m.family("rtmp_ban_list_entries", "gauge", "Entries in the ban list, including manual bans.")
+	m.sample("rtmp_ban_list_entries", float64(len(banList.List())))
+
+	writeStreamMetrics(m, cfg)
+
+	pool := mem_pool.GetStats()
+	m.family("rtmp_mem_pool_allocs_total", "counter", "Slices allocated from the memory pool.")
+	m.sample("rtmp_mem_pool_allocs_total", float64(pool.Allocs))
+	m.family("rtmp_mem_pool_frees_total", "counter", "Slices returned to the memory pool.")
+	m.sample("rtmp_mem_pool_frees_total", float64(pool.Frees))
+	m.family("rtmp_mem_pool_alloc_bytes_total", "counter", "Bytes allocated from the memory pool.")
+	m.sample("rtmp_mem_pool_alloc_bytes_total", float64(pool.AllocBytes))
+}
+
+// writeStreamMetrics 每个app的发布者和播放者 以及每路流的码率和帧率.
+func writeStreamMetrics(m *metricsWriter, cfg MetricsConfig) {
+	type appKey struct{ vhost, app string }
+	publishers := make(map[appKey]int)
+	players := make(map[appKey]int)
+
+	var stats []StreamStats
+	for _, s := range streamManager.Streams() {
+		key := appKey{s.Vhost, metricsApp(s.App, cfg)}
+		st := s.Stats()
+		players[key] += s.PlayerCount()
+		if st.PublishTime != nil {
+			publishers[key]++
+			stats = append(stats, st)
+		}
+	}
+
+	keys := make([]appKey, 0, len(players))
+	for key := range players {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].vhost != keys[j].vhost {
+			return keys[i].vhost < keys[j].vhost
+		}
+
+		return keys[i].app < keys[j].app
+	})
+
+	m.family("rtmp_publishers", "gauge", "Active publishers per app.")
+	for _, key := range keys {
+		m.sample("rtmp_publishers", float64(publishers[key]), "vhost", key.vhost, "app", key.app)
+	}
+	m.family("rtmp_players", "gauge", "Active players per app.")
+	for _, key := range keys {
+		m.sample("rtmp_players", float64(players[key]), "vhost", key.vhost, "app", key.app)
+	}
+
+	if !cfg.Streams {
+		return
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].BitrateKbps > stats[j].BitrateKbps
+	})
+	if cfg.MaxStreams > 0 && len(stats) > cfg.MaxStreams {
+		stats = stats[:cfg.MaxStreams]
+	}
+
+	// 不同实例中可能有同名的流 流的标签使用完整的app
+	m.family("rtmp_stream_bitrate_bits_per_second", "gauge", "Incoming bitrate of each published stream.")
+	for _, st := range stats {
+		m.sample("rtmp_stream_bitrate_bits_per_second", st.BitrateKbps*1000,
+			"vhost", st.Vhost, "app", st.App, "stream", st.Name)
+	}
+	m.family("rtmp_stream_frame_rate", "gauge", "Video frames per second of each published stream.")
+	for _, st := range stats {
+		m.sample("rtmp_stream_frame_rate", st.FrameRate,
+			"vhost", st.Vhost, "app", st.App, "stream", st.Name)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var streams []*Stream
+	for _, app := range []string{"metrics/room1", "metrics/room2"} {
+		p := newPuller("", app, "cam", "rtmp://origin/"+app+"/cam", 0, 0)
+		s, err := streamManager.Publish("", app, "cam", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer streamManager.Unpublish(s, p)
+		// 录制 转推这些内部的订阅者不算播放者
+		sub := newInternalSubscriber("record")
+		streamManager.Subscribe("", app, "cam", sub)
+		defer streamManager.Unsubscribe(s, sub)
+		s.WritePacket(&AVPacket{Type: RtmpMsgVideo, Payload: []byte{0x17, 1, 0, 0, 0}})
+		streams = append(streams, s)
+	}
+	if err := banList.Add("198.51.100.0/24", "metrics", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer banList.Remove("198.51.100.0/24")
+	countHandshakeResult(HandshakeComplex, HandshakeFallback)
+	countMessage(RtmpMsgVideo)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, MetricsConfig{Streams: true, MaxStreams: 1})
+	out := buf.String()
+
+	for _, line := range []string{
+		`# TYPE rtmp_connections gauge`,
+		`rtmp_connections{state="publishing"} `,
+		`rtmp_handshakes_total{type="complex",result="fallback"} `,
+		`rtmp_messages_received_total{type="video"} `,
+		`rtmp_publishers{vhost="",app="metrics"} 2`,
+		`rtmp_stream_frame_rate{vhost="",app="metrics/room`,
+		`rtmp_players{vhost="",app="metrics"} 0`,
+		`rtmp_mem_pool_allocs_total `,
+		`# TYPE rtmp_auto_bans_total counter`,
+		`rtmp_ban_list_entries 1`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+	if n := strings.Count(out, "rtmp_stream_bitrate_bits_per_second{"); n != 1 {
+		t.Errorf("max_streams 1 but got %d streams", n)
+	}
+
+	buf.Reset()
+	writeMetrics(&buf, MetricsConfig{AppInstances: true})
+	out = buf.String()
+	if !strings.Contains(out, `rtmp_publishers{vhost="",app="metrics/room2"} 1`) || strings.Contains(out, "rtmp_stream_bitrate") {
+		t.Errorf("app instances without streams:\n%s", out)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("got %s", got)
+	}
+}
@@ -11,6 +11,8 @@ const (
 	// RtmpDefaultChunkSize = 128
 	RtmpDefaultChunkSize = 128
 	RtmpMaxChunkSize     = 65536
+	// timestamp只有3byte 超过后需要使用 ExtendTimestamp
+	RtmpMaxTimestamp = 0xffffff
 	// Chunk
 	RtmpMsgChunkSize = 1
 	RtmpMsgAbort     = 2
@@ -35,10 +37,17 @@ const (
 	RtmpUserPingRequest    = 6
 	RtmpUserPingResponse   = 7
 
+	// 数据消息 例如 onMetaData
+	RtmpMsgAMF3Data = 15
+	RtmpMsgAMF0Data = 18
+
 	// 命令消息
 	RtmpMsgAMF3Command = 17
 	RtmpMsgAMF0Command = 20
 
+	// 聚合消息
+	RtmpMsgAggregate = 22
+
 	RtmpUserEmpty = 31
 
 	CommandConnect       = "connect"
@@ -60,6 +69,9 @@ const (
 	CommandFCPublish     = "FCPublish"
 	CommandFcUnpublish   = "FCUnpublish"
 
+	DataSetDataFrame = "@setDataFrame"
+	DataOnMetaData   = "onMetaData"
+
 	RtmpCSIDControl = 0x02
 	RtmpCSIDCommand = 0x03
 	RtmpCSIDAudio   = 0x06
@@ -190,8 +202,8 @@ func (c *CreateStreamMessage) GetCommand() CommandMessage {
 type PlayMessage struct {
 	CommandMessage
 	StreamName string
-	Start      uint64
-	Duration   uint64
+	Start      int64
+	Duration   int64
 	Reset      bool
 }
 
@@ -199,6 +211,16 @@ func (p *PlayMessage) GetCommand() CommandMessage {
 	return p.CommandMessage
 }
 
+type PublishMessage struct {
+	CommandMessage
+	PublishingName string
+	PublishingType string // live record append
+}
+
+func (p *PublishMessage) GetCommand() CommandMessage {
+	return p.CommandMessage
+}
+
 type CURDStreamMessage struct {
 	CommandMessage
 	StreamID uint32
@@ -231,6 +253,9 @@ func (msg *ResponseConnectMessage) Encode() []byte {
 
 	if msg.Properties != nil {
 		_ = amf.encodeObject(msg.Properties)
+	} else if msg.Infomation != nil {
+		// _error 没有 Properties 需要用 null 占位
+		_ = amf.writeNull()
 	}
 
 	if msg.Infomation != nil {
@@ -240,13 +265,126 @@ func (msg *ResponseConnectMessage) Encode() []byte {
 	return amf.Bytes()
 }
 
+type ResponseCreateStreamMessage struct {
+	CommandMessage
+	StreamID uint32
+}
+
+func (msg *ResponseCreateStreamMessage) Encode() []byte {
+	amf := NewAMFEncode()
+
+	_ = amf.writeString(msg.CommandName)
+	_ = amf.writeNumber(float64(msg.TransactionID))
+	_ = amf.writeNull()
+	_ = amf.writeNumber(float64(msg.StreamID))
+
+	return amf.Bytes()
+}
+
+type ResponseOnStatusMessage struct {
+	CommandMessage
+	Infomation AMFObjects `json:",omitempty"`
+	StreamID   uint32
+}
+
+func newOnStatusMessage(streamID uint32, level, code, description string) *ResponseOnStatusMessage {
+	info := newAMFObjects()
+	info["level"] = level
+	info["code"] = code
+	if description != "" {
+		info["description"] = description
+	}
+
+	m := new(ResponseOnStatusMessage)
+	m.CommandName = ResponseOnStatus
+	m.TransactionID = 0
+	m.Infomation = info
+	m.StreamID = streamID
+
+	return m
+}
+
+func (msg *ResponseOnStatusMessage) Encode() []byte {
+	amf := NewAMFEncode()
+
+	_ = amf.writeString(msg.CommandName)
+	_ = amf.writeNumber(float64(msg.TransactionID))
+	_ = amf.writeNull()
+	_ = amf.encodeObject(msg.Infomation)
+
+	return amf.Bytes()
+}
+
+func (msg *ResponseOnStatusMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+// RequestCommandMessage 客户端发送的命令 参数依次使用AMF0编码.
+type RequestCommandMessage struct {
+	CommandMessage
+	Arguments []interface{}
+	StreamID  uint32
+}
+
+func (msg *RequestCommandMessage) Encode() []byte {
+	amf := NewAMFEncode()
+
+	_ = amf.writeString(msg.CommandName)
+	_ = amf.writeNumber(float64(msg.TransactionID))
+	for _, arg := range msg.Arguments {
+		_ = amf.writeValue(arg)
+	}
+
+	return amf.Bytes()
+}
+
+func (msg *RequestCommandMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+// DataMessage 数据消息 例如 @setDataFrame onMetaData.
+type DataMessage struct {
+	Name   string
+	Values []AMFObject
+}
+
+// AVMessage 直接转发的音视频/数据消息 Payload不做任何修改.
+type AVMessage struct {
+	Timestamp uint32
+	StreamID  uint32
+	Payload   []byte
+}
+
+func (msg *AVMessage) Encode() []byte {
+	return msg.Payload
+}
+
+func (msg *AVMessage) GetStreamID() uint32 {
+	return msg.StreamID
+}
+
+func (msg *AVMessage) GetTimestamp() uint32 {
+	return msg.Timestamp
+}
+
+type HaveTimestamp interface {
+	GetTimestamp() uint32
+}
+
 func newChunkHeaderFromMessageType(msgType byte) *ChunkHeader {
 	head := &ChunkHeader{}
 
 	head.ChunkStreamID = RtmpCSIDControl
 
-	if msgType == RtmpMsgAMF0Command {
+	switch msgType {
+	case RtmpMsgAMF0Command:
 		head.ChunkStreamID = RtmpCSIDCommand
+	case RtmpMsgAudio:
+		head.ChunkStreamID = RtmpCSIDAudio
+	case RtmpMsgVideo:
+		head.ChunkStreamID = RtmpCSIDVideo
+	case RtmpMsgAMF0Data:
+		head.ChunkStreamID = RtmpCSIDData
 	}
 
 	head.Timestamp = 0
@@ -281,8 +419,17 @@ func GetRtmpMsgData(chunk *Chunk) (interface{}, error) {
 		}
 
 		return m, nil
-	case RtmpMsgAudio:
-	case RtmpMsgVideo:
+	case RtmpMsgAudio, RtmpMsgVideo, RtmpMsgAggregate:
+		// 音视频数据不需要解析 直接使用Body
+		return nil, nil
+	case RtmpMsgAMF3Data:
+		if len(chunk.Body) > 0 && chunk.Body[0] == 0 {
+			return decodeDataAMF0(chunk.Body[1:]), nil
+		}
+
+		return decodeDataAMF0(chunk.Body), nil
+	case RtmpMsgAMF0Data:
+		return decodeDataAMF0(chunk.Body), nil
 	case RtmpMsgAMF3Command:
 		// 这里表示 使用AMF3编码的
 		return deCodeCommandAMF3(chunk)
@@ -337,6 +484,28 @@ func decodeCommandAMF0(chunk *Chunk) (interface{}, error) {
 	return handlerCommand(cmdMsg, amf)
 }
 
+// decodeDataAMF0 数据消息解析失败也不影响转发 所以这里只返回能解析出来的部分.
+func decodeDataAMF0(body []byte) *DataMessage {
+	amf := NewAMF(body)
+	msg := &DataMessage{}
+
+	name, err := amf.decodeObject()
+	if err != nil {
+		return msg
+	}
+	msg.Name, _ = name.(string)
+
+	for amf.Len() > 0 {
+		v, err := amf.decodeObject()
+		if err != nil {
+			break
+		}
+		msg.Values = append(msg.Values, v)
+	}
+
+	return msg
+}
+
 func handlerCommand(cmd CommandMessage, amf *AMF) (interface{}, error) {
 	switch cmd.CommandName {
 	case CommandConnect, CommandCall:
@@ -381,6 +550,8 @@ func handlerCommand(cmd CommandMessage, amf *AMF) (interface{}, error) {
 		_, _ = amf.readNull()
 		msgData := &PlayMessage{
 			CommandMessage: cmd,
+			Start:          -2,
+			Duration:       -1,
 		}
 
 		if streamName, err := amf.readString(); err != nil {
@@ -389,30 +560,76 @@ func handlerCommand(cmd CommandMessage, amf *AMF) (interface{}, error) {
 			msgData.StreamName = streamName
 		}
 
-		if start, err := amf.readNumber(); err != nil {
-			return nil, err
-		} else if err == nil {
-			msgData.Start = uint64(start)
+		// 后面的参数都是可选的
+		if amf.Len() > 0 {
+			start, err := amf.readNumber()
+			if err != nil {
+				return nil, err
+			}
+			msgData.Start = int64(start)
 		}
 
-		if duration, err := amf.readNumber(); err != nil {
-			return nil, err
-		} else if err == nil {
-			msgData.Duration = uint64(duration)
+		if amf.Len() > 0 {
+			duration, err := amf.readNumber()
+			if err != nil {
+				return nil, err
+			}
+			msgData.Duration = int64(duration)
 		}
 
-		if reset, err := amf.readBool(); err != nil {
-			return nil, err
-		} else if err == nil {
+		if amf.Len() > 0 {
+			reset, err := amf.readBool()
+			if err != nil {
+				return nil, err
+			}
 			msgData.Reset = reset
 		}
 
+		return msgData, nil
+	case CommandPublish:
+		_, _ = amf.readNull()
+		msgData := &PublishMessage{
+			CommandMessage: cmd,
+			PublishingType: "live",
+		}
+
+		name, err := amf.readString()
+		if err != nil {
+			return nil, err
+		}
+		msgData.PublishingName = name
+
+		if amf.Len() > 0 {
+			if t, err := amf.readString(); err == nil {
+				msgData.PublishingType = t
+			}
+		}
+
 		return msgData, nil
 	case "FCPublish", "FCUnpublish":
 		return nil, nil
 	}
 
-	return nil, errors.Errorf("not Support CommandName name is %s", cmd.CommandName)
+	// 其他的命令 例如 _result _error onStatus 都是 CommandObject + 一个可选的参数
+	msgData := &CallMessage{
+		CommandMessage: cmd,
+	}
+	if amf.Len() > 0 {
+		obj, err := amf.decodeObject()
+		if err != nil {
+			return nil, err
+		}
+		msgData.Object = obj
+	}
+	if amf.Len() > 0 {
+		opt, err := amf.decodeObject()
+		if err != nil {
+			return nil, err
+		}
+		msgData.Optional = opt
+	}
+
+	return msgData, nil
 }
 
 func handlerUserControlMessage(controlMsg UserControlMessage) interface{} {
@@ -3,10 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// "fmt"
 	"net"
+	"net/url"
 	"rtmp/mem_pool"
 	"rtmp/utils"
 
@@ -18,16 +23,36 @@ const (
 	SendSetPeerBandWidthMessage = "Send Set Peer Bandwidth Message"
 	SendStreamBeginMessage      = "Send Stream Begin Message"
 	SendConnectResponseMessage  = "Send Connect Response Message"
+	SendConnectRejectMessage    = "Send Connect Reject Message"
 	SendPingResponseMessage     = "Send Ping Response Message"
 	SendPingRequestMessage      = "Send Ping Request Message"
 	SendAckMessage              = "Send Ack Message"
+	SendSetChunkSizeMessage     = "Send Set Chunk Size Message"
+	SendCreateStreamResponse    = "Send Create Stream Response Message"
+	SendOnStatusMessage         = "Send OnStatus Message"
 )
 
 const (
 	EngineVersion = "mou/"
+
+	// 服务端发送数据时默认使用的ChunkSize 128太小了 音视频数据会被拆成很多个chunk
+	RtmpServerChunkSize = 4096
+)
+
+// 客户端连接的状态.
+const (
+	ClientStateHandshake  = "handshake"
+	ClientStateConnecting = "connecting"
+	ClientStateConnected  = "connected"
+	ClientStatePublishing = "publishing"
+	ClientStatePlaying    = "playing"
 )
 
 type NetConnection struct {
+	// 64位的原子操作需要8字节对齐 放在最前面
+	bytesIn  uint64 // 一共读取的byte数 不会回绕 用于统计
+	bytesOut uint64 // 一共发送的byte数
+
 	conn           net.Conn
 	rw             *bufio.ReadWriter
 	writeChunkSize int
@@ -38,23 +63,185 @@ type NetConnection struct {
 	rtmpHeader map[uint32]*ChunkHeader
 	// rtmp 的body可能是不完全的 因为每个chunk最大128byte 我们就需要将每个body拼接起来
 	rtmpBody       map[uint32][]byte
-	appName        string
+	appName        string // 带有实例的app 例如 live/room1
+	vhost          string // 虚拟主机 默认虚拟主机为空
+	tcURL          *TcURL
 	objectEncoding float64
 	readSeqNum     uint32 // 已经读取到的byte数
 	writeSeqNum    uint32 // 一些发送出去的byte数
 	totalWrite     uint32 // 一共发送出去的byte数
 	totalRead      uint32 // 一共已经读取到的byte数
 	bandwith       uint32 // 发送窗口限制
+	ackWindowSize  uint32 // 发送给对方的 Window Acknowledgement Size
+
+	writeLock    sync.Mutex // 播放时 转发数据和回复命令在不同的goroutine中
+	netStreams   map[uint32]*NetStream
+	nextStreamID uint32
+	closeOnce    sync.Once
+
+	limits        LimitsConfig
+	bufferedBytes int // rtmpBody 中未接收完的消息的长度之和
+
+	id          uint64 // 客户端连接的ID 管理接口中使用
+	connectedAt time.Time
+	// 带有连接ID 地址和app的日志 只在 HandlerMessage 的goroutine中修改
+	log Logger
+	// 管理接口在其他goroutine中读取 state vhost appName 等
+	infoLock sync.RWMutex
+	state    string
+	flashVer string
+	swfURL   string
+	pageURL  string
+	// 正在发布或者播放的 NetStream
+	activeStreams []*NetStream
+}
+
+func newNetConnection(conn net.Conn) *NetConnection {
+	return &NetConnection{
+		conn:           conn,
+		rw:             bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		writeChunkSize: RtmpDefaultChunkSize,
+		readChunkSize:  RtmpDefaultChunkSize,
+		rtmpHeader:     make(map[uint32]*ChunkHeader),
+		rtmpBody:       make(map[uint32][]byte),
+		bandwith:       RtmpMaxChunkSize << 3,
+		netStreams:     make(map[uint32]*NetStream),
+		limits:         conf().Limits,
+		connectedAt:    time.Now(),
+		state:          ClientStateHandshake,
+		log:            logger(),
+	}
+}
+
+func (nc *NetConnection) RemoteAddr() string {
+	return nc.conn.RemoteAddr().String()
+}
+
+// Info 连接当前的状态 可以在其他goroutine中调用.
+func (nc *NetConnection) Info() ClientInfo {
+	nc.infoLock.RLock()
+	defer nc.infoLock.RUnlock()
+
+	return ClientInfo{
+		ID:          nc.id,
+		Addr:        nc.RemoteAddr(),
+		Vhost:       nc.vhost,
+		App:         nc.appName,
+		State:       nc.state,
+		BytesIn:     nc.BytesIn(),
+		BytesOut:    nc.BytesOut(),
+		ConnectedAt: nc.connectedAt,
+		FlashVer:    nc.flashVer,
+		SwfURL:      nc.swfURL,
+		PageURL:     nc.pageURL,
+		Streams:     nc.streamsInfo(),
+	}
+}
+
+// streamsInfo 需要持有 infoLock.
+func (nc *NetConnection) streamsInfo() []ClientStream {
+	var list []ClientStream
+	for _, ns := range nc.activeStreams {
+		ns.lock.Lock()
+		if ns.stream != nil {
+			list = append(list, ClientStream{
+				Vhost:      ns.stream.Vhost,
+				App:        ns.stream.App,
+				Name:       ns.streamName,
+				Publishing: ns.publishing,
+				ns:         ns,
+				stream:     ns.stream,
+				subscriber: ns.subscriber,
+			})
+		}
+		ns.lock.Unlock()
+	}
+
+	return list
+}
+
+func (nc *NetConnection) setState(state string) {
+	nc.infoLock.Lock()
+	defer nc.infoLock.Unlock()
+
+	nc.state = state
+}
+
+// updateState 按照连接上的 NetStream 更新状态 只在 HandlerMessage 的goroutine中调用.
+func (nc *NetConnection) updateState() {
+	state := ClientStateConnected
+	var active []*NetStream
+	for _, ns := range nc.netStreams {
+		if ns.publishing {
+			state = ClientStatePublishing
+		} else if ns.subscriber != nil && state != ClientStatePublishing {
+			state = ClientStatePlaying
+		}
+		if ns.publishing || ns.subscriber != nil {
+			active = append(active, ns)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].streamID < active[j].streamID
+	})
+
+	nc.infoLock.Lock()
+	defer nc.infoLock.Unlock()
+
+	nc.state = state
+	nc.activeStreams = active
+}
+
+// ClientIP 客户端的地址 不是TCP连接时返回nil.
+func (nc *NetConnection) ClientIP() net.IP {
+	if addr, ok := nc.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return net.ParseIP(clientIP(nc.RemoteAddr()))
+}
+
+// Close 关闭连接 可以在其他goroutine中调用 HandlerMessage 读取失败后会清理这个连接上的发布和播放.
+func (nc *NetConnection) Close() error {
+	var err error
+
+	nc.closeOnce.Do(func() {
+		err = nc.conn.Close()
+	})
+
+	return err
+}
+
+// cleanup 停止这个连接上所有的发布和播放 只在 HandlerMessage 的goroutine中调用.
+func (nc *NetConnection) cleanup() {
+	_ = nc.Close()
+
+	for id, ns := range nc.netStreams {
+		ns.close()
+		delete(nc.netStreams, id)
+	}
 }
 
 func (nc *NetConnection) addReadSeqNum(n int) {
 	// atomic.AddUint32(&nc.readSeqNum, uint32(n))
 	nc.readSeqNum += uint32(n)
+	atomic.AddUint64(&nc.bytesIn, uint64(n))
 }
 
 func (nc *NetConnection) addWriteSeqNum(n int) {
 	// atomic.AddUint32(&nc.writeSeqNum, uint32(n))
 	nc.writeSeqNum += uint32(n)
+	atomic.AddUint64(&nc.bytesOut, uint64(n))
+}
+
+// BytesIn 连接上一共读取的byte数 可以在其他goroutine中调用.
+func (nc *NetConnection) BytesIn() uint64 {
+	return atomic.LoadUint64(&nc.bytesIn)
+}
+
+// BytesOut 连接上一共发送的byte数.
+func (nc *NetConnection) BytesOut() uint64 {
+	return atomic.LoadUint64(&nc.bytesOut)
 }
 
 func (nc *NetConnection) readByte() (b byte, err error) {
@@ -65,7 +252,7 @@ func (nc *NetConnection) readByte() (b byte, err error) {
 }
 
 func (nc *NetConnection) readFull(b []byte) (n int, err error) {
-	n, err = nc.rw.Read(b)
+	n, err = io.ReadFull(nc.rw, b)
 	nc.addReadSeqNum(n)
 
 	return
@@ -85,24 +272,91 @@ func (nc *NetConnection) writeFull(b []byte) (n int, err error) {
 	return
 }
 
+// handshake 握手时限制同时握手的连接数和读取 C0C1 C2 的时间.
+func (nc *NetConnection) handshake() (*rtmpeCipher, error) {
+	if !acquireHandshake(conf().RateLimit.MaxHandshakes) {
+		return nil, limitError(nc, LimitHandshakes, "%d connections are handshaking", Handshaking())
+	}
+	defer releaseHandshake()
+
+	hc := newHandshakeConn(nc.conn, nc.limits, conf().Handshake)
+	nc.rw = bufio.NewReadWriter(bufio.NewReader(hc), bufio.NewWriter(hc))
+
+	c, err := handshake(nc.rw)
+	if isTimeout(err) {
+		return nil, limitError(nc, hc.reason, "handshake timeout")
+	}
+
+	return c, err
+}
+
+// setDeadline 为0时取消超时.
+func (nc *NetConnection) setDeadline(d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	_ = nc.conn.SetDeadline(t)
+}
+
 func (nc *NetConnection) HandlerMessage() {
-	var err error
-	if err = handshake(nc.rw); err != nil {
-		fmt.Println("HandShake Fail")
+	defer nc.cleanup()
+
+	// 有 PROXY 头时获取地址会等待读取 所以在连接的协程中才设置
+	nc.log = logger().With("remote", nc.RemoteAddr())
+	nc.log.Debug("accepted")
+
+	if banList.Banned(nc.ClientIP()) {
+		nc.log.Info("connection from banned address")
+
+		return
+	}
+
+	ip := nc.ClientIP()
+	if reason := connRateLimiter.allow(ip, conf().RateLimit); reason != "" {
+		_ = limitError(nc, reason, "too many new connections")
 
 		return
 	}
-	fmt.Println("HandShake Success")
+	if reason := connections.acquire(ip, nc.limits); reason != "" {
+		_ = limitError(nc, reason, "too many connections")
+
+		return
+	}
+	defer connections.release(ip)
+
+	clients.add(nc)
+	defer clients.remove(nc)
+	nc.log = logger().With("conn", nc.id, "remote", nc.RemoteAddr())
+
+	c, err := nc.handshake()
+	if err != nil {
+		nc.log.Info("handshake failed", "err", err)
+
+		return
+	}
+	// RTMPE 之后所有的数据都是加密的
+	if c != nil {
+		nc.rw = c.wrap(nc.rw.Reader, nc.conn)
+	}
+	nc.log.Debug("handshake success")
+	nc.setState(ClientStateConnecting)
+	nc.setDeadline(nc.limits.ConnectTimeout)
 	if err = nc.onConnect(); err != nil {
-		fmt.Println("Try To Connect Fail")
+		if isTimeout(err) {
+			_ = limitError(nc, LimitConnectTimeout, "connect not received in %s", nc.limits.ConnectTimeout)
+		}
+		nc.log.Info("connect failed", "err", err)
 
 		return
 	}
+	nc.setDeadline(0)
+	nc.setState(ClientStateConnected)
 
 	for {
 		msg, err := nc.getMsg()
 		if err != nil {
-			fmt.Println("HandlerMessage Error is ", err.Error())
+			nc.log.Debug("read message failed", "err", err)
 
 			break
 		}
@@ -110,28 +364,79 @@ func (nc *NetConnection) HandlerMessage() {
 		if msg.MessageLength == 0 {
 			continue
 		}
+		// 每个消息都会调用 先判断级别 避免构造字段
+		if nc.log.Enabled(LogDebug) {
+			nc.log.Debug("message received", "type", messageTypeName(msg.MessageTypeID), "stream_id", msg.MessageStreamID,
+				"length", msg.MessageLength, "timestamp", msg.Timestamp)
+		}
 
 		switch msg.MessageTypeID {
-		case RtmpMsgAMF0Command:
+		case RtmpMsgAMF0Command, RtmpMsgAMF3Command:
 			if msg.MsgData == nil {
 				break
 			}
 
 			commander, ok := msg.MsgData.(GetCommander)
 			if !ok {
-				fmt.Println("interface{} is not CommandMessage")
+				nc.log.Warn("command message not decoded", "type", messageTypeName(msg.MessageTypeID))
 
 				continue
 			}
-			cmd := commander.GetCommand()
-			switch cmd.CommandName {
-			case "createStream":
-				fmt.Println("qweqwew")
+			if err = nc.handleCommand(msg, commander); err != nil {
+				nc.log.Warn("handle command failed", "err", err)
+			}
+			nc.updateState()
+		case RtmpMsgAudio, RtmpMsgVideo, RtmpMsgAMF0Data, RtmpMsgAMF3Data:
+			if ns, ok := nc.netStreams[msg.MessageStreamID]; ok {
+				ns.writePacket(msg)
 			}
 		}
 	}
 
-	fmt.Println("Try Connect Success")
+	nc.log.Info("connection closed", "bytes_in", nc.BytesIn(), "bytes_out", nc.BytesOut())
+}
+
+func (nc *NetConnection) handleCommand(msg *Chunk, commander GetCommander) error {
+	cmd := commander.GetCommand()
+
+	switch cmd.CommandName {
+	case CommandCreateStream:
+		nc.nextStreamID++
+		ns := newNetStream(nc, nc.nextStreamID)
+		nc.netStreams[ns.streamID] = ns
+
+		return nc.SendMessage(SendCreateStreamResponse, &ResponseCreateStreamMessage{
+			CommandMessage: CommandMessage{CommandName: ResponseResult, TransactionID: cmd.TransactionID},
+			StreamID:       ns.streamID,
+		})
+	case CommandPublish:
+		ns, ok := nc.netStreams[msg.MessageStreamID]
+		if !ok {
+			return errors.Errorf("publish on unknown stream id %d", msg.MessageStreamID)
+		}
+
+		return ns.publish(commander.(*PublishMessage))
+	case CommandPlay:
+		ns, ok := nc.netStreams[msg.MessageStreamID]
+		if !ok {
+			return errors.Errorf("play on unknown stream id %d", msg.MessageStreamID)
+		}
+
+		return ns.play(commander.(*PlayMessage))
+	case CommandDeleteStream, CommandCloseStream:
+		m := commander.(*CURDStreamMessage)
+		streamID := m.StreamID
+		if cmd.CommandName == CommandCloseStream {
+			streamID = msg.MessageStreamID
+		}
+
+		if ns, ok := nc.netStreams[streamID]; ok {
+			ns.close()
+			delete(nc.netStreams, streamID)
+		}
+	}
+
+	return nil
 }
 
 func (nc *NetConnection) onConnect() (err error) {
@@ -157,32 +462,81 @@ func (nc *NetConnection) onConnect() (err error) {
 		return
 	}
 
-	if appName, ok := v["app"]; ok {
-		nc.appName = appName.(string)
+	if objEncoding, ok := v["objectEncoding"]; ok {
+		nc.objectEncoding, _ = objEncoding.(float64)
+	}
+
+	// 有些客户端不发送 tcUrl 这时只能使用默认虚拟主机
+	tcURL, _ := v["tcUrl"].(string)
+	u, err := ParseTcURL(tcURL)
+	if err != nil {
+		u = &TcURL{Query: make(url.Values)}
+	}
+	if appName, ok := v["app"].(string); ok && appName != "" {
+		u.setApp(appName)
+	}
+	// 不能修改域名的客户端可以通过 ?vhost= 指定虚拟主机
+	host := u.Host
+	if vhost := u.Query.Get("vhost"); vhost != "" {
+		host = vhost
 	}
 
-	if objEncoding, ok := v["objectEncoding"]; ok {
-		nc.objectEncoding = objEncoding.(float64)
+	nc.infoLock.Lock()
+	nc.tcURL = u
+	nc.appName = u.FullApp()
+	nc.vhost = conf().MatchVhost(host)
+	nc.flashVer, _ = v["flashVer"].(string)
+	nc.swfURL, _ = v["swfUrl"].(string)
+	nc.pageURL, _ = v["pageUrl"].(string)
+	nc.infoLock.Unlock()
+	if nc.vhost != "" {
+		nc.log = nc.log.With("vhost", nc.vhost)
+	}
+	nc.log = nc.log.With("app", nc.appName)
+
+	if u.App == "" || !conf().AppAllowed(nc.vhost, nc.appName) {
+		description := "app " + nc.appName + " not found"
+		_ = nc.SendMessage(SendConnectRejectMessage, description)
+
+		return errors.New(description)
+	}
+
+	// 只能发布的app 在 connect 时就可以检查发布的规则
+	if app := conf().App(nc.vhost, nc.appName); !app.CanPlay() && !checkAccess(app.Access.Publish, nc.ClientIP()) {
+		_ = nc.SendMessage(SendConnectRejectMessage, "access denied")
+
+		return errors.New("access denied")
+	}
+
+	if err = authenticate(newAuthRequest(nc, AuthActionConnect, "", "")); err != nil {
+		_ = nc.SendMessage(SendConnectRejectMessage, err.Error())
+
+		return errors.Wrap(err, "authenticate")
 	}
 
 	// 回复消息
-	if err = nc.SendMessage(SendAckWindowSizeMessage, uint32(512<<10)); err != nil {
-		fmt.Println("Send SendAckWindowSizeMessage ", err)
+	if err = nc.SendMessage(SendAckWindowSizeMessage, conf().Rtmp.WindowAckSize); err != nil {
+		nc.log.Warn("send message failed", "message", SendAckWindowSizeMessage, "err", err)
 
 		return
 	}
-	if err = nc.SendMessage(SendSetPeerBandWidthMessage, uint32(512<<10)); err != nil {
-		fmt.Println("Send SendSetPeerBandWidthMessage ", err)
+	if err = nc.SendMessage(SendSetPeerBandWidthMessage, conf().Rtmp.PeerBandwidth); err != nil {
+		nc.log.Warn("send message failed", "message", SendSetPeerBandWidthMessage, "err", err)
 
 		return
 	}
 	if err = nc.SendMessage(SendStreamBeginMessage, nil); err != nil {
-		fmt.Println("Send SendStreamBeginMessage ", err)
+		nc.log.Warn("send message failed", "message", SendStreamBeginMessage, "err", err)
+
+		return
+	}
+	if err = nc.SendMessage(SendSetChunkSizeMessage, conf().App(nc.vhost, nc.appName).ChunkSize); err != nil {
+		nc.log.Warn("send message failed", "message", SendSetChunkSizeMessage, "err", err)
 
 		return
 	}
 	if err = nc.SendMessage(SendConnectResponseMessage, nc.objectEncoding); err != nil {
-		fmt.Println("Send SendConnectResponseMessage  ", err)
+		nc.log.Warn("send message failed", "message", SendConnectResponseMessage, "err", err)
 
 		return
 	}
@@ -190,7 +544,18 @@ func (nc *NetConnection) onConnect() (err error) {
 	return nil
 }
 
+// getMsg 协议控制消息在这里处理 返回其他的消息.
 func (nc *NetConnection) getMsg() (*Chunk, error) {
+	for {
+		msg, err := nc.readMsg()
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+// readMsg 读取一个消息 是协议控制消息时处理后返回 nil.
+func (nc *NetConnection) readMsg() (*Chunk, error) {
 	if nc.readSeqNum >= nc.bandwith {
 		// atomic.AddUint32(&nc.totalRead, nc.readSeqNum)
 		// atomic.StoreUint32(&nc.readSeqNum, 0)
@@ -203,45 +568,52 @@ func (nc *NetConnection) getMsg() (*Chunk, error) {
 	if err != nil {
 		return nil, err
 	}
+	countMessage(msg.MessageTypeID)
 
 	// fmt.Println("readSeqNum is ", nc.readSeqNum)
 	// fmt.Println("bandwith is ", nc.bandwith)
 	// fmt.Println("bandwith is ", nc.bandwith)
-	fmt.Println("cur msg id is ", msg.MessageTypeID)
 	// 这里表示是用户控制消息
 	// 消息ID在 1~8
 	if RtmpMsgChunkSize <= msg.MessageTypeID && msg.MessageTypeID <= RtmpMsgEdge {
 		switch msg.MessageTypeID {
 		case RtmpMsgChunkSize:
 			m := msg.MsgData.(uint32)
+			if m == 0 || (nc.limits.MaxChunkSize > 0 && m > nc.limits.MaxChunkSize) {
+				return nil, limitError(nc, LimitChunkSize, "chunk size %d exceeds %d", m, nc.limits.MaxChunkSize)
+			}
 			nc.readChunkSize = int(m)
-			fmt.Println("MsgChunkSize V is ", m)
+			nc.log.Debug("set chunk size", "size", m)
 
-			return nc.getMsg()
+			return nil, nil
 		case RtmpMsgAbort:
 			m := msg.MsgData.(uint32)
-			delete(nc.rtmpBody, m)
+			nc.dropPartialMessage(m)
 
-			return nc.getMsg()
+			return nil, nil
 		case RtmpMsgAck, RtmpMsgEdge:
 
-			return nc.getMsg()
+			return nil, nil
 		case RtmpMsgUserControl:
 			if _, ok := msg.MsgData.(*PingRequestMessage); ok {
 				_ = nc.SendMessage(SendPingResponseMessage, nil)
 			}
 
-			return nc.getMsg()
+			return nil, nil
 		case RtmpMsgAckSize:
 			m := msg.MsgData.(uint32)
 			nc.bandwith = m
 
-			return nc.getMsg()
+			return nil, nil
 		case RtmpMsgBandWidth:
 			m := msg.MsgData.(*SetPeerBandWidthMessage)
 			nc.bandwith = m.AcknowledgementWindowSize
+			// 和之前发送的窗口大小不同时 需要回复 Window Acknowledgement Size
+			if nc.ackWindowSize != m.AcknowledgementWindowSize {
+				_ = nc.SendMessage(SendAckWindowSizeMessage, m.AcknowledgementWindowSize)
+			}
 
-			return nc.getMsg()
+			return nil, nil
 		}
 	}
 
@@ -249,14 +621,13 @@ func (nc *NetConnection) getMsg() (*Chunk, error) {
 }
 
 func (nc *NetConnection) SendMessage(msgType string, args interface{}) error {
-	fmt.Println("Send Message MsgType is ", msgType)
-
 	switch msgType {
 	case SendAckWindowSizeMessage:
 		size, ok := args.(uint32)
 		if !ok {
 			return errors.New(SendAckWindowSizeMessage + ", The args must be a uint32")
 		}
+		nc.ackWindowSize = size
 
 		return nc.writeMessage(RtmpMsgAckSize, Uint32Message(size))
 	case SendSetPeerBandWidthMessage:
@@ -270,11 +641,45 @@ func (nc *NetConnection) SendMessage(msgType string, args interface{}) error {
 			LimitType:                 byte(2),
 		})
 	case SendStreamBeginMessage:
+		// 其实这里还没有streamID 后面客户端回复 建立连接的时候会把streamID带过来
+		streamID := nc.streamID
 		if args != nil {
-			return errors.New(SendStreamBeginMessage + ", The paramter is nil")
+			id, ok := args.(uint32)
+			if !ok {
+				return errors.New(SendStreamBeginMessage + ", The args must be nil or a uint32")
+			}
+			streamID = id
 		}
-		// 其实这里还没有streamID 后面客户端回复 建立连接的时候会把streamID带过来
-		return nc.writeMessage(RtmpMsgUserControl, &StreamIDMessage{UserControlMessage{EventType: RtmpUserStreamBegin}, nc.streamID})
+
+		return nc.writeMessage(RtmpMsgUserControl, &StreamIDMessage{UserControlMessage{EventType: RtmpUserStreamBegin}, streamID})
+	case SendSetChunkSizeMessage:
+		size, ok := args.(uint32)
+		if !ok {
+			return errors.New(SendSetChunkSizeMessage + ", The args must be a uint32")
+		}
+
+		if err := nc.writeMessage(RtmpMsgChunkSize, Uint32Message(size)); err != nil {
+			return err
+		}
+		nc.writeLock.Lock()
+		nc.writeChunkSize = int(size)
+		nc.writeLock.Unlock()
+
+		return nil
+	case SendCreateStreamResponse:
+		m, ok := args.(*ResponseCreateStreamMessage)
+		if !ok {
+			return errors.New(SendCreateStreamResponse + ", The args must be a *ResponseCreateStreamMessage")
+		}
+
+		return nc.writeMessage(RtmpMsgAMF0Command, m)
+	case SendOnStatusMessage:
+		m, ok := args.(*ResponseOnStatusMessage)
+		if !ok {
+			return errors.New(SendOnStatusMessage + ", The args must be a *ResponseOnStatusMessage")
+		}
+
+		return nc.writeMessage(RtmpMsgAMF0Command, m)
 	case SendAckMessage:
 		num, ok := args.(uint32)
 		if !ok {
@@ -286,8 +691,8 @@ func (nc *NetConnection) SendMessage(msgType string, args interface{}) error {
 		pro := newAMFObjects()
 		info := newAMFObjects()
 
-		pro["fmsVer"] = EngineVersion
-		pro["capabilities"] = 31
+		pro["fmsVer"] = conf().Rtmp.FmsVer
+		pro["capabilities"] = conf().Rtmp.Capabilities
 		pro["mode"] = 1
 		pro["Author"] = "dexter"
 
@@ -301,6 +706,23 @@ func (nc *NetConnection) SendMessage(msgType string, args interface{}) error {
 		m.Properties = pro
 		m.Infomation = info
 
+		return nc.writeMessage(RtmpMsgAMF0Command, m)
+	case SendConnectRejectMessage:
+		description, ok := args.(string)
+		if !ok {
+			return errors.New(SendConnectRejectMessage + ", The args must be a string")
+		}
+
+		info := newAMFObjects()
+		info["level"] = LevelError
+		info["code"] = NetConnectionConnectRejected
+		info["description"] = description
+
+		m := new(ResponseConnectMessage)
+		m.CommandName = ResponseError
+		m.TransactionID = 1
+		m.Infomation = info
+
 		return nc.writeMessage(RtmpMsgAMF0Command, m)
 	case SendPingResponseMessage:
 		if args != nil {
@@ -319,7 +741,26 @@ func (nc *NetConnection) SendMessage(msgType string, args interface{}) error {
 	return errors.New("SendMessage Not Support Type is " + msgType)
 }
 
+// dropPartialMessage 丢弃未接收完的消息.
+func (nc *NetConnection) dropPartialMessage(csid uint32) {
+	if body, ok := nc.rtmpBody[csid]; ok {
+		nc.bufferedBytes -= cap(body)
+		delete(nc.rtmpBody, csid)
+	}
+}
+
+// readChunk 读取chunk 直到有一个消息接收完.
 func (nc *NetConnection) readChunk() (*Chunk, error) {
+	for {
+		msg, err := nc.readOneChunk()
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+// readOneChunk 读取一个chunk 消息还没有接收完时返回 nil.
+func (nc *NetConnection) readOneChunk() (*Chunk, error) {
 	// 先读 BasicHeader
 	// 先读 先读BasicHeader中的 ChunkType
 
@@ -345,17 +786,26 @@ func (nc *NetConnection) readChunk() (*Chunk, error) {
 		nc.rtmpHeader[streamID] = fullHead
 	}
 
-	err = nc.buildChunkHeader(chunkType, fullHead)
+	currentBody, ok := nc.rtmpBody[streamID]
+
+	err = nc.buildChunkHeader(chunkType, fullHead, !ok)
 	if err != nil {
 		return nil, err
 	}
 
-	currentBody, ok := nc.rtmpBody[streamID]
-
 	msgLen := int(fullHead.MessageLength)
 	if !ok {
+		if err = nc.checkNewMessage(msgLen); err != nil {
+			return nil, err
+		}
 		currentBody = mem_pool.GetSlice(msgLen)[:0]
 		nc.rtmpBody[streamID] = currentBody
+		nc.bufferedBytes += cap(currentBody)
+	} else if msgLen > cap(currentBody) || msgLen < len(currentBody) {
+		// 消息没有接收完时 新的头修改了消息长度
+		atomic.AddUint64(&chunkParseErrors, 1)
+
+		return nil, errors.Errorf("chunk stream %d message length changed to %d", streamID, msgLen)
 	}
 	// 已经读取的长度
 	readed := len(currentBody)
@@ -369,11 +819,11 @@ func (nc *NetConnection) readChunk() (*Chunk, error) {
 		needRead = unRead
 	}
 
-	if n, err := nc.readFull(currentBody[readed : needRead+readed]); err != nil {
-		fmt.Println("nc ReadFull Err ", err.Error())
-	} else {
-		readed += n
+	n, err := nc.readFull(currentBody[readed : needRead+readed])
+	if err != nil {
+		return nil, err
 	}
+	readed += n
 
 	currentBody = currentBody[:readed]
 	nc.rtmpBody[streamID] = currentBody
@@ -390,14 +840,33 @@ func (nc *NetConnection) readChunk() (*Chunk, error) {
 		msg.ChunkHeader = fullHead.Clone()
 		msg.MsgData, err = GetRtmpMsgData(msg)
 		if err != nil {
+			atomic.AddUint64(&chunkParseErrors, 1)
+
 			return nil, err
 		}
+		nc.bufferedBytes -= cap(currentBody)
 		delete(nc.rtmpBody, msg.ChunkStreamID)
 
 		return msg, nil
 	}
 
-	return nc.readChunk()
+	return nil, nil
+}
+
+// checkNewMessage 开始接收一个新的消息之前检查资源限制.
+func (nc *NetConnection) checkNewMessage(msgLen int) error {
+	l := nc.limits
+	if l.MaxMessageSize > 0 && msgLen > int(l.MaxMessageSize) {
+		return limitError(nc, LimitMessageSize, "message length %d exceeds %d", msgLen, l.MaxMessageSize)
+	}
+	if l.MaxPartialMessages > 0 && len(nc.rtmpBody) >= l.MaxPartialMessages {
+		return limitError(nc, LimitPartialMessages, "%d messages are being received", len(nc.rtmpBody))
+	}
+	if l.MaxBufferedBytes > 0 && nc.bufferedBytes+msgLen > l.MaxBufferedBytes {
+		return limitError(nc, LimitBufferedBytes, "buffered %d bytes, new message %d", nc.bufferedBytes, msgLen)
+	}
+
+	return nil
 }
 
 /*
@@ -408,7 +877,9 @@ func (nc *NetConnection) readChunk() (*Chunk, error) {
 		3时 MsgHeader为部分头部 占用0byte 若加上BasicHeader 就是1byte
 
 */
-func (nc *NetConnection) buildChunkHeader(chunkType byte, h *ChunkHeader) error {
+func (nc *NetConnection) buildChunkHeader(chunkType byte, h *ChunkHeader, newMessage bool) error {
+	h.ChunkType = chunkType
+
 	switch chunkType {
 	case 0:
 		return nc.chunkType0(h)
@@ -417,9 +888,7 @@ func (nc *NetConnection) buildChunkHeader(chunkType byte, h *ChunkHeader) error
 	case 2:
 		return nc.chunkType2(h)
 	case 3:
-		h.ChunkType = chunkType
-
-		return nil
+		return nc.chunkType3(h, newMessage)
 	}
 
 	return errors.Errorf("Not Support ChunkType type is %d", chunkType)
@@ -433,7 +902,7 @@ func (nc *NetConnection) chunkType0(h *ChunkHeader) error {
 	if err != nil {
 		return err
 	}
-	h.Timestamp = utils.BigEndian.Uint24(b)
+	timestamp := utils.BigEndian.Uint24(b)
 
 	// 再3个为 Message Len
 	if _, err := nc.readFull(b); err != nil {
@@ -448,18 +917,19 @@ func (nc *NetConnection) chunkType0(h *ChunkHeader) error {
 	h.MessageTypeID = mb
 	// 再来4个是 msgStreamID 和 前面 basicHeader 中的chunkID相同 不过这里的ID是用小端来存储的
 	b4 := mem_pool.GetSlice(4)
-	mem_pool.RecycleSlice(b4)
+	defer mem_pool.RecycleSlice(b4)
 	_, err = nc.readFull(b4)
 	if err != nil {
 		return err
 	}
 	h.MessageStreamID = binary.LittleEndian.Uint32(b4)
 
-	err = nc.getExtendTimestamp(h)
-
-	if err != nil {
+	if timestamp, err = nc.getExtendTimestamp(h, timestamp); err != nil {
 		return err
 	}
+	// fmt=0 时timestamp是绝对时间 若后面跟着的是fmt=3的新消息 这个值就作为时间差使用
+	h.Timestamp = timestamp
+	h.timestampDelta = timestamp
 
 	return nil
 }
@@ -467,12 +937,12 @@ func (nc *NetConnection) chunkType0(h *ChunkHeader) error {
 func (nc *NetConnection) chunkType1(h *ChunkHeader) error {
 	// 前3byte为timestamp 这里的timestamp是前一个包的时间差值
 	b3 := mem_pool.GetSlice(3)
-	mem_pool.RecycleSlice(b3)
+	defer mem_pool.RecycleSlice(b3)
 	_, err := nc.readFull(b3)
 	if err != nil {
 		return err
 	}
-	h.Timestamp += utils.BigEndian.Uint24(b3)
+	delta := utils.BigEndian.Uint24(b3)
 
 	// 后3byte为messageLength
 	_, err = nc.readFull(b3)
@@ -488,10 +958,11 @@ func (nc *NetConnection) chunkType1(h *ChunkHeader) error {
 
 	h.MessageTypeID = b1
 
-	err = nc.getExtendTimestamp(h)
-	if err != nil {
+	if delta, err = nc.getExtendTimestamp(h, delta); err != nil {
 		return err
 	}
+	h.Timestamp += delta
+	h.timestampDelta = delta
 
 	return nil
 }
@@ -503,30 +974,53 @@ func (nc *NetConnection) chunkType2(h *ChunkHeader) error {
 	if err != nil {
 		return err
 	}
+	delta := utils.BigEndian.Uint24(b3)
 
-	h.Timestamp += binary.BigEndian.Uint32(b3)
-
-	if err = nc.getExtendTimestamp(h); err != nil {
+	if delta, err = nc.getExtendTimestamp(h, delta); err != nil {
 		return err
 	}
+	h.Timestamp += delta
+	h.timestampDelta = delta
 
 	return nil
 }
 
-func (nc *NetConnection) getExtendTimestamp(h *ChunkHeader) error {
-	b4 := mem_pool.GetSlice(4)
-	defer mem_pool.RecycleSlice(b4)
-	// 判断是否要读取ExtendTimestamp中的值
-	if h.Timestamp == 0xfffff {
+// chunkType3 没有MessageHeader 若是一个新的消息 时间戳要加上上一次的时间差.
+func (nc *NetConnection) chunkType3(h *ChunkHeader, newMessage bool) error {
+	// 上一个chunk使用了ExtendTimestamp 那么fmt=3的chunk也会带上ExtendTimestamp
+	if h.ExtendTimestamp != 0 {
+		b4 := mem_pool.GetSlice(4)
+		defer mem_pool.RecycleSlice(b4)
 		if _, err := nc.readFull(b4); err != nil {
 			return err
 		}
-		h.ExtendTimestamp = binary.BigEndian.Uint32(b4)
+	}
+
+	if newMessage {
+		h.Timestamp += h.timestampDelta
 	}
 
 	return nil
 }
 
+// getExtendTimestamp 若timestamp为0xffffff 那么真正的时间戳在后面的4byte中.
+func (nc *NetConnection) getExtendTimestamp(h *ChunkHeader, timestamp uint32) (uint32, error) {
+	h.ExtendTimestamp = 0
+	// 判断是否要读取ExtendTimestamp中的值
+	if timestamp != RtmpMaxTimestamp {
+		return timestamp, nil
+	}
+
+	b4 := mem_pool.GetSlice(4)
+	defer mem_pool.RecycleSlice(b4)
+	if _, err := nc.readFull(b4); err != nil {
+		return 0, err
+	}
+	h.ExtendTimestamp = binary.BigEndian.Uint32(b4)
+
+	return h.ExtendTimestamp, nil
+}
+
 func (nc *NetConnection) getChunkStreamID(csid uint32) (uint32, error) {
 	chunkStreamID := csid
 
@@ -574,17 +1068,32 @@ func (nc *NetConnection) writeMessage(t byte, en MessageEncode) error {
 		head.MessageStreamID = sid.GetStreamID()
 	}
 
+	if ts, ok := en.(HaveTimestamp); ok {
+		head.Timestamp = ts.GetTimestamp()
+	}
+
+	nc.writeLock.Lock()
+	defer nc.writeLock.Unlock()
+
 	if nc.writeSeqNum > nc.bandwith {
 		nc.totalWrite += nc.writeSeqNum
 		nc.writeSeqNum = 0
-		if err := nc.SendMessage(SendAckMessage, nc.totalWrite); err != nil {
+		if err := nc.writeChunks(newChunkHeaderFromMessageType(RtmpMsgAck), Uint32Message(nc.totalWrite).Encode()); err != nil {
 			return err
 		}
-		if err := nc.SendMessage(SendPingRequestMessage, nil); err != nil {
+		ping := &PingRequestMessage{UserControlMessage{EventType: RtmpUserPingRequest}, 0}
+		if err := nc.writeChunks(newChunkHeaderFromMessageType(RtmpMsgUserControl), ping.Encode()); err != nil {
 			return err
 		}
 	}
 
+	return nc.writeChunks(head, body)
+}
+
+// writeChunks 需要持有 writeLock.
+func (nc *NetConnection) writeChunks(head *ChunkHeader, body []byte) error {
+	head.MessageLength = uint32(len(body))
+
 	// 这里根据ChunkType的不同 也会有不同大小的ChunkHead
 	// 分为 12 8 4 1 这些数字指的都是ChunkHeader的大小
 	// 开始我们先使用12byte 的全量包发，若发不完就需要分包，这时就需要使用 1byte的ChunkHeader发送直到发完
@@ -594,19 +1103,11 @@ func (nc *NetConnection) writeMessage(t byte, en MessageEncode) error {
 		return err
 	}
 
-	if err := nc.rw.Flush(); err != nil {
-		return err
-	}
-
 	for need != nil {
 		if need, err = nc.encodeChunk1(head, need, nc.writeChunkSize); err != nil {
 			return err
 		}
-
-		if err = nc.rw.Flush(); err != nil {
-			return err
-		}
 	}
 
-	return nil
+	return nc.rw.Flush()
 }
@@ -1,5 +1,297 @@
 package main
 
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// NetStream 客户端通过 createStream 创建的消息流 一个连接上可以有多个
+// 每个NetStream 要么用来发布 要么用来播放.
+type NetStream struct {
+	nc       *NetConnection
+	streamID uint32
+	// 控制接口在其他goroutine中重定向 需要持有lock修改 stream streamName log
+	lock       sync.Mutex
+	log        Logger
+	streamName string
+	stream     *Stream
+	publishing bool
+	subscriber *Subscriber
+	done       chan struct{}
+
+	// 发布或者播放时的鉴权请求 结束时的回调使用
+	authReq *AuthRequest
+}
+
+func newNetStream(nc *NetConnection, streamID uint32) *NetStream {
+	return &NetStream{
+		nc:       nc,
+		streamID: streamID,
+		done:     make(chan struct{}),
+	}
+}
+
+// Close 实现 Publisher 关闭发布端所在的连接.
+func (ns *NetStream) Close() error {
+	return ns.nc.Close()
+}
+
+// RemoteAddr 发布端的地址.
+func (ns *NetStream) RemoteAddr() string {
+	return ns.nc.RemoteAddr()
+}
+
+// splitStreamName 流名后面可能带有参数 例如 live?token=xxx.
+func splitStreamName(name string) (string, string) {
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return name, ""
+}
+
+// safeName 流名和app实例会作为录制文件的路径 不能包含 .. 路径分隔符和NUL.
+func safeName(s string) bool {
+	return !strings.Contains(s, "..") && !strings.ContainsAny(s, "/\\\x00")
+}
+
+func (ns *NetStream) sendOnStatus(level, code, description string) error {
+	return ns.nc.SendMessage(SendOnStatusMessage, newOnStatusMessage(ns.streamID, level, code, description))
+}
+
+func (ns *NetStream) current() *Stream {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	return ns.stream
+}
+
+func (ns *NetStream) publish(m *PublishMessage) error {
+	if ns.current() != nil {
+		return ns.sendOnStatus(LevelError, NetStreamPublishBadName, "NetStream is already in use")
+	}
+
+	name, query := splitStreamName(m.PublishingName)
+	app := conf().App(ns.nc.vhost, ns.nc.appName)
+	if !app.CanPublish() {
+		return ns.sendOnStatus(LevelError, NetStreamPublishBadName, "publish is not allowed on "+ns.nc.appName)
+	}
+	if !checkAccess(app.Access.Publish, ns.nc.ClientIP()) {
+		return ns.sendOnStatus(LevelError, NetStreamPublishBadName, "access denied")
+	}
+	req := newAuthRequest(ns.nc, AuthActionPublish, name, query)
+	if err := authenticate(req); err != nil {
+		var redirect *HookRedirect
+		if !errors.As(err, &redirect) {
+			return ns.sendOnStatus(LevelError, NetStreamPublishBadName, err.Error())
+		}
+		name = redirect.Stream
+		req.Stream = name
+	}
+	if app, instance := splitAppInstance(ns.nc.appName); !safeName(name) || !safeName(app) || !safeName(instance) {
+		return ns.sendOnStatus(LevelError, NetStreamPublishBadName, "invalid stream name "+name)
+	}
+
+	s, err := streamManager.Publish(ns.nc.vhost, ns.nc.appName, name, ns)
+	if err != nil {
+		return ns.sendOnStatus(LevelError, NetStreamPublishBadName, err.Error())
+	}
+	ns.lock.Lock()
+	ns.stream = s
+	ns.streamName = name
+	ns.publishing = true
+	ns.authReq = req
+	ns.log = ns.nc.log.With("stream", name)
+	ns.log.Info("publish started")
+	ns.lock.Unlock()
+
+	if err = ns.nc.SendMessage(SendStreamBeginMessage, ns.streamID); err != nil {
+		return err
+	}
+
+	return ns.sendOnStatus(LevelStatus, NetStreamPublishStart, name+" is now published")
+}
+
+// writePacket 发布端发送过来的音视频数据 写入到直播流中.
+func (ns *NetStream) writePacket(msg *Chunk) {
+	if !ns.publishing {
+		return
+	}
+
+	p := newAVPacket(msg)
+	if p == nil {
+		return
+	}
+
+	ns.current().WritePacket(p)
+}
+
+func (ns *NetStream) play(m *PlayMessage) error {
+	if ns.current() != nil {
+		return errors.Errorf("NetStream %d is already in use", ns.streamID)
+	}
+
+	name, query := splitStreamName(m.StreamName)
+	app := conf().App(ns.nc.vhost, ns.nc.appName)
+	if !app.CanPlay() {
+		return ns.sendOnStatus(LevelError, NetStreamPlayFailed, "play is not allowed on "+ns.nc.appName)
+	}
+	if !checkAccess(app.Access.Play, ns.nc.ClientIP()) {
+		return ns.sendOnStatus(LevelError, NetStreamPlayFailed, "access denied")
+	}
+	req := newAuthRequest(ns.nc, AuthActionPlay, name, query)
+	if err := authenticate(req); err != nil {
+		return ns.sendOnStatus(LevelError, NetStreamPlayFailed, err.Error())
+	}
+	if err := ns.nc.SendMessage(SendStreamBeginMessage, ns.streamID); err != nil {
+		return err
+	}
+	if err := ns.sendOnStatus(LevelStatus, NetStreamPlayReset, "Playing and resetting "+name); err != nil {
+		return err
+	}
+	if err := ns.sendOnStatus(LevelStatus, NetStreamPlayStart, "Started playing "+name); err != nil {
+		return err
+	}
+
+	amf := NewAMFEncode()
+	_ = amf.writeString("|RtmpSampleAccess")
+	_ = amf.writeBool(true)
+	_ = amf.writeBool(true)
+	if err := ns.nc.writeMessage(RtmpMsgAMF0Data, &AVMessage{StreamID: ns.streamID, Payload: amf.Bytes()}); err != nil {
+		return err
+	}
+
+	sub := newSubscriber(ns.nc.RemoteAddr())
+	s := streamManager.Subscribe(ns.nc.vhost, ns.nc.appName, name, sub)
+	ns.lock.Lock()
+	ns.authReq = req
+	ns.streamName = name
+	ns.subscriber = sub
+	ns.stream = s
+	ns.log = ns.nc.log.With("stream", name)
+	ns.log.Info("play started")
+	ns.lock.Unlock()
+
+	go ns.sendPackets(sub)
+
+	return nil
+}
+
+// sendPackets 将订阅到的数据发送给播放端 在单独的goroutine中运行.
+func (ns *NetStream) sendPackets(sub *Subscriber) {
+	for {
+		select {
+		case p := <-sub.Packets():
+			if len(p.Payload) == 0 {
+				continue
+			}
+
+			err := ns.nc.writeMessage(p.Type, &AVMessage{
+				Timestamp: p.Timestamp,
+				StreamID:  ns.streamID,
+				Payload:   p.Payload,
+			})
+			if err != nil {
+				_ = ns.nc.Close()
+
+				return
+			}
+		case <-ns.done:
+			return
+		}
+	}
+}
+
+func (ns *NetStream) notifyDone(action string) {
+	if ns.authReq == nil {
+		return
+	}
+
+	e := newHookEvent(action, ns.authReq)
+	e.BytesIn = ns.nc.BytesIn()
+	e.BytesOut = ns.nc.BytesOut()
+	notifyHook(action, e)
+}
+
+func (ns *NetStream) close() {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	if ns.stream == nil {
+		return
+	}
+
+	if ns.publishing {
+		streamManager.Unpublish(ns.stream, ns)
+		ns.publishing = false
+		ns.notifyDone(HookOnPublishDone)
+		ns.log.Info("publish stopped")
+	}
+
+	if ns.subscriber != nil {
+		streamManager.Unsubscribe(ns.stream, ns.subscriber)
+		close(ns.done)
+		ns.log.Info("play stopped", "dropped", ns.stream.Dropped(ns.subscriber))
+		ns.subscriber = nil
+		ns.notifyDone(HookOnPlayDone)
+	}
+
+	ns.stream = nil
+}
+
+// redirect 把正在发布或者播放的流切换到同一个app中的另一路流 可以在其他goroutine中调用.
+func (ns *NetStream) redirect(name string) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	old := ns.stream
+	if old == nil {
+		return errors.Errorf("NetStream %d is not publishing or playing", ns.streamID)
+	}
+	if name == ns.streamName {
+		return nil
+	}
+
+	if ns.publishing {
+		s, err := streamManager.Publish(old.Vhost, old.App, name, ns)
+		if err != nil {
+			return err
+		}
+		// 发布端不会再发送 sequence header 从原来的流中复制过去
+		metaData, video, audio := old.SequenceHeaders()
+		for _, p := range []*AVPacket{metaData, video, audio} {
+			if p != nil {
+				s.WritePacket(p)
+			}
+		}
+		streamManager.Unpublish(old, ns)
+		ns.stream = s
+	} else {
+		streamManager.Unsubscribe(old, ns.subscriber)
+		ns.stream = streamManager.Subscribe(old.Vhost, old.App, name, ns.subscriber)
+	}
+
+	ns.log.Info("redirected by control", "to", name)
+	ns.log = ns.nc.log.With("stream", name)
+	ns.streamName = name
+	if ns.authReq != nil {
+		req := *ns.authReq
+		req.Stream = name
+		ns.authReq = &req
+	}
+
+	if ns.publishing {
+		return nil
+	}
+	if err := ns.sendOnStatus(LevelStatus, NetStreamPlayReset, "Playing and resetting "+name); err != nil {
+		return err
+	}
+
+	return ns.sendOnStatus(LevelStatus, NetStreamPlayStart, "Started playing "+name)
+}
+
 //
 //func processStream(nc *bufio.ReadWriter) (*Chunk, error) {
 //
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProbeGapThreshold 相邻两帧的时间戳差超过这个值 认为是一个间断.
+const ProbeGapThreshold = 1000
+
+// ProbeTrack 一个音频或视频轨的统计.
+type ProbeTrack struct {
+	Codec   string `json:"codec"`
+	Profile string `json:"profile,omitempty"`
+	Compat  int    `json:"compat,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+
+	SampleRate int `json:"sample_rate,omitempty"`
+	Channels   int `json:"channels,omitempty"`
+
+	Frames       int     `json:"frames"`
+	Bytes        int64   `json:"bytes"`
+	BitrateKbps  float64 `json:"bitrate_kbps"`
+	FrameRate    float64 `json:"frame_rate,omitempty"`
+	KeyFrames    int     `json:"key_frames,omitempty"`
+	KeyFrameMs   float64 `json:"keyframe_interval_ms,omitempty"`
+	FirstTs      uint32  `json:"first_timestamp"`
+	LastTs       uint32  `json:"last_timestamp"`
+	Gaps         int     `json:"gaps"`
+	MaxGapMs     uint32  `json:"max_gap_ms"`
+	Backwards    int     `json:"backwards"`
+	lastKeyFrame uint32
+	keyFrameSum  uint32
+}
+
+// ProbeReport probe 的结果.
+type ProbeReport struct {
+	URL      string      `json:"url"`
+	Seconds  float64     `json:"seconds"`
+	MetaData AMFObjects  `json:"metadata,omitempty"`
+	Video    *ProbeTrack `json:"video,omitempty"`
+	Audio    *ProbeTrack `json:"audio,omitempty"`
+	// 最后的音视频时间戳差 和这个差值在探测期间的变化
+	AVOffsetMs int64 `json:"av_offset_ms"`
+	AVDriftMs  int64 `json:"av_drift_ms"`
+
+	firstOffset    int64
+	firstOffsetSet bool
+}
+
+func (r *ProbeReport) track(p *AVPacket) *ProbeTrack {
+	if p.IsVideo() {
+		if r.Video == nil {
+			r.Video = &ProbeTrack{Codec: codecName(flvVideoCodecNames, p.Payload[0]&0x0f)}
+		}
+
+		return r.Video
+	}
+
+	if r.Audio == nil {
+		r.Audio = &ProbeTrack{Codec: codecName(flvAudioCodecNames, p.Payload[0]>>4)}
+		// 非AAC的采样率和声道从tag头中获取
+		r.Audio.SampleRate = []int{5500, 11025, 22050, 44100}[(p.Payload[0]>>2)&0x03]
+		r.Audio.Channels = int(p.Payload[0]&0x01) + 1
+	}
+
+	return r.Audio
+}
+
+func (r *ProbeReport) handle(p *AVPacket) {
+	if len(p.Payload) == 0 {
+		return
+	}
+
+	if p.IsMetaData() {
+		data := decodeDataAMF0(p.Payload)
+		if len(data.Values) > 0 {
+			if obj := DecodeAMFObject(data.Values[0]); obj != nil {
+				r.MetaData = obj
+			}
+		}
+
+		return
+	}
+
+	if !p.IsVideo() && !p.IsAudio() {
+		return
+	}
+
+	t := r.track(p)
+	if p.IsSequenceHeader() {
+		r.handleSequenceHeader(t, p)
+
+		return
+	}
+
+	if t.Frames > 0 {
+		switch {
+		case p.Timestamp < t.LastTs:
+			t.Backwards++
+		case p.Timestamp-t.LastTs > ProbeGapThreshold:
+			t.Gaps++
+		}
+		if p.Timestamp > t.LastTs && p.Timestamp-t.LastTs > t.MaxGapMs {
+			t.MaxGapMs = p.Timestamp - t.LastTs
+		}
+	} else {
+		t.FirstTs = p.Timestamp
+	}
+	t.LastTs = p.Timestamp
+	t.Frames++
+	t.Bytes += int64(len(p.Payload))
+
+	if p.IsVideo() && p.IsKeyFrame() {
+		if t.KeyFrames > 0 && p.Timestamp > t.lastKeyFrame {
+			t.keyFrameSum += p.Timestamp - t.lastKeyFrame
+		}
+		t.KeyFrames++
+		t.lastKeyFrame = p.Timestamp
+	}
+
+	if r.Video != nil && r.Audio != nil && r.Video.Frames > 0 && r.Audio.Frames > 0 {
+		r.AVOffsetMs = int64(r.Video.LastTs) - int64(r.Audio.LastTs)
+		if !r.firstOffsetSet {
+			r.firstOffset = r.AVOffsetMs
+			r.firstOffsetSet = true
+		}
+		r.AVDriftMs = r.AVOffsetMs - r.firstOffset
+	}
+}
+
+func (r *ProbeReport) handleSequenceHeader(t *ProbeTrack, p *AVPacket) {
+	if p.IsVideo() {
+		if len(p.Payload) < 5 {
+			return
+		}
+		avc, err := ParseAVCDecoderConfigurationRecord(p.Payload[5:])
+		if err != nil {
+			return
+		}
+		t.Profile = codecName(avcProfileNames, avc.ProfileIndication)
+		t.Compat = int(avc.ProfileCompatibility)
+		t.Level = fmt.Sprintf("%.1f", float64(avc.LevelIndication)/10)
+		t.Width, t.Height = avc.Width, avc.Height
+
+		return
+	}
+
+	aac, err := ParseAudioSpecificConfig(p.Payload[2:])
+	if err != nil {
+		return
+	}
+	t.Profile = codecName(aacObjectTypeNames, byte(aac.ObjectType))
+	t.SampleRate = aac.SampleRate
+	t.Channels = aac.ChannelCount
+}
+
+// finish 根据探测的时长计算码率和帧率.
+func (r *ProbeReport) finish(elapsed time.Duration) {
+	r.Seconds = elapsed.Seconds()
+
+	for _, t := range []*ProbeTrack{r.Video, r.Audio} {
+		if t == nil {
+			continue
+		}
+
+		// 码率按照媒体时间计算 没有时间跨度时使用探测时长
+		span := float64(t.LastTs-t.FirstTs) / 1000
+		if span <= 0 {
+			span = r.Seconds
+		}
+		if span > 0 {
+			t.BitrateKbps = float64(t.Bytes) * 8 / 1000 / span
+			if t == r.Video && t.Frames > 1 {
+				t.FrameRate = float64(t.Frames-1) / span
+			}
+		}
+		if t.KeyFrames > 1 {
+			t.KeyFrameMs = float64(t.keyFrameSum) / float64(t.KeyFrames-1)
+		}
+	}
+}
+
+func (r *ProbeReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "url: %s\n", r.URL)
+	fmt.Fprintf(w, "probed: %.1fs\n", r.Seconds)
+
+	if len(r.MetaData) > 0 {
+		fmt.Fprintln(w, "metadata:")
+		keys := make([]string, 0, len(r.MetaData))
+		for k := range r.MetaData {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s: %v\n", k, r.MetaData[k])
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		track *ProbeTrack
+	}{{"video", r.Video}, {"audio", r.Audio}} {
+		if t.track == nil {
+			continue
+		}
+
+		tr := t.track
+		var params []string
+		if tr.Profile != "" {
+			params = append(params, tr.Profile)
+		}
+		if tr.Level != "" {
+			params = append(params, "level "+tr.Level)
+		}
+		if tr.Width > 0 {
+			params = append(params, fmt.Sprintf("%dx%d", tr.Width, tr.Height))
+		}
+		if tr.SampleRate > 0 {
+			params = append(params, fmt.Sprintf("%dHz %dch", tr.SampleRate, tr.Channels))
+		}
+
+		fmt.Fprintf(w, "%s: %s %s\n", t.name, tr.Codec, strings.Join(params, ", "))
+		fmt.Fprintf(w, "  frames: %d, bitrate: %.0fkbps", tr.Frames, tr.BitrateKbps)
+		if tr.FrameRate > 0 {
+			fmt.Fprintf(w, ", fps: %.2f", tr.FrameRate)
+		}
+		if tr.KeyFrameMs > 0 {
+			fmt.Fprintf(w, ", keyframe interval: %.0fms", tr.KeyFrameMs)
+		}
+		fmt.Fprintf(w, "\n  timestamps: %d..%d, gaps: %d, max gap: %dms, backwards: %d\n",
+			tr.FirstTs, tr.LastTs, tr.Gaps, tr.MaxGapMs, tr.Backwards)
+	}
+
+	if r.Video != nil && r.Audio != nil {
+		fmt.Fprintf(w, "a/v offset: %dms, drift: %dms\n", r.AVOffsetMs, r.AVDriftMs)
+	}
+}
+
+// runProbe probe 子命令 播放一段时间 输出流的信息
+//
+//	rtmp probe [flags] <rtmp://host/app/stream>
+func runProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	seconds := fs.Duration("t", 5*time.Second, "how long to probe")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	timeout := fs.Duration("timeout", 10*time.Second, "connect timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmp probe [flags] <rtmp://host/app/stream>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+
+		return errors.New("need url")
+	}
+	url := fs.Arg(0)
+
+	// 报告输出到标准输出 其他的打印都改到标准错误
+	out := os.Stdout
+	os.Stdout = os.Stderr
+
+	opts := defaultClientOptions()
+	opts.Timeout = *timeout
+	client, err := DialRtmpWithOptions(url, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Play(); err != nil {
+		return err
+	}
+
+	report := &ProbeReport{URL: url}
+	start := time.Now()
+	deadline := start.Add(*seconds)
+	_ = client.conn.SetReadDeadline(deadline)
+
+	for time.Now().Before(deadline) {
+		p, err := client.ReadPacket()
+		if err != nil {
+			break
+		}
+
+		report.handle(p)
+	}
+	report.finish(time.Since(start))
+
+	if report.Video == nil && report.Audio == nil && report.MetaData == nil {
+		return errors.New("no data received")
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(report)
+	}
+
+	report.writeText(out)
+
+	return nil
+}
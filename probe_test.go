@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeCodecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []*AVPacket
+		video   *ProbeTrack
+		audio   *ProbeTrack
+	}{
+		{
+			name: "avc aac",
+			packets: []*AVPacket{
+				{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()},
+				{Type: RtmpMsgAudio, Payload: []byte{0xaf, 0, 0x12, 0x10}},
+				{Type: RtmpMsgVideo, Payload: testVideoFrame(true)},
+				{Type: RtmpMsgAudio, Payload: []byte{0xaf, 1, 1, 2}},
+			},
+			video: &ProbeTrack{Codec: "H.264", Profile: "High", Level: "3.1", Width: 1280, Height: 720},
+			audio: &ProbeTrack{Codec: "AAC", Profile: "LC", SampleRate: 44100, Channels: 2},
+		},
+		{
+			name:    "aac 48k",
+			packets: []*AVPacket{{Type: RtmpMsgAudio, Payload: []byte{0xaf, 0, 0x11, 0x90}}},
+			audio:   &ProbeTrack{Codec: "AAC", Profile: "LC", SampleRate: 48000, Channels: 2},
+		},
+		{
+			// 非AAC的采样率和声道从tag头中获取
+			name:    "mp3 mono",
+			packets: []*AVPacket{{Type: RtmpMsgAudio, Payload: []byte{0x2e, 1, 2}}},
+			audio:   &ProbeTrack{Codec: "MP3", SampleRate: 44100, Channels: 1},
+		},
+		{
+			name:    "nellymoser 22k stereo",
+			packets: []*AVPacket{{Type: RtmpMsgAudio, Payload: []byte{0x6b, 1, 2}}},
+			audio:   &ProbeTrack{Codec: "Nellymoser", SampleRate: 22050, Channels: 2},
+		},
+		{
+			name:    "h263",
+			packets: []*AVPacket{{Type: RtmpMsgVideo, Payload: []byte{0x22, 1, 2}}},
+			video:   &ProbeTrack{Codec: "H.263"},
+		},
+		{
+			name:    "unknown video codec",
+			packets: []*AVPacket{{Type: RtmpMsgVideo, Payload: []byte{0x1e, 1, 2}}},
+			video:   &ProbeTrack{Codec: "unknown(14)"},
+		},
+		{
+			// 不完整的 sequence header 只有编码 没有参数
+			name:    "truncated avc sequence header",
+			packets: []*AVPacket{{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()[:8]}},
+			video:   &ProbeTrack{Codec: "H.264"},
+		},
+	}
+
+	for _, tt := range tests {
+		r := &ProbeReport{}
+		for _, p := range tt.packets {
+			r.handle(p)
+		}
+
+		for _, c := range []struct {
+			kind      string
+			got, want *ProbeTrack
+		}{{"video", r.Video, tt.video}, {"audio", r.Audio, tt.audio}} {
+			if c.want == nil {
+				if c.got != nil {
+					t.Errorf("%s: unexpected %s track %+v", tt.name, c.kind, c.got)
+				}
+
+				continue
+			}
+			if c.got == nil {
+				t.Errorf("%s: no %s track", tt.name, c.kind)
+
+				continue
+			}
+			g, w := c.got, c.want
+			if g.Codec != w.Codec || g.Profile != w.Profile || g.Level != w.Level || g.Width != w.Width || g.Height != w.Height ||
+				g.SampleRate != w.SampleRate || g.Channels != w.Channels {
+				t.Errorf("%s: %s track is %+v, want %+v", tt.name, c.kind, g, w)
+			}
+		}
+	}
+}
+
+func TestProbeTimestamps(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		keyFrames  map[uint32]bool
+		gaps       int
+		maxGap     uint32
+		backwards  int
+		frameRate  float64
+		keyFrameMs float64
+	}{
+		{
+			name:       "steady",
+			timestamps: []uint32{0, 40, 80, 120, 160, 200, 240, 280, 320, 360},
+			keyFrames:  map[uint32]bool{0: true, 200: true},
+			maxGap:     40,
+			frameRate:  25,
+			keyFrameMs: 200,
+		},
+		{
+			name:       "gap",
+			timestamps: []uint32{0, 40, 1200, 1240},
+			gaps:       1,
+			maxGap:     1160,
+			frameRate:  3 / 1.24,
+		},
+		{
+			// 正好等于阈值的不算间断
+			name:       "threshold",
+			timestamps: []uint32{0, ProbeGapThreshold},
+			maxGap:     ProbeGapThreshold,
+			frameRate:  1,
+		},
+		{
+			name:       "backwards",
+			timestamps: []uint32{0, 40, 20, 60},
+			backwards:  1,
+			maxGap:     40,
+			frameRate:  3 / 0.06,
+		},
+		{
+			name:       "keyframe interval",
+			timestamps: []uint32{0, 1000, 2000, 4000},
+			keyFrames:  map[uint32]bool{0: true, 2000: true, 4000: true},
+			gaps:       1,
+			maxGap:     2000,
+			frameRate:  0.75,
+			keyFrameMs: 2000,
+		},
+	}
+
+	for _, tt := range tests {
+		r := &ProbeReport{}
+		r.handle(&AVPacket{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()})
+		for _, ts := range tt.timestamps {
+			r.handle(&AVPacket{Type: RtmpMsgVideo, Timestamp: ts, Payload: testVideoFrame(tt.keyFrames[ts])})
+		}
+		r.finish(time.Second)
+
+		v := r.Video
+		if v.Frames != len(tt.timestamps) || v.FirstTs != tt.timestamps[0] || v.LastTs != tt.timestamps[len(tt.timestamps)-1] {
+			t.Errorf("%s: frames %d timestamps %d..%d", tt.name, v.Frames, v.FirstTs, v.LastTs)
+		}
+		if v.Gaps != tt.gaps || v.MaxGapMs != tt.maxGap || v.Backwards != tt.backwards {
+			t.Errorf("%s: gaps %d max %d backwards %d", tt.name, v.Gaps, v.MaxGapMs, v.Backwards)
+		}
+		if diff := v.FrameRate - tt.frameRate; diff > 0.01 || diff < -0.01 {
+			t.Errorf("%s: frame rate %f, want %f", tt.name, v.FrameRate, tt.frameRate)
+		}
+		if v.KeyFrameMs != tt.keyFrameMs {
+			t.Errorf("%s: keyframe interval %f, want %f", tt.name, v.KeyFrameMs, tt.keyFrameMs)
+		}
+	}
+}
+
+func TestProbeAVOffset(t *testing.T) {
+	r := &ProbeReport{}
+	r.handle(&AVPacket{Type: RtmpMsgAMF0Data, Payload: testOnMetaData()})
+	if r.MetaData["width"] != float64(1280) {
+		t.Errorf("metadata %v", r.MetaData)
+	}
+
+	// 音频比视频落后 并且越来越多
+	packets := []*AVPacket{
+		{Type: RtmpMsgVideo, Timestamp: 0, Payload: testVideoFrame(true)},
+		{Type: RtmpMsgAudio, Timestamp: 0, Payload: []byte{0xaf, 1, 1}},
+		{Type: RtmpMsgVideo, Timestamp: 100, Payload: testVideoFrame(false)},
+		{Type: RtmpMsgAudio, Timestamp: 80, Payload: []byte{0xaf, 1, 1}},
+		{Type: RtmpMsgVideo, Timestamp: 200, Payload: testVideoFrame(false)},
+		{Type: RtmpMsgAudio, Timestamp: 150, Payload: []byte{0xaf, 1, 1}},
+	}
+	for _, p := range packets {
+		r.handle(p)
+	}
+	if r.AVOffsetMs != 50 || r.AVDriftMs != 50 {
+		t.Errorf("offset %d drift %d", r.AVOffsetMs, r.AVDriftMs)
+	}
+
+	// 码率按照媒体时间 150ms 内3个3byte的包计算
+	r.finish(time.Second)
+	if r.Audio.BitrateKbps != float64(9*8)/1000/0.15 {
+		t.Errorf("audio bitrate %f", r.Audio.BitrateKbps)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PROXY protocol v2 中的 TLV 类型.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1 的头最长 107 字节.
+const proxyV1MaxLen = 107
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ProxyHeader 负载均衡发送的 PROXY 头 Local 为 true 时是负载均衡自己的连接 比如健康检查 没有地址.
+type ProxyHeader struct {
+	Version int
+	Local   bool
+	Source  net.Addr
+	Dest    net.Addr
+	TLVs    map[byte][]byte
+}
+
+// readProxyHeader 读取 v1 或者 v2 的 PROXY 头 不是 PROXY 头时返回 nil 不消耗数据.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyV1Prefix[0]:
+		if b, err = r.Peek(len(proxyV1Prefix)); err != nil || !bytes.Equal(b, proxyV1Prefix) {
+			return nil, err
+		}
+
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		if b, err = r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, err
+		}
+
+		return readProxyV2(r)
+	}
+
+	return nil, nil
+}
+
+// readProxyV1 "PROXY TCP4 1.2.3.4 5.6.7.8 1111 1935\r\n" 或者 "PROXY UNKNOWN ...\r\n".
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "read proxy v1 header")
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("proxy v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("invalid proxy v1 header %q", line)
+	}
+
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Dest = src, dst
+
+	return h, nil
+}
+
+func parseProxyV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.Errorf("invalid proxy v1 address %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("invalid proxy v1 port %s", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 12字节签名 版本和命令 地址族和协议 2字节长度 之后是地址和 TLV.
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.Wrap(err, "read proxy v2 header")
+	}
+	if head[12]>>4 != 2 {
+		return nil, errors.Errorf("invalid proxy v2 version %d", head[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "read proxy v2 header")
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch head[12] & 0xf {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, errors.Errorf("invalid proxy v2 command %d", head[12]&0xf)
+	}
+
+	// 地址的长度由地址族决定 UDP 和 UNIX 的地址也需要跳过才能读到 TLV
+	var addrLen, ipLen int
+	switch head[13] >> 4 {
+	case 1:
+		addrLen, ipLen = 12, net.IPv4len
+	case 2:
+		addrLen, ipLen = 36, net.IPv6len
+	case 3:
+		addrLen = 216
+	}
+	// 只处理 TCP over IPv4 IPv6 其他的当作 LOCAL 使用连接本身的地址
+	if head[13] != 0x11 && head[13] != 0x21 {
+		h.Local = true
+	}
+	if len(body) < addrLen {
+		return nil, errors.Errorf("proxy v2 address too short %d", len(body))
+	}
+	if addrLen > 0 && !h.Local {
+		a := body[:addrLen]
+		h.Source = &net.TCPAddr{IP: net.IP(append([]byte(nil), a[:ipLen]...)), Port: int(binary.BigEndian.Uint16(a[2*ipLen:]))}
+		h.Dest = &net.TCPAddr{IP: net.IP(append([]byte(nil), a[ipLen:2*ipLen]...)), Port: int(binary.BigEndian.Uint16(a[2*ipLen+2:]))}
+	}
+
+	tlvs, err := parseProxyTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+
+	// 有 CRC32C 时校验整个头 校验时 CRC 字段按照0计算
+	if crc, ok := tlvs[ProxyTLVCRC32C]; ok {
+		if len(crc) != 4 {
+			return nil, errors.New("invalid proxy v2 crc32c length")
+		}
+		want := binary.BigEndian.Uint32(crc)
+		for i := range crc {
+			crc[i] = 0
+		}
+		sum := crc32.Update(crc32.Checksum(head, castagnoli), castagnoli, body)
+		binary.BigEndian.PutUint32(crc, want)
+		if sum != want {
+			return nil, errors.Errorf("proxy v2 crc32c mismatch %08x %08x", sum, want)
+		}
+	}
+
+	return h, nil
+}
+
+// parseProxyTLVs 每个 TLV 为 1字节类型 2字节长度 和值 值直接引用 data.
+func parseProxyTLVs(data []byte) (map[byte][]byte, error) {
+	tlvs := make(map[byte][]byte)
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errors.New("proxy v2 tlv truncated")
+		}
+		n := int(binary.BigEndian.Uint16(data[1:]))
+		if len(data) < 3+n {
+			return nil, errors.Errorf("proxy v2 tlv 0x%02x truncated", data[0])
+		}
+		if data[0] != ProxyTLVNoop {
+			tlvs[data[0]] = data[3 : 3+n]
+		}
+		data = data[3+n:]
+	}
+
+	return tlvs, nil
+}
+
+// proxyConn 第一次读数据或者获取地址时读取 PROXY 头 在处理连接的协程中执行 不阻塞 Accept.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+		}
+
+		c.header, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			logger().Info("proxy protocol header invalid", "remote", c.Conn.RemoteAddr().String(), "err", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr 有 PROXY 头时返回客户端的真实地址.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Dest != nil {
+		return c.header.Dest
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// Header 没有 PROXY 头时为 nil.
+func (c *proxyConn) Header() *ProxyHeader {
+	c.readHeader()
+
+	return c.header
+}
+
+func (c *proxyConn) SetNoDelay(noDelay bool) error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		return tcp.SetNoDelay(noDelay)
+	}
+
+	return nil
+}
+
+// proxyListener 只有来自信任地址的连接才读取 PROXY 头 其他连接原样返回
+// 不信任的地址发送 PROXY 头时握手失败 不能伪造地址.
+type proxyListener struct {
+	net.Listener
+	config func() ProxyProtocolConfig
+}
+
+func newProxyListener(l net.Listener, config func() ProxyProtocolConfig) net.Listener {
+	return &proxyListener{Listener: l, config: config}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := l.config()
+	if !cfg.Enable {
+		return conn, nil
+	}
+
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if !cfg.trusted(ip) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: cfg.Timeout}, nil
+}
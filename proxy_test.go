@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2 生成 TCP over IPv4 的 v2 头 crc 为 true 时附加 CRC32C.
+func proxyV2(src, dst *net.TCPAddr, tlvs map[byte][]byte, crc bool) []byte {
+	body := make([]byte, 12)
+	copy(body, src.IP.To4())
+	copy(body[4:], dst.IP.To4())
+	binary.BigEndian.PutUint16(body[8:], uint16(src.Port))
+	binary.BigEndian.PutUint16(body[10:], uint16(dst.Port))
+	for t, v := range tlvs {
+		body = append(body, t, byte(len(v)>>8), byte(len(v)))
+		body = append(body, v...)
+	}
+	crcAt := 0
+	if crc {
+		crcAt = len(body) + 3
+		body = append(body, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	h := append(append([]byte(nil), proxyV2Signature...), 0x21, 0x11, byte(len(body)>>8), byte(len(body)))
+	h = append(h, body...)
+	if crc {
+		binary.BigEndian.PutUint32(h[16+crcAt:], crc32.Checksum(h, castagnoli))
+	}
+
+	return h
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 1935}
+	valid := proxyV2(src, dst, map[byte][]byte{ProxyTLVAuthority: []byte("live.example.com")}, true)
+	corrupt := append([]byte(nil), valid...)
+	corrupt[16] ^= 0xff
+
+	tests := []struct {
+		name  string
+		data  string
+		src   string
+		local bool
+		err   bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 1935\r\n", "203.0.113.7:51000", false, false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 51000 1935\r\n", "[2001:db8::1]:51000", false, false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", true, false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 10.0.0.1 51000 1935\r\n", "", false, true},
+		{"v1 no crlf", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 1935\n", "", false, true},
+		{"v2 with tlv", string(valid), "203.0.113.7:51000", false, false},
+		{"v2 crc mismatch", string(corrupt), "", false, true},
+		{"v2 local", string(append(append([]byte(nil), proxyV2Signature...), 0x20, 0, 0, 0)), "", true, false},
+		{"not proxy", "\x03rtmp", "", false, false},
+	}
+
+	for _, tt := range tests {
+		r := bufio.NewReader(bytes.NewReader([]byte(tt.data + "\x03")))
+		h, err := readProxyHeader(r)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err is %v", tt.name, err)
+
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if h == nil {
+			if tt.src != "" || tt.local {
+				t.Errorf("%s: header not found", tt.name)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != tt.data+"\x03" {
+				t.Errorf("%s: data consumed", tt.name)
+			}
+
+			continue
+		}
+		if h.Local != tt.local || (h.Source != nil && h.Source.String() != tt.src) {
+			t.Errorf("%s: header is %+v", tt.name, h)
+		}
+		// 头后面的数据不能被读取
+		if b, _ := r.ReadByte(); b != 0x03 {
+			t.Errorf("%s: next byte is %x", tt.name, b)
+		}
+	}
+
+	h, _ := readProxyHeader(bufio.NewReader(bytes.NewReader(valid)))
+	if string(h.TLVs[ProxyTLVAuthority]) != "live.example.com" {
+		t.Errorf("tlvs are %v", h.TLVs)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+
+	cfg := ProxyProtocolConfig{Enable: true, Trusted: []string{"127.0.0.0/8"}, Timeout: time.Second}
+	l := newProxyListener(inner, func() ProxyProtocolConfig { return cfg })
+
+	accept := func(header string) (net.Addr, string) {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte(header + "rtmp"))
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		b := make([]byte, 4)
+		_, _ = conn.Read(b)
+
+		return conn.RemoteAddr(), string(b)
+	}
+
+	if addr, data := accept("PROXY TCP4 203.0.113.7 10.0.0.1 51000 1935\r\n"); addr.String() != "203.0.113.7:51000" || data != "rtmp" {
+		t.Errorf("trusted: addr %s data %q", addr, data)
+	}
+	if addr, _ := accept(""); !addr.(*net.TCPAddr).IP.IsLoopback() {
+		t.Errorf("without header addr is %s", addr)
+	}
+
+	// 不信任的地址 PROXY 头原样交给握手
+	cfg.Trusted = []string{"192.0.2.0/24"}
+	if addr, data := accept("PROXY TCP4 203.0.113.7 10.0.0.1 51000 1935\r\n"); !addr.(*net.TCPAddr).IP.IsLoopback() || data != "PROX" {
+		t.Errorf("untrusted: addr %s data %q", addr, data)
+	}
+}
+
+func TestReadProxyV2Families(t *testing.T) {
+	tests := []struct {
+		name    string
+		family  byte
+		addrLen int
+	}{
+		{"udp4", 0x12, 12},
+		{"udp6", 0x22, 36},
+		{"unix stream", 0x31, 216},
+		{"unix dgram", 0x32, 216},
+	}
+
+	for _, tt := range tests {
+		// 地址需要按照地址族的长度跳过 否则会被当作 TLV 解析
+		body := make([]byte, tt.addrLen)
+		for i := range body {
+			body[i] = byte(i + 1)
+		}
+		body = append(body, ProxyTLVAuthority, 0, 4, 'l', 'i', 'v', 'e')
+		h := append(append([]byte(nil), proxyV2Signature...), 0x21, tt.family, byte(len(body)>>8), byte(len(body)))
+		h = append(h, body...)
+
+		r := bufio.NewReader(bytes.NewReader(append(h, 0x03)))
+		p, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+		if !p.Local || p.Source != nil || len(p.TLVs) != 1 || string(p.TLVs[ProxyTLVAuthority]) != "live" {
+			t.Errorf("%s: header is %+v", tt.name, p)
+		}
+		if b, _ := r.ReadByte(); b != 0x03 {
+			t.Errorf("%s: next byte is %x", tt.name, b)
+		}
+	}
+
+	// 地址族要求的长度不够
+	h := append(append([]byte(nil), proxyV2Signature...), 0x21, 0x31, 0, 12)
+	h = append(h, make([]byte, 12)...)
+	if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(h))); err == nil {
+		t.Error("short unix address accepted")
+	}
+}
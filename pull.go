@@ -0,0 +1,306 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PullDialTimeout = 10 * time.Second
+	// 源站这么长时间没有数据 就认为连接已经断开
+	PullReadTimeout = 30 * time.Second
+)
+
+// PullSource 拉流的数据来源.
+type PullSource interface {
+	ReadPacket() (*AVPacket, error)
+	Close() error
+}
+
+// openPullSource 连接源站并开始播放 支持 rtmp 和 http(s)-flv.
+func openPullSource(rawURL string) (PullSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "rtmp":
+		return openRtmpSource(rawURL)
+	case "http", "https":
+		return openFlvSource(rawURL)
+	}
+
+	return nil, errors.Errorf("not support pull scheme %s", u.Scheme)
+}
+
+func openRtmpSource(rawURL string) (PullSource, error) {
+	client, err := DialRtmp(rawURL, PullDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = client.Play(); err != nil {
+		_ = client.Close()
+
+		return nil, errors.Wrap(err, "play")
+	}
+	client.SetReadTimeout(PullReadTimeout)
+
+	return client, nil
+}
+
+var flvHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: PullDialTimeout,
+		}).DialContext,
+		TLSHandshakeTimeout:   PullDialTimeout,
+		ResponseHeaderTimeout: PullDialTimeout,
+	},
+}
+
+// flvSource HTTP-FLV 拉流 body 是一个不会结束的FLV文件.
+type flvSource struct {
+	body io.ReadCloser
+	r    *FlvReader
+	// 一段时间没有读到数据就关闭 body 这样阻塞的读取会返回错误
+	watchdog *time.Timer
+}
+
+func openFlvSource(rawURL string) (PullSource, error) {
+	resp, err := flvHTTPClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+
+		return nil, errors.Errorf("http status %s", resp.Status)
+	}
+
+	src := &flvSource{
+		body: resp.Body,
+		r:    NewFlvReader(resp.Body),
+	}
+	src.watchdog = time.AfterFunc(PullReadTimeout, func() {
+		_ = src.body.Close()
+	})
+
+	if _, _, err = src.r.ReadHeader(); err != nil {
+		_ = src.Close()
+
+		return nil, errors.Wrap(err, "read flv header")
+	}
+
+	return src, nil
+}
+
+func (src *flvSource) ReadPacket() (*AVPacket, error) {
+	for {
+		src.watchdog.Reset(PullReadTimeout)
+
+		tag, err := src.r.ReadTag()
+		if err != nil {
+			return nil, err
+		}
+
+		if p := tag.Packet(); p != nil {
+			return p, nil
+		}
+	}
+}
+
+func (src *flvSource) Close() error {
+	src.watchdog.Stop()
+
+	return src.body.Close()
+}
+
+// Puller 从源站拉流 作为本地的一路直播流发布 断开后按照指数退避重试 直到 stop.
+type Puller struct {
+	vhost    string
+	app      string
+	name     string
+	url      string
+	retryMin time.Duration
+	retryMax time.Duration
+	done     chan struct{}
+
+	lock sync.Mutex
+	src  PullSource
+}
+
+func newPuller(vhost, app, name, url string, retryMin, retryMax time.Duration) *Puller {
+	return &Puller{
+		vhost:    vhost,
+		app:      app,
+		name:     name,
+		url:      url,
+		retryMin: retryMin,
+		retryMax: retryMax,
+		done:     make(chan struct{}),
+	}
+}
+
+// Close 实现 Publisher 只断开当前的连接 之后会重新拉流.
+func (p *Puller) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.src != nil {
+		return p.src.Close()
+	}
+
+	return nil
+}
+
+// RemoteAddr 拉流的地址.
+func (p *Puller) RemoteAddr() string {
+	return p.url
+}
+
+func (p *Puller) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop 停止拉流 不再重试.
+func (p *Puller) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped() {
+		return
+	}
+	close(p.done)
+	if p.src != nil {
+		_ = p.src.Close()
+	}
+}
+
+func (p *Puller) run() {
+	backoff := p.retryMin
+
+	for {
+		start := time.Now()
+		err := p.pull()
+
+		if p.stopped() {
+			return
+		}
+
+		// 拉流持续了足够长的时间 说明源站是正常的 重新开始计算退避时间
+		if time.Since(start) > p.retryMax {
+			backoff = p.retryMin
+		}
+		logger().Warn("pull failed", "url", p.url, "retry_after", backoff, "err", err)
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.retryMax {
+			backoff = p.retryMax
+		}
+	}
+}
+
+func (p *Puller) pull() error {
+	src, err := openPullSource(p.url)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	p.lock.Lock()
+	if p.stopped() {
+		p.lock.Unlock()
+
+		return nil
+	}
+	p.src = src
+	p.lock.Unlock()
+
+	s, err := streamManager.Publish(p.vhost, p.app, p.name, p)
+	if err != nil {
+		return err
+	}
+	defer streamManager.Unpublish(s, p)
+
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		s.WritePacket(pkt)
+	}
+}
+
+// PullManager 管理配置中一直拉取的流.
+type PullManager struct {
+	lock    sync.Mutex
+	pullers map[string]*Puller
+}
+
+var pullManager = newPullManager()
+
+func newPullManager() *PullManager {
+	return &PullManager{
+		pullers: make(map[string]*Puller),
+	}
+}
+
+// reload 按照配置启动新的拉流 停止已经删除或者地址修改了的拉流.
+func (m *PullManager) reload() {
+	cfg := conf().Pull
+
+	m.lock.Lock()
+	var stopped, started []*Puller
+	want := make(map[string]bool)
+	for _, p := range cfg.Streams {
+		key := streamKey(p.Vhost, p.App, p.Stream)
+		want[key] = true
+
+		if old, ok := m.pullers[key]; ok {
+			if old.url == p.URL {
+				continue
+			}
+			stopped = append(stopped, old)
+		}
+
+		puller := newPuller(p.Vhost, p.App, p.Stream, p.URL, cfg.RetryMin, cfg.RetryMax)
+		m.pullers[key] = puller
+		started = append(started, puller)
+	}
+	for key, p := range m.pullers {
+		if !want[key] {
+			delete(m.pullers, key)
+			stopped = append(stopped, p)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, p := range stopped {
+		p.stop()
+	}
+	for _, p := range started {
+		go p.run()
+	}
+}
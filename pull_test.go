@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPullerHTTPFlvRetry(t *testing.T) {
+	header := flvTestHeader(FlvHeaderSize)
+	seqHeader := flvTestTag(FlvTagVideo, 0, testAVCSequenceHeader())
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		case 3:
+			// 数据不完整 读取失败后重新拉流
+			_, _ = w.Write(append(header, seqHeader[:8]...))
+
+			return
+		}
+
+		_, _ = w.Write(header)
+		_, _ = w.Write(seqHeader)
+		_, _ = w.Write(flvTestTag(FlvTagVideo, 0, testVideoFrame(true)))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	p := newPuller("", "live", "pullflv", srv.URL+"/live/pullflv.flv", 10*time.Millisecond, 20*time.Millisecond)
+	go p.run()
+	defer p.stop()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if s := streamManager.Get("", "live", "pullflv"); s != nil && s.Publisher() == p {
+			if _, video, _ := s.SequenceHeaders(); video != nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("http-flv pull not published")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Errorf("requests %d", n)
+	}
+
+	p.stop()
+	for streamManager.Get("", "live", "pullflv") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not unpublished after stop")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// flvPusher 读取FLV 按照时间戳推送到服务器.
+type flvPusher struct {
+	client   *RtmpClient
+	realtime bool
+	// 第一次推送时从这个时间开始 之前的只发送 metaData 和 sequence header
+	start uint32
+	// 循环推送时 后一次的时间戳接在前一次的后面
+	offset uint32
+	// 最后一个包的时间戳 和前两个包的间隔
+	last  uint32
+	delta uint32
+	// 第一个包发送的时间 用来控制发送速度
+	clock   time.Time
+	packets int
+	readErr chan error
+}
+
+func (p *flvPusher) send(pkt *AVPacket) error {
+	if p.realtime {
+		if p.clock.IsZero() {
+			p.clock = time.Now()
+		}
+		if d := time.Until(p.clock.Add(time.Duration(pkt.Timestamp) * time.Millisecond)); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	select {
+	case err := <-p.readErr:
+		return errors.Wrap(err, "server closed")
+	default:
+	}
+
+	if pkt.Timestamp > p.last {
+		p.delta = pkt.Timestamp - p.last
+		p.last = pkt.Timestamp
+	}
+	p.packets++
+
+	return p.client.WritePacket(pkt)
+}
+
+// pushFile 推送一遍FLV start 只在第一遍时有效.
+func (p *flvPusher) pushFile(r io.Reader, first bool) error {
+	fr := NewFlvReader(r)
+	_, hasVideo, err := fr.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	started := !first || p.start == 0
+	var base uint32
+	baseSet := false
+
+	for {
+		tag, err := fr.ReadTag()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		pkt := tag.Packet()
+		if pkt == nil {
+			continue
+		}
+
+		if pkt.IsMetaData() || pkt.IsSequenceHeader() {
+			pkt.Timestamp = p.offset
+			if err = p.send(pkt); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// 有视频时从关键帧开始 这样播放端才能解码
+		if !started {
+			if pkt.Timestamp < p.start || (hasVideo && !pkt.IsKeyFrame()) {
+				continue
+			}
+			started = true
+		}
+
+		if !baseSet {
+			base = pkt.Timestamp
+			baseSet = true
+		}
+		if pkt.Timestamp < base {
+			pkt.Timestamp = base
+		}
+		pkt.Timestamp = pkt.Timestamp - base + p.offset
+
+		if err = p.send(pkt); err != nil {
+			return err
+		}
+	}
+
+	if p.delta == 0 {
+		p.delta = 40
+	}
+	p.offset = p.last + p.delta
+
+	return nil
+}
+
+// runPush push 子命令 将FLV文件或者标准输入推送到服务器
+//
+//	rtmp push [flags] <file.flv|-> <rtmp://host/app/stream>
+func runPush(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	loop := fs.Bool("loop", false, "push the file again and again, not for stdin")
+	realtime := fs.Bool("realtime", true, "send packets at the speed of their timestamps")
+	start := fs.Duration("start", 0, "start from this offset of the file, e.g. 30s")
+	chunkSize := fs.Uint("chunk-size", RtmpServerChunkSize, "outgoing chunk size")
+	publishType := fs.String("type", "live", "publish type: live, record or append")
+	timeout := fs.Duration("timeout", 10*time.Second, "handshake and connect timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmp push [flags] <file.flv|-> <rtmp://host/app/stream>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+
+		return errors.New("need input and url")
+	}
+	input, url := fs.Arg(0), fs.Arg(1)
+
+	switch *publishType {
+	case "live", "record", "append":
+	default:
+		return errors.Errorf("unknown publish type %s", *publishType)
+	}
+	if *chunkSize < RtmpDefaultChunkSize || *chunkSize > RtmpMaxChunkSize {
+		return errors.Errorf("chunk size must be in [%d, %d]", RtmpDefaultChunkSize, RtmpMaxChunkSize)
+	}
+
+	var f *os.File
+	if input == "-" {
+		if *loop {
+			return errors.New("can not loop stdin")
+		}
+		f = os.Stdin
+	} else {
+		var err error
+		if f, err = os.Open(input); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	opts := defaultClientOptions()
+	opts.Timeout = *timeout
+	opts.ChunkSize = uint32(*chunkSize)
+	opts.PublishType = *publishType
+
+	client, err := DialRtmpWithOptions(url, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Publish(); err != nil {
+		return err
+	}
+
+	p := &flvPusher{
+		client:   client,
+		realtime: *realtime,
+		start:    uint32(*start / time.Millisecond),
+		readErr:  make(chan error, 1),
+	}
+	go func() {
+		p.readErr <- client.discardMessages()
+	}()
+
+	for first := true; ; first = false {
+		if err = p.pushFile(f, first); err != nil {
+			return err
+		}
+
+		if !*loop {
+			break
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "push finished, sent %d packets\n", p.packets)
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket 每秒加入 rate 个令牌 最多 burst 个 每个新连接消耗一个.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// full 令牌已经加满 和新建的一样 可以删除.
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+// rateLimiter 限制新建连接的速度 每个IP一个令牌桶 还有一个全局的令牌桶.
+type rateLimiter struct {
+	lock      sync.Mutex
+	global    tokenBucket
+	perIP     map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+var connRateLimiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{perIP: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// allow 超过限制时返回原因.
+func (r *rateLimiter) allow(ip net.IP, cfg RateLimitConfig) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastPrune) > time.Minute {
+		r.lastPrune = now
+		for key, b := range r.perIP {
+			if b.full(now, cfg.Rate, cfg.Burst) {
+				delete(r.perIP, key)
+			}
+		}
+	}
+
+	if cfg.Rate > 0 && ip != nil {
+		key := ip.String()
+		b, ok := r.perIP[key]
+		if !ok {
+			b = &tokenBucket{}
+			r.perIP[key] = b
+		}
+		if !b.take(now, cfg.Rate, cfg.Burst) {
+			return LimitRate
+		}
+	}
+	if cfg.GlobalRate > 0 && !r.global.take(now, cfg.GlobalRate, cfg.GlobalBurst) {
+		return LimitGlobalRate
+	}
+
+	return ""
+}
+
+// handshaking 正在握手的连接数.
+var handshaking int32
+
+// acquireHandshake 超过同时握手的连接数时返回 false 成功后需要调用 releaseHandshake.
+func acquireHandshake(max int) bool {
+	if n := atomic.AddInt32(&handshaking, 1); max > 0 && int(n) > max {
+		atomic.AddInt32(&handshaking, -1)
+
+		return false
+	}
+
+	return true
+}
+
+func releaseHandshake() {
+	atomic.AddInt32(&handshaking, -1)
+}
+
+// Handshaking 当前正在握手的连接数.
+func Handshaking() int {
+	return int(atomic.LoadInt32(&handshaking))
+}
+
+// handshakeConn 握手时分别限制读取 C0C1 和 C2 的时间
+// 发送 S0S1S2 之后才开始计算 C2 的时间 都不能超过整个握手的时间.
+type handshakeConn struct {
+	net.Conn
+	deadline  time.Time // 整个握手的超时时间
+	c2Timeout time.Duration
+	sent      bool
+	// 当前生效的超时 超时后按照这个原因统计
+	reason string
+}
+
+func newHandshakeConn(conn net.Conn, limits LimitsConfig, cfg HandshakeConfig) *handshakeConn {
+	c := &handshakeConn{Conn: conn, c2Timeout: cfg.C2Timeout}
+	if limits.HandshakeTimeout > 0 {
+		c.deadline = time.Now().Add(limits.HandshakeTimeout)
+	}
+	c.setDeadline(cfg.C0C1Timeout, LimitC0C1Timeout)
+
+	return c
+}
+
+// setDeadline 使用 d 和整个握手的超时中较早的一个.
+func (c *handshakeConn) setDeadline(d time.Duration, reason string) {
+	t, r := c.deadline, LimitHandshakeTimeout
+	if d > 0 && (t.IsZero() || time.Now().Add(d).Before(t)) {
+		t, r = time.Now().Add(d), reason
+	}
+	c.reason = r
+	_ = c.Conn.SetDeadline(t)
+}
+
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	if !c.sent {
+		c.sent = true
+		c.setDeadline(c.c2Timeout, LimitC2Timeout)
+	}
+
+	return c.Conn.Write(b)
+}
+
+// offenders 统计每个IP超过限制的次数 在 ban_window 内达到 ban_after 次时临时封禁
+// 只统计每个IP自己的限制 总连接数 总速率这些全局的限制不计入.
+type offenders struct {
+	bans    uint64 // 64位的原子操作需要8字节对齐 放在最前面
+	lock    sync.Mutex
+	entries map[string]*offence
+}
+
+type offence struct {
+	count int
+	first time.Time
+}
+
+var autoBan = &offenders{entries: make(map[string]*offence)}
+
+func (o *offenders) record(ip net.IP, reason string) {
+	cfg := conf().RateLimit
+	if cfg.BanAfter <= 0 || ip == nil || globalLimits[reason] {
+		return
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	o.lock.Lock()
+	for k, e := range o.entries {
+		if now.Sub(e.first) > cfg.BanWindow {
+			delete(o.entries, k)
+		}
+	}
+	e, ok := o.entries[key]
+	if !ok {
+		e = &offence{first: now}
+		o.entries[key] = e
+	}
+	e.count++
+	ban := e.count >= cfg.BanAfter
+	if ban {
+		delete(o.entries, key)
+	}
+	o.lock.Unlock()
+
+	if !ban {
+		return
+	}
+
+	atomic.AddUint64(&o.bans, 1)
+	if err := banList.Add(key, "auto ban: "+reason, cfg.BanDuration); err != nil {
+		logger().Error("auto ban failed", "cidr", key, "err", err)
+
+		return
+	}
+	logger().Warn("auto ban", "cidr", key, "duration", cfg.BanDuration, "reason", reason)
+}
+
+// AutoBans 启动以来自动封禁的次数.
+func (o *offenders) AutoBans() uint64 {
+	return atomic.LoadUint64(&o.bans)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newRateLimiter()
+	r.now = func() time.Time { return now }
+
+	cfg := RateLimitConfig{Rate: 1, Burst: 2, GlobalRate: 10, GlobalBurst: 3}
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	for i, want := range []string{"", "", LimitRate} {
+		if got := r.allow(a, cfg); got != want {
+			t.Errorf("a %d: got %q want %q", i, got, want)
+		}
+	}
+	// 全局只剩一个令牌 被限制的连接没有消耗全局令牌
+	if got := r.allow(b, cfg); got != "" {
+		t.Errorf("b: %q", got)
+	}
+	if got := r.allow(b, cfg); got != LimitGlobalRate {
+		t.Errorf("global: %q", got)
+	}
+
+	now = now.Add(time.Second)
+	if got := r.allow(a, cfg); got != "" {
+		t.Errorf("after refill: %q", got)
+	}
+
+	// 一分钟后已经加满的令牌桶被删除
+	now = now.Add(2 * time.Minute)
+	r.allow(nil, cfg)
+	if len(r.perIP) != 0 {
+		t.Errorf("%d buckets left", len(r.perIP))
+	}
+}
+
+func TestAutoBan(t *testing.T) {
+	defer setConfig(conf())
+	c := *conf()
+	c.RateLimit.BanAfter = 3
+	c.RateLimit.BanWindow = time.Minute
+	c.RateLimit.BanDuration = time.Hour
+	setConfig(&c)
+
+	ip := net.ParseIP("192.0.2.77")
+	defer banList.Remove(ip.String())
+
+	o := &offenders{entries: make(map[string]*offence)}
+	// 全局的限制不计入
+	for _, reason := range []string{LimitConnections, LimitGlobalRate, LimitHandshakes, LimitConnections} {
+		o.record(ip, reason)
+	}
+	if banList.Banned(ip) || len(o.entries) != 0 {
+		t.Fatal("banned by global limits")
+	}
+
+	for _, reason := range []string{LimitRate, LimitC0C1Timeout} {
+		o.record(ip, reason)
+		if banList.Banned(ip) {
+			t.Fatalf("banned after %s", reason)
+		}
+	}
+	o.record(ip, LimitMessageSize)
+	if !banList.Banned(ip) || o.AutoBans() != 1 {
+		t.Errorf("not banned, auto bans %d", o.AutoBans())
+	}
+
+	_, _ = banList.Remove(ip.String())
+	for i := 0; i < 3; i++ {
+		if banList.Banned(ip) {
+			t.Fatalf("banned after %d offences", i)
+		}
+		o.record(ip, LimitRate)
+	}
+	if !banList.Banned(ip) || o.AutoBans() != 2 {
+		t.Errorf("not banned, auto bans %d", o.AutoBans())
+	}
+}
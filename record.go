@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Recorder 将一路流录制为FLV文件 每次发布生成一个新的文件.
+type Recorder struct {
+	stream *Stream
+	dir    string
+	path   string
+	done   chan struct{}
+	// 通过管理接口开始的录制 重新加载配置时不会停止
+	manual bool
+}
+
+func newRecorder(s *Stream, dir string) *Recorder {
+	name := fmt.Sprintf("%s-%s.flv", s.Name, time.Now().Format("20060102-150405"))
+
+	return &Recorder{
+		stream: s,
+		dir:    dir,
+		path:   filepath.Join(dir, s.App, name),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *Recorder) stop() {
+	close(r.done)
+}
+
+func (r *Recorder) run() {
+	if err := r.record(); err != nil {
+		logger().Error("record failed", "path", r.path, "err", err)
+
+		return
+	}
+
+	notifyHook(HookOnRecordDone, &HookEvent{
+		Vhost:  r.stream.Vhost,
+		App:    r.stream.App,
+		Stream: r.stream.Name,
+		Path:   r.path,
+	})
+}
+
+func (r *Recorder) record() error {
+	// 流名在发布时已经检查过 这里再确认一次不会写到录制目录之外
+	if rel, err := filepath.Rel(r.dir, r.path); err != nil || strings.HasPrefix(rel, "..") {
+		return errors.Errorf("record path %s is outside %s", r.path, r.dir)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	defer bw.Flush()
+
+	w := NewFlvWriter(bw)
+	if err = w.WriteHeader(true, true); err != nil {
+		return err
+	}
+
+	sub := newInternalSubscriber("record " + r.path)
+	s := streamManager.Subscribe(r.stream.Vhost, r.stream.App, r.stream.Name, sub)
+	defer streamManager.Unsubscribe(s, sub)
+
+	// 文件中的时间戳从0开始
+	var base uint32
+	started := false
+	for {
+		select {
+		case p := <-sub.Packets():
+			if !started {
+				base = p.Timestamp
+				started = true
+			}
+
+			ts := uint32(0)
+			if p.Timestamp > base {
+				ts = p.Timestamp - base
+			}
+
+			if err = w.WriteTag(&FlvTag{Type: p.Type, Timestamp: ts, Data: p.Payload}); err != nil {
+				return err
+			}
+		case <-r.done:
+			return nil
+		}
+	}
+}
+
+// RecordManager 根据app的 record 配置 在流发布时开始录制.
+type RecordManager struct {
+	lock      sync.Mutex
+	recorders map[string]*Recorder
+	// 通过管理接口停止录制的流 重新发布之前 重新加载配置时也不再录制
+	stopped map[string]*Stream
+}
+
+var recordManager = newRecordManager()
+
+func newRecordManager() *RecordManager {
+	return &RecordManager{
+		recorders: make(map[string]*Recorder),
+		stopped:   make(map[string]*Stream),
+	}
+}
+
+func (m *RecordManager) onPublish(s *Stream) {
+	m.lock.Lock()
+	delete(m.stopped, s.Key())
+	m.lock.Unlock()
+
+	dir := conf().App(s.Vhost, s.App).Record
+	if dir == "" {
+		return
+	}
+
+	r := newRecorder(s, dir)
+
+	m.lock.Lock()
+	old := m.recorders[s.Key()]
+	m.recorders[s.Key()] = r
+	m.lock.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go r.run()
+}
+
+func (m *RecordManager) onUnpublish(s *Stream) {
+	m.lock.Lock()
+	r := m.recorders[s.Key()]
+	delete(m.recorders, s.Key())
+	delete(m.stopped, s.Key())
+	m.lock.Unlock()
+
+	if r != nil {
+		r.stop()
+	}
+}
+
+// reload 配置修改后 开始或者停止录制正在发布的流 录制目录修改后会录制到新的文件中.
+func (m *RecordManager) reload() {
+	for _, s := range streamManager.Streams() {
+		if s.Publisher() == nil {
+			continue
+		}
+
+		dir := conf().App(s.Vhost, s.App).Record
+
+		m.lock.Lock()
+		old := m.recorders[s.Key()]
+		if old != nil && old.stream == s && (old.dir == dir || old.manual) {
+			m.lock.Unlock()
+
+			continue
+		}
+		if old == nil && m.stopped[s.Key()] == s {
+			m.lock.Unlock()
+
+			continue
+		}
+
+		var r *Recorder
+		if dir != "" {
+			r = newRecorder(s, dir)
+			m.recorders[s.Key()] = r
+		} else {
+			delete(m.recorders, s.Key())
+		}
+		m.lock.Unlock()
+
+		if old != nil {
+			logger().Info("record stopped by reload", "path", old.path)
+			old.stop()
+		}
+		if r != nil {
+			logger().Info("record started by reload", "path", r.path)
+			go r.run()
+		}
+	}
+}
+
+// Start 开始录制正在发布的流 dir 为空时使用app配置的录制目录.
+func (m *RecordManager) Start(s *Stream, dir string) (string, error) {
+	if dir == "" {
+		dir = conf().App(s.Vhost, s.App).Record
+	}
+	if dir == "" {
+		return "", errors.Errorf("no record dir for %s", s.Key())
+	}
+
+	m.lock.Lock()
+	if old := m.recorders[s.Key()]; old != nil && old.stream == s {
+		m.lock.Unlock()
+
+		return "", errors.Errorf("%s is already recording to %s", s.Key(), old.path)
+	}
+	r := newRecorder(s, dir)
+	r.manual = true
+	m.recorders[s.Key()] = r
+	delete(m.stopped, s.Key())
+	m.lock.Unlock()
+
+	logger().Info("record started by admin", "path", r.path)
+	go r.run()
+
+	return r.path, nil
+}
+
+// Stop 停止录制 返回录制的文件 没有在录制时返回空.
+func (m *RecordManager) Stop(s *Stream) string {
+	m.lock.Lock()
+	r := m.recorders[s.Key()]
+	if r == nil || r.stream != s {
+		m.lock.Unlock()
+
+		return ""
+	}
+	delete(m.recorders, s.Key())
+	m.stopped[s.Key()] = s
+	m.lock.Unlock()
+
+	logger().Info("record stopped by admin", "path", r.path)
+	r.stop()
+
+	return r.path
+}
+
+// Recording 正在录制的文件 没有在录制时返回空.
+func (m *RecordManager) Recording(s *Stream) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if r := m.recorders[s.Key()]; r != nil && r.stream == s {
+		return r.path
+	}
+
+	return ""
+}
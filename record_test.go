@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorderOutsideDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newRecorder(newStream("", "live", "../../x"), filepath.Join(dir, "rec"))
+	if err = r.record(); err == nil {
+		t.Fatalf("recorded to %s", r.path)
+	}
+	if _, err = os.Stat(r.path); !os.IsNotExist(err) {
+		t.Errorf("%s created", r.path)
+	}
+}
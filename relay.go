@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RelayStateConnecting = "connecting"
+	RelayStatePublishing = "publishing"
+	RelayStateRetrying   = "retrying"
+	RelayStateStopped    = "stopped"
+
+	RelayDialTimeout = 10 * time.Second
+)
+
+// RelayStatus 一个转推目标的状态.
+type RelayStatus struct {
+	App         string     `json:"app"`
+	Stream      string     `json:"stream"`
+	URL         string     `json:"url"`
+	State       string     `json:"state"`
+	LastError   string     `json:"last_error,omitempty"`
+	Retries     int        `json:"retries"`
+	BytesSent   uint64     `json:"bytes_sent"`
+	Dropped     uint64     `json:"dropped"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	// 通过管理接口增加的目标
+	Manual bool `json:"manual,omitempty"`
+}
+
+// expandRelayURL 替换目标地址中的 {app} {stream}.
+func expandRelayURL(tmpl string, s *Stream) string {
+	r := strings.NewReplacer("{app}", s.App, "{stream}", s.Name)
+
+	return r.Replace(tmpl)
+}
+
+// RelayPusher 将一路流转推到一个目标 每个目标有自己的订阅队列 互不影响.
+type RelayPusher struct {
+	stream *Stream
+	url    string
+	cfg    RelayConfig
+	done   chan struct{}
+
+	lock   sync.RWMutex
+	status RelayStatus
+	client *RtmpClient
+}
+
+func newRelayPusher(s *Stream, url string, cfg RelayConfig) *RelayPusher {
+	return &RelayPusher{
+		stream: s,
+		url:    url,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+		status: RelayStatus{
+			App:    s.App,
+			Stream: s.Name,
+			URL:    url,
+			State:  RelayStateConnecting,
+		},
+	}
+}
+
+func (p *RelayPusher) Status() RelayStatus {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.status
+}
+
+func (p *RelayPusher) setState(state string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.status.State = state
+	if state == RelayStatePublishing {
+		now := time.Now()
+		p.status.ConnectedAt = &now
+	}
+}
+
+func (p *RelayPusher) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop 停止转推 正在进行的连接会被关闭.
+func (p *RelayPusher) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped() {
+		return
+	}
+	close(p.done)
+	if p.client != nil {
+		_ = p.client.Close()
+	}
+}
+
+// run 失败后按照指数退避重试 直到 stop.
+func (p *RelayPusher) run() {
+	backoff := p.cfg.RetryMin
+
+	for {
+		p.setState(RelayStateConnecting)
+		start := time.Now()
+		err := p.push()
+
+		if p.stopped() {
+			p.setState(RelayStateStopped)
+
+			return
+		}
+
+		// 推流持续了足够长的时间 说明目标是正常的 重新开始计算退避时间
+		if time.Since(start) > p.cfg.RetryMax {
+			backoff = p.cfg.RetryMin
+		}
+
+		p.lock.Lock()
+		p.status.State = RelayStateRetrying
+		p.status.Retries++
+		if err != nil {
+			p.status.LastError = err.Error()
+		}
+		p.lock.Unlock()
+		logger().Warn("relay failed", "url", p.url, "retry_after", backoff, "err", err)
+
+		select {
+		case <-p.done:
+			p.setState(RelayStateStopped)
+
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.cfg.RetryMax {
+			backoff = p.cfg.RetryMax
+		}
+	}
+}
+
+func (p *RelayPusher) push() error {
+	client, err := DialRtmp(p.url, RelayDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	p.lock.Lock()
+	if p.stopped() {
+		p.lock.Unlock()
+
+		return nil
+	}
+	p.client = client
+	p.lock.Unlock()
+
+	if err = client.Publish(); err != nil {
+		return err
+	}
+	p.setState(RelayStatePublishing)
+
+	// 每次重新连接都重新订阅 这样新的连接可以先收到 sequence header 和 GOP缓存
+	sub := newInternalSubscriber("relay " + p.url)
+	s := streamManager.Subscribe(p.stream.Vhost, p.stream.App, p.stream.Name, sub)
+	defer streamManager.Unsubscribe(s, sub)
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- client.discardMessages()
+	}()
+
+	for {
+		select {
+		case pkt := <-sub.Packets():
+			if err = client.WritePacket(pkt); err != nil {
+				return err
+			}
+
+			dropped := s.Dropped(sub)
+			p.lock.Lock()
+			p.status.BytesSent += uint64(len(pkt.Payload))
+			p.status.Dropped = dropped
+			p.lock.Unlock()
+		case err = <-readErr:
+			return err
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// RelayManager 根据配置在流发布时转推到其他服务器.
+type RelayManager struct {
+	lock    sync.RWMutex
+	pushers map[string][]*RelayPusher
+	// 通过管理接口删除的配置中的目标 流重新发布之前 重新加载配置时也不再转推
+	removed map[string]map[string]bool
+}
+
+var relayManager = newRelayManager()
+
+func newRelayManager() *RelayManager {
+	return &RelayManager{
+		pushers: make(map[string][]*RelayPusher),
+		removed: make(map[string]map[string]bool),
+	}
+}
+
+// destinations 一路流的所有转推目标 包括 relay.rules 和 apps 中配置的
+// relay.rules 按照app匹配所有虚拟主机中的流 app的实例使用app的规则.
+func (m *RelayManager) destinations(s *Stream) []string {
+	var dests []string
+	for _, rule := range conf().Relay.Rules {
+		if rule.App == appBase(s.App) {
+			dests = append(dests, rule.Destinations...)
+		}
+	}
+
+	return append(dests, conf().App(s.Vhost, s.App).Relay...)
+}
+
+func (m *RelayManager) onPublish(s *Stream) {
+	cfg := conf().Relay
+
+	var pushers []*RelayPusher
+	for _, dest := range m.destinations(s) {
+		pushers = append(pushers, newRelayPusher(s, expandRelayURL(dest, s), cfg))
+	}
+
+	m.lock.Lock()
+	delete(m.removed, s.Key())
+	if len(pushers) == 0 {
+		m.lock.Unlock()
+
+		return
+	}
+	old := m.pushers[s.Key()]
+	m.pushers[s.Key()] = pushers
+	m.lock.Unlock()
+
+	for _, p := range old {
+		p.stop()
+	}
+	for _, p := range pushers {
+		go p.run()
+	}
+}
+
+func (m *RelayManager) onUnpublish(s *Stream) {
+	m.lock.Lock()
+	pushers := m.pushers[s.Key()]
+	delete(m.pushers, s.Key())
+	delete(m.removed, s.Key())
+	m.lock.Unlock()
+
+	for _, p := range pushers {
+		p.stop()
+	}
+}
+
+// reload 配置修改后 正在发布的流增加新的转推目标 停止已经删除的目标 没有变化的目标不受影响.
+func (m *RelayManager) reload() {
+	cfg := conf().Relay
+
+	for _, s := range streamManager.Streams() {
+		if s.Publisher() == nil {
+			continue
+		}
+
+		want := make(map[string]bool)
+		for _, dest := range m.destinations(s) {
+			want[expandRelayURL(dest, s)] = true
+		}
+
+		m.lock.Lock()
+		for url := range m.removed[s.Key()] {
+			delete(want, url)
+		}
+		var pushers, stopped, started []*RelayPusher
+		for _, p := range m.pushers[s.Key()] {
+			if p.status.Manual && p.stream == s {
+				pushers = append(pushers, p)
+				delete(want, p.url)
+			} else if want[p.url] && p.stream == s {
+				pushers = append(pushers, p)
+				delete(want, p.url)
+			} else {
+				stopped = append(stopped, p)
+			}
+		}
+		for url := range want {
+			p := newRelayPusher(s, url, cfg)
+			pushers = append(pushers, p)
+			started = append(started, p)
+		}
+		if len(pushers) > 0 {
+			m.pushers[s.Key()] = pushers
+		} else {
+			delete(m.pushers, s.Key())
+		}
+		m.lock.Unlock()
+
+		for _, p := range stopped {
+			logger().Info("relay removed by reload", "url", p.url)
+			p.stop()
+		}
+		for _, p := range started {
+			logger().Info("relay added by reload", "url", p.url)
+			go p.run()
+		}
+	}
+}
+
+// Add 给正在发布的流增加一个转推目标 流停止发布后不再保留.
+func (m *RelayManager) Add(s *Stream, url string) error {
+	if _, err := ParseRtmpURL(url); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	for _, p := range m.pushers[s.Key()] {
+		if p.url == url {
+			m.lock.Unlock()
+
+			return errors.Errorf("%s is already relayed to %s", s.Key(), url)
+		}
+	}
+	p := newRelayPusher(s, url, conf().Relay)
+	p.status.Manual = true
+	m.pushers[s.Key()] = append(m.pushers[s.Key()], p)
+	delete(m.removed[s.Key()], url)
+	m.lock.Unlock()
+
+	logger().Info("relay added by admin", "url", url)
+	go p.run()
+
+	return nil
+}
+
+// Remove 停止转推到 url 返回是否存在.
+func (m *RelayManager) Remove(s *Stream, url string) bool {
+	m.lock.Lock()
+	var found *RelayPusher
+	pushers := m.pushers[s.Key()][:0]
+	for _, p := range m.pushers[s.Key()] {
+		if p.url == url && found == nil {
+			found = p
+		} else {
+			pushers = append(pushers, p)
+		}
+	}
+	if found == nil {
+		m.lock.Unlock()
+
+		return false
+	}
+	if len(pushers) > 0 {
+		m.pushers[s.Key()] = pushers
+	} else {
+		delete(m.pushers, s.Key())
+	}
+	if m.removed[s.Key()] == nil {
+		m.removed[s.Key()] = make(map[string]bool)
+	}
+	m.removed[s.Key()][url] = true
+	m.lock.Unlock()
+
+	logger().Info("relay removed by admin", "url", url)
+	found.stop()
+
+	return true
+}
+
+// StreamStatus 一路流的转推目标的状态.
+func (m *RelayManager) StreamStatus(s *Stream) []RelayStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var status []RelayStatus
+	for _, p := range m.pushers[s.Key()] {
+		if p.stream == s {
+			status = append(status, p.Status())
+		}
+	}
+
+	return status
+}
+
+func (m *RelayManager) Status() []RelayStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	status := make([]RelayStatus, 0)
+	for _, pushers := range m.pushers {
+		for _, p := range pushers {
+			status = append(status, p.Status())
+		}
+	}
+
+	return status
+}
+
+// ServeHTTP 以JSON返回所有转推目标的状态.
+func (m *RelayManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m.Status())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func waitRelay(t *testing.T, p *RelayPusher, ok func(RelayStatus) bool) RelayStatus {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		st := p.Status()
+		if ok(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay status is %+v", st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRelayPusher(t *testing.T) {
+	addr := startTestServer(t)
+
+	src := newPuller("", "live", "relaysrc", "rtmp://origin/live/relaysrc", 0, 0)
+	s, err := streamManager.Publish("", "live", "relaysrc", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamManager.Unpublish(s, src)
+	s.WritePacket(&AVPacket{Type: RtmpMsgVideo, Payload: testAVCSequenceHeader()})
+
+	p := newRelayPusher(s, fmt.Sprintf("rtmp://%s/live/relaydst", addr), RelayConfig{RetryMin: time.Second, RetryMax: time.Second})
+	go p.run()
+	defer p.stop()
+
+	waitRelay(t, p, func(st RelayStatus) bool { return st.State == RelayStatePublishing && st.BytesSent > 0 })
+
+	// 目标服务器收到转推的流 和 sequence header
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if dst := streamManager.Get("", "live", "relaydst"); dst != nil {
+			if _, video, _ := dst.SequenceHeaders(); video != nil {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relay destination not published")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	m := newRelayManager()
+	m.pushers[s.Key()] = []*RelayPusher{p}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/relay", nil))
+	var status []RelayStatus
+	if err = json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].URL != p.url || status[0].State != RelayStatePublishing || status[0].ConnectedAt == nil {
+		t.Errorf("status is %+v", status)
+	}
+
+	p.stop()
+	waitRelay(t, p, func(st RelayStatus) bool { return st.State == RelayStateStopped })
+	for streamManager.Get("", "live", "relaydst") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("relay destination not closed after stop")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRelayPusherRetry(t *testing.T) {
+	// 关闭的端口 连接立即失败
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("rtmp://%s/live/retry", l.Addr())
+	_ = l.Close()
+
+	s := newStream("", "live", "retry")
+	retries := func(cfg RelayConfig) int {
+		p := newRelayPusher(s, url, cfg)
+		go p.run()
+		time.Sleep(150 * time.Millisecond)
+		p.stop()
+
+		st := waitRelay(t, p, func(st RelayStatus) bool { return st.State == RelayStateStopped })
+		if st.LastError == "" {
+			t.Errorf("last error is empty: %+v", st)
+		}
+
+		return st.Retries
+	}
+
+	// 10ms 20ms 40ms 80ms 150ms 内最多重试4次
+	if n := retries(RelayConfig{RetryMin: 10 * time.Millisecond, RetryMax: time.Second}); n < 2 || n > 4 {
+		t.Errorf("backoff retries is %d", n)
+	}
+	// 退避时间不超过 RetryMax
+	if n := retries(RelayConfig{RetryMin: 10 * time.Millisecond, RetryMax: 10 * time.Millisecond}); n < 6 {
+		t.Errorf("capped retries is %d", n)
+	}
+}
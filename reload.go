@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// restartSections 这些配置只在启动时使用 修改后需要重启才能生效.
+var restartSections = []string{"rtmp.listen", "rtmps", "rtmpt", "http", "dash", "admin.path", "metrics.path", "stat.path", "stat.control_path"}
+
+var (
+	reloadLock  sync.Mutex
+	reloadHooks []func()
+)
+
+// onReload 注册配置重新加载后的回调 回调中通过 conf() 获取新的配置.
+func onReload(h func()) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	reloadHooks = append(reloadHooks, h)
+}
+
+// watchReload 收到 SIGHUP 后重新读取配置文件.
+func watchReload(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		if err := reloadConfig(path); err != nil {
+			logger().Error("reload config failed, keep the old config", "err", err)
+		}
+	}
+}
+
+// reloadConfig 重新读取并校验配置 校验失败时继续使用原来的配置
+// 新的连接使用新的配置 转推 录制 拉流 GOP缓存会应用到正在发布的流上 已经建立的连接不受影响.
+func reloadConfig(path string) error {
+	if path == "" {
+		return fmt.Errorf("no config file, start with -c to enable reload")
+	}
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	old := conf()
+	changes := diffConfig(old, c)
+	if len(changes) == 0 {
+		logger().Info("reload config, nothing changed")
+
+		return nil
+	}
+
+	for _, change := range changes {
+		logger().Info("reload config", "change", change.String())
+	}
+	for _, section := range restartSections {
+		for _, change := range changes {
+			if change.in(section) {
+				logger().Warn("reload config changed a section that needs restart", "section", section)
+
+				break
+			}
+		}
+	}
+
+	setConfig(c)
+
+	for _, s := range streamManager.Streams() {
+		s.setGopCache(c.App(s.Vhost, s.App).UseGopCache())
+	}
+	for _, h := range reloadHooks {
+		h()
+	}
+
+	return nil
+}
+
+// configChange 一个修改了的字段 Path 例如 apps[0].chunk_size 新增的字段 Old 为空 删除的字段 New 为空.
+type configChange struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// String 只输出字段路径 值中可能有 token 密钥 推流地址 不写到日志中.
+func (c configChange) String() string {
+	switch {
+	case c.Old == "":
+		return "+ " + c.Path
+	case c.New == "":
+		return "- " + c.Path
+	}
+
+	return "~ " + c.Path
+}
+
+// in 修改的字段是否属于 section.
+func (c configChange) in(section string) bool {
+	return c.Path == section || strings.HasPrefix(c.Path, section+".") || strings.HasPrefix(c.Path, section+"[")
+}
+
+// diffConfig 返回两个配置中不同的字段 按照字段排序.
+func diffConfig(old, c *Config) []configChange {
+	a, b := flattenConfig(old), flattenConfig(c)
+
+	var changes []configChange
+	for k, v := range a {
+		if nv := b[k]; nv != v {
+			changes = append(changes, configChange{Path: k, Old: v, New: nv})
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			changes = append(changes, configChange{Path: k, New: v})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes
+}
+
+// flattenConfig 将配置展开为 路径 -> 值.
+func flattenConfig(c *Config) map[string]string {
+	out := make(map[string]string)
+
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return out
+	}
+
+	var v interface{}
+	if err = yaml.Unmarshal(data, &v); err != nil {
+		return out
+	}
+	flattenValue("", v, out)
+
+	return out
+}
+
+func flattenValue(path string, v interface{}, out map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			flattenValue(p, item, out)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenValue(fmt.Sprintf("%s[%d]", path, i), item, out)
+		}
+	case nil:
+	default:
+		out[path] = fmt.Sprint(v)
+	}
+}
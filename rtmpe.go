@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RtmpeHandShakVersion         = 0x6 // RTMPE
+	RtmpeXteaHandShakVersion     = 0x8 // S2的签名需要使用XTEA加密
+	RtmpeBlowfishHandShakVersion = 0x9 // S2的签名需要使用Blowfish加密
+
+	// DH 公钥的长度 就是 C1S1 中 key 的长度
+	RtmpeDHKeySize  = C1S1KeyDataSize
+	RtmpeRC4KeySize = 16
+)
+
+/*
+C1S1 有两种格式
+
+	scheme0: time + version + digest + key
+	scheme1: time + version + key + digest
+
+RTMPE 的客户端一般使用 scheme1
+*/
+const (
+	handshakeScheme0 = 0
+	handshakeScheme1 = 1
+)
+
+// rtmpeDHPrime RFC2409 中的 1024bit MODP Group 2 生成元为2.
+var rtmpeDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var rtmpeDHGenerator = big.NewInt(2)
+
+func sumOffset(b []byte) int {
+	return int(b[0]) + int(b[1]) + int(b[2]) + int(b[3])
+}
+
+// digestOffset 返回 digest-data 在 C1S1 中的位置.
+func digestOffset(b []byte, scheme int) int {
+	if scheme == handshakeScheme0 {
+		return getDigestDataOffset(b)
+	}
+
+	return sumOffset(b[772:])%C1S1DigestOffsetMax + C1S1TimeSize + C1S1VersionSize + C1S1KeySize + C1S1DigestOffsetSize
+}
+
+// keyOffset 返回 key-data 在 C1S1 中的位置.
+func keyOffset(b []byte, scheme int) int {
+	if scheme == handshakeScheme0 {
+		return getKeyOffset(b)
+	}
+
+	return sumOffset(b[768:])%C1S1KeyOffsetMax + C1S1TimeSize + C1S1VersionSize
+}
+
+// calcDigest 计算 C1S1 除去 digest-data 之外部分的摘要.
+func calcDigest(b []byte, offset int, key []byte) ([]byte, error) {
+	buf := make([]byte, 0, len(b)-C1S1DigestDataSize)
+	buf = append(buf, b[:offset]...)
+	buf = append(buf, b[offset+C1S1DigestDataSize:]...)
+
+	return HMACSha256(buf, key)
+}
+
+// validateDigest 依次尝试两种格式 返回校验成功的格式.
+func validateDigest(b []byte, key []byte) (int, bool) {
+	for _, scheme := range []int{handshakeScheme0, handshakeScheme1} {
+		offset := digestOffset(b, scheme)
+		digest, err := calcDigest(b, offset, key)
+		if err != nil {
+			continue
+		}
+
+		if bytes.Equal(digest, b[offset:offset+C1S1DigestDataSize]) {
+			return scheme, true
+		}
+	}
+
+	return 0, false
+}
+
+type rtmpeDH struct {
+	private *big.Int
+	public  []byte
+}
+
+func newRtmpeDH() (*rtmpeDH, error) {
+	b := make([]byte, RtmpeDHKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(rtmpeDHGenerator, x, rtmpeDHPrime)
+
+	return &rtmpeDH{private: x, public: padBytes(y.Bytes(), RtmpeDHKeySize)}, nil
+}
+
+// sharedSecret 计算共享密钥 和 librtmp 一样 不足128byte时后面补0.
+func (dh *rtmpeDH) sharedSecret(peer []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peer)
+
+	// 对方的公钥需要满足 1 < y < p-1
+	max := new(big.Int).Sub(rtmpeDHPrime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, errors.New("invalid DH public key")
+	}
+
+	secret := make([]byte, RtmpeDHKeySize)
+	copy(secret, new(big.Int).Exp(y, dh.private, rtmpeDHPrime).Bytes())
+
+	return secret, nil
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	buf := make([]byte, size)
+	copy(buf[size-len(b):], b)
+
+	return buf
+}
+
+// rtmpeCipher RTMPE 握手协商出来的RC4密钥 握手完成后所有的数据都需要加解密.
+type rtmpeCipher struct {
+	in  *rc4.Cipher
+	out *rc4.Cipher
+}
+
+// newRtmpeCipher 发送使用 HMAC(secret, 对方公钥) 接收使用 HMAC(secret, 自己公钥)
+// 两个密钥流都需要先跳过1536byte.
+func newRtmpeCipher(secret, localPub, remotePub []byte) (*rtmpeCipher, error) {
+	newRC4 := func(pub []byte) (*rc4.Cipher, error) {
+		key, err := HMACSha256(pub, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := rc4.NewCipher(key[:RtmpeRC4KeySize])
+		if err != nil {
+			return nil, err
+		}
+
+		skip := make([]byte, HandshakDataLen)
+		c.XORKeyStream(skip, skip)
+
+		return c, nil
+	}
+
+	out, err := newRC4(remotePub)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := newRC4(localPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtmpeCipher{in: in, out: out}, nil
+}
+
+// wrap 返回加解密之后的读写 r 中可能已经缓存了握手之后的数据 所以需要在 r 的上面解密
+// w 在握手时已经 Flush 过了 直接写到底层的连接.
+func (c *rtmpeCipher) wrap(r io.Reader, w io.Writer) *bufio.ReadWriter {
+	return bufio.NewReadWriter(
+		bufio.NewReader(cipher.StreamReader{S: c.in, R: r}),
+		bufio.NewWriter(cipher.StreamWriter{S: c.out, W: w}),
+	)
+}
+
+// rtmpeHandshake C1 中 key 的位置是客户端的 DH 公钥 S1 中同样位置放服务端的公钥.
+func rtmpeHandshake(conn *bufio.ReadWriter, version byte, c1 []byte) (*rtmpeCipher, error) {
+	if version == RtmpeXteaHandShakVersion || version == RtmpeBlowfishHandShakVersion {
+		return nil, errors.Errorf("RTMPE version %d is not support", version)
+	}
+
+	scheme, ok := validateDigest(c1, FPKey[:30])
+	if !ok {
+		return nil, errors.New("RTMPE client digest is invalid")
+	}
+
+	clientDigestOffset := digestOffset(c1, scheme)
+	clientDigest := c1[clientDigestOffset : clientDigestOffset+C1S1DigestDataSize]
+	clientKeyOffset := keyOffset(c1, scheme)
+	clientPub := c1[clientKeyOffset : clientKeyOffset+RtmpeDHKeySize]
+
+	dh, err := newRtmpeDH()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := dh.sharedSecret(clientPub)
+	if err != nil {
+		return nil, err
+	}
+
+	// S1 使用和客户端相同的格式
+	s1 := createS1()
+	copy(s1[keyOffset(s1, scheme):], dh.public)
+	s1DigestOffset := digestOffset(s1, scheme)
+	s1Digest, err := calcDigest(s1, s1DigestOffset, FMSKey[:36])
+	if err != nil {
+		return nil, err
+	}
+	copy(s1[s1DigestOffset:], s1Digest)
+
+	s2Random := createS2()
+	s2Hash, err := HMACSha256(clientDigest, FMSKey[:68])
+	if err != nil {
+		return nil, err
+	}
+	s2Digest, err := HMACSha256(s2Random, s2Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(version)
+	buf.Write(s1)
+	buf.Write(s2Random)
+	buf.Write(s2Digest)
+
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	// 跳过C2
+	if _, err = ReadByteToBuf(conn, HandshakDataLen); err != nil {
+		return nil, err
+	}
+
+	return newRtmpeCipher(secret, dh.public, clientPub)
+}
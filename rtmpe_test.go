@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// 模拟 librtmp 的 RTMPE 客户端 使用 scheme1.
+func TestRtmpeHandshake(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	result := make(chan *rtmpeCipher, 1)
+	go func() {
+		c, err := handshake(bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)))
+		if err != nil {
+			t.Error(err)
+		}
+		result <- c
+	}()
+
+	dh, err := newRtmpeDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := make([]byte, HandshakDataLen)
+	_, _ = rand.Read(c1)
+	c1[4] = 9
+	copy(c1[keyOffset(c1, handshakeScheme1):], dh.public)
+	offset := digestOffset(c1, handshakeScheme1)
+	digest, _ := calcDigest(c1, offset, FPKey[:30])
+	copy(c1[offset:], digest)
+
+	if _, err = client.Write(append([]byte{RtmpeHandShakVersion}, c1...)); err != nil {
+		t.Fatal(err)
+	}
+
+	s0s1s2 := make([]byte, 1+2*HandshakDataLen)
+	if _, err = io.ReadFull(client, s0s1s2); err != nil {
+		t.Fatal(err)
+	}
+	if s0s1s2[0] != RtmpeHandShakVersion {
+		t.Fatalf("S0 is %d", s0s1s2[0])
+	}
+
+	s1 := s0s1s2[1 : 1+HandshakDataLen]
+	if scheme, ok := validateDigest(s1, FMSKey[:36]); !ok || scheme != handshakeScheme1 {
+		t.Fatalf("S1 digest invalid, scheme %d", scheme)
+	}
+
+	serverPub := s1[keyOffset(s1, handshakeScheme1) : keyOffset(s1, handshakeScheme1)+RtmpeDHKeySize]
+	secret, err := dh.sharedSecret(serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCipher, err := newRtmpeCipher(secret, dh.public, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Write(s1); err != nil {
+		t.Fatal(err)
+	}
+	serverCipher := <-result
+	if serverCipher == nil {
+		t.Fatal("server did not negotiate RTMPE")
+	}
+
+	msg := []byte("connect after RTMPE handshake")
+	go func() {
+		rw := clientCipher.wrap(client, client)
+		_, _ = rw.Write(msg)
+		_ = rw.Flush()
+	}()
+
+	rw := serverCipher.wrap(server, server)
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(rw, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("decrypt fail %q", got)
+	}
+}
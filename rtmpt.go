@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RtmptContentType = "application/x-fcs"
+
+	// 返回给客户端的轮询间隔 有数据时为1 没有数据时逐渐增大
+	RtmptMinPollDelay = 0x01
+	RtmptMaxPollDelay = 0x21
+
+	// 客户端一直不来取数据时 最多缓存的数据
+	RtmptMaxPendingSize = 8 << 20
+	RtmptMaxRequestSize = 1 << 20
+)
+
+var errRtmptClosed = errors.New("rtmpt session closed")
+
+// rtmptTimeout 读超过 SetReadDeadline 设置的时间 和 net.Conn 一样是 Timeout 的 net.Error.
+type rtmptTimeout struct{}
+
+func (rtmptTimeout) Error() string   { return "rtmpt read timeout" }
+func (rtmptTimeout) Timeout() bool   { return true }
+func (rtmptTimeout) Temporary() bool { return true }
+
+type rtmptAddr string
+
+func (a rtmptAddr) Network() string {
+	return "rtmpt"
+}
+
+func (a rtmptAddr) String() string {
+	return string(a)
+}
+
+// rtmptConn 一个RTMPT会话 对 NetConnection 来说就是一个普通的连接
+// 客户端 send 过来的数据从 Read 读出 Write 写入的数据等客户端 send 或 idle 时带回去.
+type rtmptConn struct {
+	id     string
+	remote net.Addr
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	in         bytes.Buffer
+	out        bytes.Buffer
+	closed     bool
+	lastActive time.Time
+	lastSeq    uint64
+	// 客户端请求的序号从0开始 收到过请求之后才比较 lastSeq
+	fed       bool
+	pollDelay byte
+	// 读的截止时间 到时 timer 唤醒等待的 Read
+	readDeadline time.Time
+	timer        *time.Timer
+}
+
+func newRtmptConn(id, remote string) *rtmptConn {
+	c := &rtmptConn{
+		id:         id,
+		remote:     rtmptAddr(remote),
+		lastActive: time.Now(),
+		pollDelay:  RtmptMinPollDelay,
+	}
+	c.cond = sync.NewCond(&c.lock)
+
+	return c
+}
+
+func (c *rtmptConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for c.in.Len() == 0 && !c.closed {
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, rtmptTimeout{}
+		}
+		c.cond.Wait()
+	}
+
+	if c.in.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return c.in.Read(b)
+}
+
+func (c *rtmptConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return 0, errRtmptClosed
+	}
+	if c.out.Len()+len(b) > RtmptMaxPendingSize {
+		return 0, errors.New("rtmpt client does not poll")
+	}
+
+	return c.out.Write(b)
+}
+
+func (c *rtmptConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *rtmptConn) LocalAddr() net.Addr {
+	return rtmptAddr("rtmpt")
+}
+
+func (c *rtmptConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *rtmptConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline 握手 connect 和空闲的超时都依赖读的截止时间.
+func (c *rtmptConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.lock.Lock()
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		})
+	}
+
+	return nil
+}
+
+// 写入只是放到缓存中 不会阻塞 客户端不来取数据时由会话的过期来处理.
+func (c *rtmptConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// feed 客户端 send 过来的数据 重复的请求只返回数据不再写入.
+func (c *rtmptConn) feed(seq uint64, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return errRtmptClosed
+	}
+
+	c.lastActive = time.Now()
+	if c.fed && seq <= c.lastSeq {
+		return nil
+	}
+	c.fed = true
+	c.lastSeq = seq
+
+	if len(data) > 0 {
+		c.in.Write(data)
+		c.cond.Broadcast()
+	}
+
+	return nil
+}
+
+// poll 返回轮询间隔和需要发送给客户端的数据.
+func (c *rtmptConn) poll() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed && c.out.Len() == 0 {
+		return nil, errRtmptClosed
+	}
+
+	c.lastActive = time.Now()
+	if c.out.Len() > 0 {
+		c.pollDelay = RtmptMinPollDelay
+	} else if c.pollDelay < RtmptMaxPollDelay {
+		c.pollDelay++
+	}
+
+	b := make([]byte, 1+c.out.Len())
+	b[0] = c.pollDelay
+	copy(b[1:], c.out.Bytes())
+	c.out.Reset()
+
+	return b, nil
+}
+
+func (c *rtmptConn) expired(timeout time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.closed || time.Since(c.lastActive) > timeout
+}
+
+// RtmptServer RTMP over HTTP
+//
+//	POST /fcs/ident2         直接返回404
+//	POST /open/1             创建会话 返回会话ID
+//	POST /send/{id}/{seq}    发送数据 返回轮询间隔和服务端的数据
+//	POST /idle/{id}/{seq}    轮询
+//	POST /close/{id}         关闭会话.
+type RtmptServer struct {
+	cfg RtmptConfig
+
+	lock     sync.Mutex
+	sessions map[string]*rtmptConn
+}
+
+func newRtmptServer(cfg RtmptConfig) *RtmptServer {
+	return &RtmptServer{
+		cfg:      cfg,
+		sessions: make(map[string]*rtmptConn),
+	}
+}
+
+func newRtmptSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (s *RtmptServer) get(id string) *rtmptConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sessions[id]
+}
+
+func (s *RtmptServer) remove(id string) {
+	s.lock.Lock()
+	c := s.sessions[id]
+	delete(s.sessions, id)
+	s.lock.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// expire 关闭长时间没有请求的会话.
+func (s *RtmptServer) expire() {
+	for range time.Tick(s.cfg.SessionTimeout / 2) {
+		s.lock.Lock()
+		var expired []string
+		for id, c := range s.sessions {
+			if c.expired(s.cfg.SessionTimeout) {
+				expired = append(expired, id)
+			}
+		}
+		s.lock.Unlock()
+
+		for _, id := range expired {
+			s.remove(id)
+		}
+	}
+}
+
+func (s *RtmptServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, RtmptMaxRequestSize))
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", RtmptContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "Keep-Alive")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "open":
+		s.open(w, r)
+	case len(parts) == 3 && (parts[0] == "send" || parts[0] == "idle"):
+		seq, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "bad sequence", http.StatusBadRequest)
+
+			return
+		}
+		if parts[0] == "idle" {
+			body = nil
+		}
+		s.send(w, parts[1], seq, body)
+	case len(parts) == 2 && parts[0] == "close":
+		s.remove(parts[1])
+		_, _ = w.Write([]byte{0})
+	default:
+		// 包括 /fcs/ident2
+		http.NotFound(w, r)
+	}
+}
+
+func (s *RtmptServer) open(w http.ResponseWriter, r *http.Request) {
+	c := newRtmptConn(newRtmptSessionID(), r.RemoteAddr)
+
+	s.lock.Lock()
+	s.sessions[c.id] = c
+	s.lock.Unlock()
+
+	nc := newNetConnection(c)
+	go func() {
+		nc.HandlerMessage()
+		s.remove(c.id)
+	}()
+
+	_, _ = w.Write([]byte(c.id + "\n"))
+}
+
+func (s *RtmptServer) send(w http.ResponseWriter, id string, seq uint64, data []byte) {
+	c := s.get(id)
+	if c == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+
+		return
+	}
+
+	if err := c.feed(seq, data); err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+
+		return
+	}
+
+	b, err := c.poll()
+	if err != nil {
+		s.remove(id)
+		http.Error(w, "session not found", http.StatusNotFound)
+
+		return
+	}
+
+	_, _ = w.Write(b)
+}
+
+// listenRtmpt 单独的 HTTP 监听 RTMPT 的路径都在根目录下.
+func listenRtmpt(cfg RtmptConfig) error {
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	logger().Info("rtmpt listening", "addr", l.Addr().String())
+
+	s := newRtmptServer(cfg)
+	go s.expire()
+	go func() {
+		if err := http.Serve(l, s); err != nil {
+			logger().Error("rtmpt serve failed", "err", err)
+		}
+	}()
+
+	return nil
+}
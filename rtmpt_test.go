@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRtmptConnFeed(t *testing.T) {
+	c := newRtmptConn("test", "127.0.0.1:1")
+
+	// 第一个 send 的序号是0
+	_ = c.feed(0, []byte("a"))
+	// 重复的请求不再写入
+	_ = c.feed(0, []byte("b"))
+	_ = c.feed(1, []byte("c"))
+	_ = c.feed(1, []byte("d"))
+	_ = c.feed(2, nil)
+	_ = c.feed(2, []byte("e"))
+	if got := c.in.String(); got != "ac" {
+		t.Errorf("fed %q", got)
+	}
+
+	_ = c.Close()
+	if err := c.feed(3, []byte("f")); err != errRtmptClosed {
+		t.Errorf("feed after close: %v", err)
+	}
+}
+
+func TestRtmptConnDeadline(t *testing.T) {
+	c := newRtmptConn("test", "127.0.0.1:1")
+	defer c.Close()
+
+	// 客户端一直不发数据 Read 要在截止时间返回超时
+	_ = c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("read err is %v, want timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("read returned after %v", d)
+	}
+
+	// 清除截止时间后可以继续读
+	_ = c.SetDeadline(time.Time{})
+	_ = c.feed(0, []byte("a"))
+	if n, err := c.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("read %d %v", n, err)
+	}
+}
+
+func TestRtmptServer(t *testing.T) {
+	srv := httptest.NewServer(newRtmptServer(RtmptConfig{SessionTimeout: time.Minute}))
+	defer srv.Close()
+
+	post := func(path string, body []byte) (int, []byte) {
+		resp, err := http.Post(srv.URL+path, RtmptContentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+
+		return resp.StatusCode, b
+	}
+
+	if code, _ := post("/fcs/ident2", nil); code != http.StatusNotFound {
+		t.Errorf("ident2 status %d", code)
+	}
+	if resp, err := http.Get(srv.URL + "/open/1"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("get open: %v %v", resp, err)
+	}
+
+	code, b := post("/open/1", nil)
+	id := strings.TrimSpace(string(b))
+	if code != http.StatusOK || id == "" {
+		t.Fatalf("open %d %q", code, b)
+	}
+
+	// 简单握手 C0C1 在序号0的 send 中
+	c0c1 := make([]byte, 1+HandshakDataLen)
+	c0c1[0] = RtmpHandShakVersion
+	code, b = post("/send/"+id+"/0", c0c1)
+	if code != http.StatusOK || len(b) == 0 {
+		t.Fatalf("send %d %q", code, b)
+	}
+	s0s1s2 := b[1:]
+
+	seq := 1
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s0s1s2) < 1+2*HandshakDataLen {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d bytes of S0S1S2", len(s0s1s2))
+		}
+		code, b = post("/idle/"+id+"/"+strconv.Itoa(seq), nil)
+		if code != http.StatusOK || len(b) == 0 {
+			t.Fatalf("idle %d %q", code, b)
+		}
+		s0s1s2 = append(s0s1s2, b[1:]...)
+		seq++
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s0s1s2[0] != RtmpHandShakVersion || len(s0s1s2) != 1+2*HandshakDataLen {
+		t.Fatalf("S0S1S2 %d bytes version %d", len(s0s1s2), s0s1s2[0])
+	}
+
+	// 没有数据时轮询间隔逐渐增大
+	_, first := post("/idle/"+id+"/"+strconv.Itoa(seq), nil)
+	_, second := post("/idle/"+id+"/"+strconv.Itoa(seq+1), nil)
+	if len(first) != 1 || len(second) != 1 || second[0] <= first[0] {
+		t.Errorf("poll delay %v %v", first, second)
+	}
+
+	if code, b = post("/close/"+id, nil); code != http.StatusOK || !bytes.Equal(b, []byte{0}) {
+		t.Errorf("close %d %q", code, b)
+	}
+	if code, _ = post("/idle/"+id+"/"+strconv.Itoa(seq+2), nil); code != http.StatusNotFound {
+		t.Errorf("idle after close status %d", code)
+	}
+	if code, _ = post("/send/"+id+"/x", nil); code != http.StatusBadRequest {
+		t.Errorf("bad sequence status %d", code)
+	}
+}
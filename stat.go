@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NginxRtmpVersion stat 中输出的 nginx-rtmp 版本 兼容按照版本解析的工具.
+const NginxRtmpVersion = "1.1.4"
+
+var startTime = time.Now()
+
+// nginx-rtmp 中使用的编码名字 按照 FLV tag 中的编码ID.
+var (
+	statVideoCodecNames = []string{
+		"", "Jpeg", "Sorenson-H263", "ScreenVideo", "On2-VP6", "On2-VP6-Alpha", "ScreenVideo2", "H264",
+	}
+	statAudioCodecNames = []string{
+		"", "ADPCM", "MP3", "LinearLE", "Nellymoser16", "Nellymoser8", "Nellymoser", "G711A", "G711U",
+		"", "AAC", "Speex", "", "", "MP3-8K", "DeviceSpecific", "Uncompressed",
+	}
+)
+
+// statRtmp nginx-rtmp stat 模块的XML格式.
+type statRtmp struct {
+	XMLName          xml.Name     `xml:"rtmp"`
+	NginxVersion     string       `xml:"nginx_version"`
+	NginxRtmpVersion string       `xml:"nginx_rtmp_version"`
+	Compiler         string       `xml:"compiler"`
+	PID              int          `xml:"pid"`
+	Uptime           int64        `xml:"uptime"`
+	NAccepted        uint64       `xml:"naccepted"`
+	BwIn             uint64       `xml:"bw_in"`
+	BytesIn          uint64       `xml:"bytes_in"`
+	BwOut            uint64       `xml:"bw_out"`
+	BytesOut         uint64       `xml:"bytes_out"`
+	Servers          []statServer `xml:"server"`
+}
+
+type statServer struct {
+	Applications []statApplication `xml:"application"`
+}
+
+type statApplication struct {
+	Name string   `xml:"name"`
+	Live statLive `xml:"live"`
+}
+
+type statLive struct {
+	Streams  []statStream `xml:"stream"`
+	NClients int          `xml:"nclients"`
+}
+
+type statStream struct {
+	Name       string       `xml:"name"`
+	Time       int64        `xml:"time"`
+	BwIn       uint64       `xml:"bw_in"`
+	BytesIn    uint64       `xml:"bytes_in"`
+	BwOut      uint64       `xml:"bw_out"`
+	BytesOut   uint64       `xml:"bytes_out"`
+	BwAudio    uint64       `xml:"bw_audio"`
+	BwVideo    uint64       `xml:"bw_video"`
+	Clients    []statClient `xml:"client"`
+	Meta       *statMeta    `xml:"meta"`
+	NClients   int          `xml:"nclients"`
+	Publishing *struct{}    `xml:"publishing"`
+	Active     *struct{}    `xml:"active"`
+}
+
+type statClient struct {
+	ID         uint64    `xml:"id"`
+	Address    string    `xml:"address"`
+	Time       int64     `xml:"time"`
+	FlashVer   string    `xml:"flashver"`
+	SwfURL     string    `xml:"swfurl,omitempty"`
+	PageURL    string    `xml:"pageurl,omitempty"`
+	Dropped    uint64    `xml:"dropped"`
+	Publishing *struct{} `xml:"publishing"`
+	Active     *struct{} `xml:"active"`
+}
+
+type statMeta struct {
+	Video *statVideo `xml:"video"`
+	Audio *statAudio `xml:"audio"`
+}
+
+type statVideo struct {
+	Width     int    `xml:"width"`
+	Height    int    `xml:"height"`
+	FrameRate int    `xml:"frame_rate"`
+	Codec     string `xml:"codec"`
+	Profile   string `xml:"profile,omitempty"`
+	Compat    int    `xml:"compat,omitempty"`
+	Level     string `xml:"level,omitempty"`
+}
+
+type statAudio struct {
+	Codec      string `xml:"codec"`
+	Profile    string `xml:"profile,omitempty"`
+	Channels   int    `xml:"channels"`
+	SampleRate int    `xml:"sample_rate"`
+}
+
+// statFlag 空元素 例如 <publishing/> 只在为true时输出.
+func statFlag(b bool) *struct{} {
+	if b {
+		return &struct{}{}
+	}
+
+	return nil
+}
+
+// statAllowed stat 和 control 只允许 stat.access 中的地址访问.
+func statAllowed(r *http.Request) bool {
+	return checkAccess(conf().Stat.Access, net.ParseIP(clientIP(r.RemoteAddr)))
+}
+
+// statHandler 输出和 nginx-rtmp stat 相同格式的XML.
+type statHandler struct{}
+
+func (statHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !statAllowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeStat(&buf, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// statVhosts 每个虚拟主机对应 nginx 中的一个 server 默认虚拟主机在最前面 control 中的 srv 是这里的下标.
+func statVhosts() []string {
+	vhosts := []string{""}
+	for _, v := range conf().Vhosts {
+		vhosts = append(vhosts, v.Name)
+	}
+
+	return vhosts
+}
+
+func writeStat(w io.Writer, now time.Time) error {
+	// 按照流汇总客户端 转推和拉流的连接不是客户端
+	type streamClient struct {
+		info ClientInfo
+		cs   ClientStream
+	}
+	streamClients := make(map[*Stream][]streamClient)
+	for _, nc := range clients.List() {
+		info := nc.Info()
+		for _, cs := range info.Streams {
+			streamClients[cs.stream] = append(streamClients[cs.stream], streamClient{info, cs})
+		}
+	}
+
+	appStreams := make(map[string][]*Stream)
+	for _, s := range streamManager.Streams() {
+		key := s.Vhost + ":" + s.App
+		appStreams[key] = append(appStreams[key], s)
+	}
+
+	in, out := clients.Bytes()
+	rtmp := statRtmp{
+		NginxVersion:     EngineVersion,
+		NginxRtmpVersion: NginxRtmpVersion,
+		Compiler:         runtime.Version(),
+		PID:              os.Getpid(),
+		Uptime:           int64(now.Sub(startTime).Seconds()),
+		NAccepted:        clients.Accepted(),
+		BytesIn:          in,
+		BytesOut:         out,
+	}
+
+	apps := listApps()
+	for _, vhost := range statVhosts() {
+		var server statServer
+		for _, app := range apps {
+			if app.Vhost != vhost {
+				continue
+			}
+
+			sa := statApplication{Name: app.Name}
+			streams := appStreams[vhost+":"+app.Name]
+			sort.Slice(streams, func(i, j int) bool {
+				return streams[i].Name < streams[j].Name
+			})
+			for _, s := range streams {
+				st := s.Stats()
+				ss := statStream{
+					Name:       st.Name,
+					BwIn:       uint64(st.BitrateKbps * 1000),
+					BytesIn:    st.BytesIn,
+					BwAudio:    uint64(st.AudioKbps * 1000),
+					BwVideo:    uint64(st.VideoKbps * 1000),
+					Publishing: statFlag(st.PublishTime != nil),
+					Active:     statFlag(st.PublishTime != nil),
+				}
+				if st.PublishTime != nil {
+					ss.Time = now.Sub(*st.PublishTime).Milliseconds()
+				}
+
+				for _, c := range streamClients[s] {
+					ss.Clients = append(ss.Clients, statClient{
+						ID:         c.info.ID,
+						Address:    clientIP(c.info.Addr),
+						Time:       now.Sub(c.info.ConnectedAt).Milliseconds(),
+						FlashVer:   c.info.FlashVer,
+						SwfURL:     c.info.SwfURL,
+						PageURL:    c.info.PageURL,
+						Dropped:    c.cs.Dropped(),
+						Publishing: statFlag(c.cs.Publishing),
+						Active:     statFlag(true),
+					})
+					if !c.cs.Publishing {
+						ss.BytesOut += c.info.BytesOut
+					}
+				}
+				ss.NClients = len(ss.Clients)
+				// 播放端的码率和发布端相同
+				ss.BwOut = ss.BwIn * uint64(st.Subscribers)
+				ss.Meta = newStatMeta(st)
+
+				sa.Live.Streams = append(sa.Live.Streams, ss)
+				sa.Live.NClients += ss.NClients
+				rtmp.BwIn += ss.BwIn
+				rtmp.BwOut += ss.BwOut
+			}
+
+			server.Applications = append(server.Applications, sa)
+		}
+		rtmp.Servers = append(rtmp.Servers, server)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	return enc.Encode(rtmp)
+}
+
+func newStatMeta(st StreamStats) *statMeta {
+	if st.Video == nil && st.Audio == nil {
+		return nil
+	}
+
+	meta := &statMeta{}
+	if v := st.Video; v != nil {
+		meta.Video = &statVideo{
+			Width:     v.Width,
+			Height:    v.Height,
+			FrameRate: int(st.FrameRate + 0.5),
+			Codec:     statCodecName(statVideoCodecNames, v.CodecID),
+			Profile:   v.Profile,
+			Compat:    v.Compat,
+			Level:     v.Level,
+		}
+	}
+	if a := st.Audio; a != nil {
+		meta.Audio = &statAudio{
+			Codec:      statCodecName(statAudioCodecNames, a.CodecID),
+			Profile:    a.Profile,
+			Channels:   a.Channels,
+			SampleRate: a.SampleRate,
+		}
+	}
+
+	return meta
+}
+
+func statCodecName(names []string, id byte) string {
+	if int(id) < len(names) {
+		return names[id]
+	}
+
+	return ""
+}
+
+// ControlHandler 兼容 nginx-rtmp 的 control 模块 路径相对于 stat.control_path
+//
+//	drop/{publisher|subscriber|client}?app=&name=&addr=&clientid=
+//	redirect/{publisher|subscriber|client}?app=&name=&addr=&clientid=&newname=
+//	record/{start|stop}?app=&name=&rec=
+//
+// 虚拟主机使用 vhost= 或者 srv= 指定 srv 是 stat 中 server 的下标.
+type ControlHandler struct {
+	prefix string
+}
+
+func newControlHandler(prefix string) *ControlHandler {
+	return &ControlHandler{prefix: prefix}
+}
+
+func (c *ControlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !statAllowed(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+
+		return
+	}
+
+	q := r.URL.Query()
+	vhost, err := controlVhost(q.Get("vhost"), q.Get("srv"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, c.prefix), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	switch parts[0] {
+	case "drop", "redirect":
+		c.clientAction(w, r, vhost, parts[0], parts[1])
+	case "record":
+		c.record(w, r, vhost, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func controlVhost(vhost, srv string) (string, error) {
+	if vhost != "" || srv == "" {
+		return vhost, nil
+	}
+
+	vhosts := statVhosts()
+	i, err := strconv.Atoi(srv)
+	if err != nil || i < 0 || i >= len(vhosts) {
+		return "", fmt.Errorf("invalid srv %s", srv)
+	}
+
+	return vhosts[i], nil
+}
+
+// clientAction 关闭或者重定向匹配的客户端 返回匹配的个数.
+func (c *ControlHandler) clientAction(w http.ResponseWriter, r *http.Request, vhost, action, kind string) {
+	if kind != "publisher" && kind != "subscriber" && kind != "client" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	q := r.URL.Query()
+	newName := q.Get("newname")
+	if action == "redirect" && newName == "" {
+		http.Error(w, "newname is required", http.StatusBadRequest)
+
+		return
+	}
+	var id uint64
+	if s := q.Get("clientid"); s != "" {
+		var err error
+		if id, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "invalid clientid", http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	count := 0
+	for _, nc := range clients.List() {
+		info := nc.Info()
+		if id != 0 && info.ID != id {
+			continue
+		}
+		if addr := q.Get("addr"); addr != "" && clientIP(info.Addr) != addr {
+			continue
+		}
+
+		for _, cs := range info.Streams {
+			if cs.Vhost != vhost ||
+				(q.Get("app") != "" && cs.App != q.Get("app")) ||
+				(q.Get("name") != "" && cs.Name != q.Get("name")) ||
+				(kind == "publisher" && !cs.Publishing) ||
+				(kind == "subscriber" && cs.Publishing) {
+				continue
+			}
+
+			if action == "drop" {
+				_ = nc.Close()
+				logger().With("conn", info.ID, "remote", info.Addr).Info("dropped by control", "stream", cs.Name)
+				count++
+
+				break
+			}
+
+			if err := cs.ns.redirect(newName); err != nil {
+				logger().With("conn", info.ID, "remote", info.Addr).Warn("redirect by control failed", "stream", cs.Name, "to", newName, "err", err)
+
+				continue
+			}
+			count++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprint(w, count)
+}
+
+// record 开始或者停止录制 返回录制的文件 rec 只是为了兼容 每路流只有一个录制.
+func (c *ControlHandler) record(w http.ResponseWriter, r *http.Request, vhost, action string) {
+	if action != "start" && action != "stop" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("app") == "" || q.Get("name") == "" {
+		http.Error(w, "app and name are required", http.StatusBadRequest)
+
+		return
+	}
+	s := streamManager.Get(vhost, q.Get("app"), q.Get("name"))
+	if s == nil || s.Publisher() == nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+
+		return
+	}
+
+	var path string
+	if action == "start" {
+		var err error
+		if path, err = recordManager.Start(s, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	} else {
+		path = recordManager.Stop(s)
+	}
+
+	if path == "" {
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, path)
+}
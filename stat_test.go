@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatAndControl(t *testing.T) {
+	defer setConfig(conf())
+
+	c := *conf()
+	c.Stat = StatConfig{Path: "/stat", ControlPath: "/control/", Access: []string{"allow 192.0.2.1", "deny all"}}
+	setConfig(&c)
+
+	addr := startTestServer(t)
+	control := newControlHandler("/control/")
+	do := func(h http.Handler, path, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if remote != "" {
+			req.RemoteAddr = remote
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		return w
+	}
+
+	if w := do(statHandler{}, "/stat", "198.51.100.1:1234"); w.Code != http.StatusForbidden {
+		t.Fatalf("denied address: %d", w.Code)
+	}
+
+	pub, err := DialRtmp(fmt.Sprintf("rtmp://%s/live/stat", addr), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err = pub.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	seq := &AVPacket{Type: RtmpMsgVideo, Payload: []byte{0x17, 0, 0, 0, 0}}
+	if err = pub.WritePacket(seq); err != nil {
+		t.Fatal(err)
+	}
+
+	player, err := DialRtmp(fmt.Sprintf("rtmp://%s/live/stat", addr), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	if err = player.Play(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待服务端处理完 publish 和 play
+	var stat statRtmp
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		w := do(statHandler{}, "/stat", "")
+		stat = statRtmp{}
+		if err = xml.Unmarshal(w.Body.Bytes(), &stat); err != nil {
+			t.Fatal(err)
+		}
+		if live := stat.Servers[0].Applications; len(live) == 1 && live[0].Live.NClients == 2 &&
+			live[0].Live.Streams[0].Meta != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stat is %+v", stat)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	app := stat.Servers[0].Applications[0]
+	s := app.Live.Streams[0]
+	if app.Name != "live" || s.Name != "stat" || s.Publishing == nil || s.Meta.Video.Codec != "H264" {
+		t.Errorf("stream is %+v", s)
+	}
+	if stat.NAccepted < 2 || len(s.Clients) != 2 {
+		t.Errorf("stat is %+v", stat)
+	}
+
+	if w := do(control, "/control/redirect/subscriber?app=live&name=stat", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("redirect without newname: %d", w.Code)
+	}
+	if w := do(control, "/control/redirect/subscriber?app=live&name=stat&newname=stat2", ""); w.Body.String() != "1" {
+		t.Fatalf("redirect subscriber: %d %s", w.Code, w.Body.String())
+	}
+	if st := streamManager.Get("", "live", "stat2"); st == nil || st.SubscriberCount() != 1 {
+		t.Errorf("subscriber not redirected")
+	}
+
+	if w := do(control, "/control/redirect/publisher?app=live&name=stat&newname=stat2", ""); w.Body.String() != "1" {
+		t.Fatalf("redirect publisher: %d %s", w.Code, w.Body.String())
+	}
+	st := streamManager.Get("", "live", "stat2")
+	if st == nil || st.Publisher() == nil {
+		t.Fatal("publisher not redirected")
+	}
+	if _, video, _ := st.SequenceHeaders(); video == nil {
+		t.Error("sequence header not copied")
+	}
+	if streamManager.Get("", "live", "stat") != nil {
+		t.Error("old stream not removed")
+	}
+
+	if w := do(control, "/control/record/stop?app=live&name=none", ""); w.Code != http.StatusNotFound {
+		t.Errorf("record unknown stream: %d", w.Code)
+	}
+	if w := do(control, "/control/drop/publisher?srv=9&app=live", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid srv: %d", w.Code)
+	}
+	if w := do(control, "/control/drop/publisher?srv=0&app=live&name=stat2", ""); w.Body.String() != "1" {
+		t.Fatalf("drop publisher: %d %s", w.Code, w.Body.String())
+	}
+	for st.Publisher() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publisher not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteStatEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeStat(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	var stat statRtmp
+	if err := xml.Unmarshal(buf.Bytes(), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.NginxRtmpVersion != NginxRtmpVersion || len(stat.Servers) != 1+len(conf().Vhosts) {
+		t.Errorf("stat is %+v", stat)
+	}
+}
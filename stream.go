@@ -0,0 +1,692 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// 每个订阅者缓存的最大包数，超过后丢弃到下一个关键帧
+	SubscriberQueueSize = 1024
+	// GOP缓存的最大包数，防止没有关键帧的流把内存占满
+	MaxGopCacheSize = 2048
+)
+
+var ErrStreamAlreadyPublished = errors.New("stream already published")
+
+// AVPacket 发布端发送过来的一个音视频/脚本数据包.
+type AVPacket struct {
+	Type      byte // RtmpMsgAudio  RtmpMsgVideo RtmpMsgAMF0Data
+	Timestamp uint32
+	Payload   []byte
+}
+
+func (p *AVPacket) IsVideo() bool {
+	return p.Type == RtmpMsgVideo
+}
+
+func (p *AVPacket) IsAudio() bool {
+	return p.Type == RtmpMsgAudio
+}
+
+func (p *AVPacket) IsMetaData() bool {
+	return p.Type == RtmpMsgAMF0Data || p.Type == RtmpMsgAMF3Data
+}
+
+// IsKeyFrame 视频Tag的第一个byte 高4bit为FrameType 1表示关键帧.
+func (p *AVPacket) IsKeyFrame() bool {
+	return p.IsVideo() && len(p.Payload) > 0 && p.Payload[0]>>4 == 1
+}
+
+// IsSequenceHeader AVC/AAC的sequence header  第二个byte为0.
+func (p *AVPacket) IsSequenceHeader() bool {
+	if len(p.Payload) < 2 {
+		return false
+	}
+
+	switch p.Type {
+	case RtmpMsgVideo:
+		return p.Payload[0]&0x0f == FlvCodecAVC && p.Payload[1] == 0
+	case RtmpMsgAudio:
+		return p.Payload[0]>>4 == FlvCodecAAC && p.Payload[1] == 0
+	}
+
+	return false
+}
+
+// newAVPacket 将收到的音视频和数据消息转换为 AVPacket
+// 数据消息只保留 onMetaData 并去掉 @setDataFrame AMF3 的数据消息转换为 AMF0 其他的返回nil.
+func newAVPacket(msg *Chunk) *AVPacket {
+	p := &AVPacket{
+		Type:      msg.MessageTypeID,
+		Timestamp: msg.Timestamp,
+		Payload:   msg.Body,
+	}
+
+	switch msg.MessageTypeID {
+	case RtmpMsgAudio, RtmpMsgVideo:
+		return p
+	case RtmpMsgAMF0Data, RtmpMsgAMF3Data:
+	default:
+		return nil
+	}
+
+	data, ok := msg.MsgData.(*DataMessage)
+	if !ok {
+		return nil
+	}
+
+	// 和解析时一样 AMF3 的数据消息只有第一个byte为0时才去掉
+	payload := msg.Body
+	if msg.MessageTypeID == RtmpMsgAMF3Data && len(payload) > 0 && payload[0] == 0 {
+		payload = payload[1:]
+	}
+	// @setDataFrame 后面跟着的才是 onMetaData 转发给播放端时需要去掉
+	// string的编码是 1byte类型 + 2byte长度 + 内容
+	if data.Name == DataSetDataFrame {
+		if len(data.Values) == 0 || data.Values[0] != DataOnMetaData {
+			return nil
+		}
+		n := 3 + len(DataSetDataFrame)
+		if len(payload) <= n {
+			return nil
+		}
+		payload = payload[n:]
+	} else if data.Name != DataOnMetaData {
+		return nil
+	}
+
+	p.Type = RtmpMsgAMF0Data
+	p.Payload = payload
+
+	return p
+}
+
+// Publisher 直播流的数据来源，可以是一个推流的连接，也可以是回源拉流.
+type Publisher interface {
+	Close() error
+}
+
+// Subscriber 直播流的一个订阅者 每个订阅者有自己独立的队列，慢的订阅者不会阻塞其他订阅者.
+type Subscriber struct {
+	ID           string
+	packets      chan *AVPacket
+	waitKeyFrame bool
+	dropped      uint64
+	// DASH 录制 转推等服务端内部的订阅者 不算作播放者
+	internal bool
+}
+
+func newSubscriber(id string) *Subscriber {
+	return &Subscriber{
+		ID:      id,
+		packets: make(chan *AVPacket, SubscriberQueueSize),
+	}
+}
+
+func newInternalSubscriber(id string) *Subscriber {
+	sub := newSubscriber(id)
+	sub.internal = true
+
+	return sub
+}
+
+func (sub *Subscriber) Packets() <-chan *AVPacket {
+	return sub.packets
+}
+
+// push 非阻塞写入 若队列已满则清空队列，并且丢弃后面的包直到下一个关键帧.
+func (sub *Subscriber) push(p *AVPacket) {
+	if sub.waitKeyFrame {
+		if !p.IsKeyFrame() && !p.IsSequenceHeader() && !p.IsMetaData() {
+			sub.dropped++
+
+			return
+		}
+		sub.waitKeyFrame = false
+	}
+
+	select {
+	case sub.packets <- p:
+		return
+	default:
+	}
+
+	for {
+		select {
+		case <-sub.packets:
+			sub.dropped++
+
+			continue
+		default:
+		}
+
+		break
+	}
+	sub.waitKeyFrame = true
+}
+
+// Stream 一路直播流 由 vhost + app + streamName 唯一确定 默认虚拟主机的 Vhost 为空.
+type Stream struct {
+	Vhost string
+	App   string
+	Name  string
+
+	lock           sync.RWMutex
+	publisher      Publisher
+	publishTime    time.Time
+	metaData       *AVPacket
+	videoSeqHeader *AVPacket
+	audioSeqHeader *AVPacket
+	gopCache       []*AVPacket
+	useGopCache    bool
+	subscribers    map[*Subscriber]struct{}
+
+	// 发布以来的统计 在 WritePacket 中更新
+	bytesIn     uint64
+	videoFrames uint64
+	audioFrames uint64
+	// 最近的音视频Tag的第一个byte 其中有 CodecID 没有收到过时为0
+	videoTag byte
+	audioTag byte
+	meter    rateMeter
+}
+
+// rateMeter 每秒计算一次码率和帧率.
+type rateMeter struct {
+	start      time.Time
+	bytes      uint64
+	videoBytes uint64
+	audioBytes uint64
+	frames     uint64
+	// bit/s
+	bitrate      float64
+	videoBitrate float64
+	audioBitrate float64
+	frameRate    float64
+}
+
+func (m *rateMeter) add(now time.Time, p *AVPacket, frame bool) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += uint64(len(p.Payload))
+	switch {
+	case p.IsVideo():
+		m.videoBytes += uint64(len(p.Payload))
+	case p.IsAudio():
+		m.audioBytes += uint64(len(p.Payload))
+	}
+	if frame {
+		m.frames++
+	}
+
+	if d := now.Sub(m.start).Seconds(); d >= 1 {
+		m.bitrate = float64(m.bytes) * 8 / d
+		m.videoBitrate = float64(m.videoBytes) * 8 / d
+		m.audioBitrate = float64(m.audioBytes) * 8 / d
+		m.frameRate = float64(m.frames) / d
+		*m = rateMeter{
+			start:        now,
+			bitrate:      m.bitrate,
+			videoBitrate: m.videoBitrate,
+			audioBitrate: m.audioBitrate,
+			frameRate:    m.frameRate,
+		}
+	}
+}
+
+// StreamVideo 视频的编码信息 来自 sequence header.
+type StreamVideo struct {
+	CodecID byte   `json:"codec_id"`
+	Codec   string `json:"codec"`
+	Profile string `json:"profile,omitempty"`
+	Compat  int    `json:"compat,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+}
+
+// StreamAudio 音频的编码信息.
+type StreamAudio struct {
+	CodecID    byte   `json:"codec_id"`
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+}
+
+// StreamStats 一路流当前的状态 没有发布者时 Publisher 为空.
+type StreamStats struct {
+	Vhost       string       `json:"vhost,omitempty"`
+	App         string       `json:"app"`
+	Name        string       `json:"name"`
+	Publisher   string       `json:"publisher,omitempty"`
+	PublishTime *time.Time   `json:"publish_time,omitempty"`
+	Uptime      float64      `json:"uptime_seconds"`
+	Subscribers int          `json:"subscribers"`
+	BytesIn     uint64       `json:"bytes_in"`
+	VideoFrames uint64       `json:"video_frames"`
+	AudioFrames uint64       `json:"audio_frames"`
+	BitrateKbps float64      `json:"bitrate_kbps"`
+	VideoKbps   float64      `json:"video_kbps"`
+	AudioKbps   float64      `json:"audio_kbps"`
+	FrameRate   float64      `json:"frame_rate"`
+	Video       *StreamVideo `json:"video,omitempty"`
+	Audio       *StreamAudio `json:"audio,omitempty"`
+	MetaData    AMFObjects   `json:"metadata,omitempty"`
+}
+
+func newStream(vhost, app, name string) *Stream {
+	return &Stream{
+		Vhost:       vhost,
+		App:         app,
+		Name:        name,
+		useGopCache: conf().App(vhost, app).UseGopCache(),
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+func (s *Stream) Key() string {
+	return streamKey(s.Vhost, s.App, s.Name)
+}
+
+func (s *Stream) Publisher() Publisher {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.publisher
+}
+
+func (s *Stream) PublishTime() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.publishTime
+}
+
+// setGopCache 修改是否缓存GOP 关闭时清空已经缓存的数据.
+func (s *Stream) setGopCache(use bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.useGopCache = use
+	if !use {
+		s.gopCache = nil
+	}
+}
+
+func (s *Stream) SubscriberCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.subscribers)
+}
+
+// PlayerCount 播放者的数量 不包括内部的订阅者.
+func (s *Stream) PlayerCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	n := 0
+	for sub := range s.subscribers {
+		if !sub.internal {
+			n++
+		}
+	}
+
+	return n
+}
+
+// SequenceHeaders 返回当前的 metaData 和音视频的 sequence header 没有的为nil.
+func (s *Stream) SequenceHeaders() (metaData, video, audio *AVPacket) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.metaData, s.videoSeqHeader, s.audioSeqHeader
+}
+
+// WritePacket 发布端写入一个包 并分发给所有的订阅者.
+func (s *Stream) WritePacket(p *AVPacket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.count(p)
+
+	switch {
+	case p.IsMetaData():
+		s.metaData = p
+	case p.IsSequenceHeader() && p.IsVideo():
+		s.videoSeqHeader = p
+	case p.IsSequenceHeader() && p.IsAudio():
+		s.audioSeqHeader = p
+	case !s.useGopCache:
+	case p.IsKeyFrame():
+		s.gopCache = append(s.gopCache[:0], p)
+	case len(s.gopCache) > 0 && len(s.gopCache) < MaxGopCacheSize:
+		s.gopCache = append(s.gopCache, p)
+	}
+
+	for sub := range s.subscribers {
+		sub.push(p)
+	}
+}
+
+// count 需要持有 s.lock.
+func (s *Stream) count(p *AVPacket) {
+	s.bytesIn += uint64(len(p.Payload))
+	frame := false
+	if len(p.Payload) > 0 && !p.IsSequenceHeader() {
+		switch {
+		case p.IsVideo():
+			s.videoFrames++
+			s.videoTag = p.Payload[0]
+			frame = true
+		case p.IsAudio():
+			s.audioFrames++
+			s.audioTag = p.Payload[0]
+		}
+	}
+	s.meter.add(time.Now(), p, frame)
+}
+
+// Stats 返回流当前的状态 编码信息从 sequence header 和 metaData 中解析.
+func (s *Stream) Stats() StreamStats {
+	s.lock.RLock()
+	st := StreamStats{
+		Vhost:       s.Vhost,
+		App:         s.App,
+		Name:        s.Name,
+		Subscribers: len(s.subscribers),
+	}
+	publisher := s.publisher
+	if publisher != nil {
+		t := s.publishTime
+		st.PublishTime = &t
+		st.Uptime = time.Since(t).Seconds()
+		st.BytesIn = s.bytesIn
+		st.VideoFrames = s.videoFrames
+		st.AudioFrames = s.audioFrames
+		st.BitrateKbps = s.meter.bitrate / 1000
+		st.VideoKbps = s.meter.videoBitrate / 1000
+		st.AudioKbps = s.meter.audioBitrate / 1000
+		st.FrameRate = s.meter.frameRate
+	}
+	// 复用 probe 的解析 没有 sequence header 的编码只有名字
+	r := &ProbeReport{}
+	for _, p := range []*AVPacket{s.metaData, s.videoSeqHeader, s.audioSeqHeader} {
+		if p != nil {
+			r.handle(p)
+		}
+	}
+	videoTag, audioTag := s.videoTag, s.audioTag
+	if s.videoSeqHeader != nil {
+		videoTag = s.videoSeqHeader.Payload[0]
+	}
+	if s.audioSeqHeader != nil {
+		audioTag = s.audioSeqHeader.Payload[0]
+	}
+	if r.Video == nil && videoTag != 0 {
+		r.track(&AVPacket{Type: RtmpMsgVideo, Payload: []byte{videoTag}})
+	}
+	if r.Audio == nil && audioTag != 0 {
+		r.track(&AVPacket{Type: RtmpMsgAudio, Payload: []byte{audioTag}})
+	}
+	s.lock.RUnlock()
+
+	if a, ok := publisher.(interface{ RemoteAddr() string }); ok {
+		st.Publisher = a.RemoteAddr()
+	}
+	if v := r.Video; v != nil {
+		st.Video = &StreamVideo{
+			CodecID: videoTag & 0x0f, Codec: v.Codec, Profile: v.Profile, Compat: v.Compat,
+			Level: v.Level, Width: v.Width, Height: v.Height,
+		}
+	}
+	if a := r.Audio; a != nil {
+		st.Audio = &StreamAudio{
+			CodecID: audioTag >> 4, Codec: a.Codec, Profile: a.Profile,
+			SampleRate: a.SampleRate, Channels: a.Channels,
+		}
+	}
+	st.MetaData = r.MetaData
+
+	return st
+}
+
+// Dropped 订阅者因为太慢丢弃的包数.
+func (s *Stream) Dropped(sub *Subscriber) uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return sub.dropped
+}
+
+func (s *Stream) addSubscriber(sub *Subscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 新的订阅者先把 metaData, sequence header 和 GOP缓存发过去 这样可以秒开
+	if s.metaData != nil {
+		sub.push(s.metaData)
+	}
+	if s.videoSeqHeader != nil {
+		sub.push(s.videoSeqHeader)
+	}
+	if s.audioSeqHeader != nil {
+		sub.push(s.audioSeqHeader)
+	}
+	for _, p := range s.gopCache {
+		sub.push(p)
+	}
+
+	s.subscribers[sub] = struct{}{}
+}
+
+func (s *Stream) removeSubscriber(sub *Subscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.subscribers, sub)
+}
+
+func (s *Stream) idle() bool {
+	return s.publisher == nil && len(s.subscribers) == 0
+}
+
+type StreamHook func(s *Stream)
+
+// StreamManager 管理所有的直播流.
+type StreamManager struct {
+	lock             sync.RWMutex
+	streams          map[string]*Stream
+	publishHooks     []StreamHook
+	unpublishHooks   []StreamHook
+	subscribeHooks   []StreamHook
+	unsubscribeHooks []StreamHook
+}
+
+var streamManager = newStreamManager()
+
+func newStreamManager() *StreamManager {
+	return &StreamManager{
+		streams: make(map[string]*Stream),
+	}
+}
+
+// streamKey 默认虚拟主机为 app/name 其他的为 vhost:app/name 域名中不会有 ':'.
+func streamKey(vhost, app, name string) string {
+	if vhost == "" {
+		return app + "/" + name
+	}
+
+	return vhost + ":" + app + "/" + name
+}
+
+// OnPublish 注册发布回调 在流开始发布后调用.
+func (m *StreamManager) OnPublish(h StreamHook) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.publishHooks = append(m.publishHooks, h)
+}
+
+// OnUnpublish 注册停止发布回调.
+func (m *StreamManager) OnUnpublish(h StreamHook) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.unpublishHooks = append(m.unpublishHooks, h)
+}
+
+// OnSubscribe 注册订阅回调 在订阅者加入后调用.
+func (m *StreamManager) OnSubscribe(h StreamHook) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.subscribeHooks = append(m.subscribeHooks, h)
+}
+
+// OnUnsubscribe 注册取消订阅回调 在订阅者离开后调用.
+func (m *StreamManager) OnUnsubscribe(h StreamHook) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.unsubscribeHooks = append(m.unsubscribeHooks, h)
+}
+
+func (m *StreamManager) Get(vhost, app, name string) *Stream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.streams[streamKey(vhost, app, name)]
+}
+
+func (m *StreamManager) Streams() []*Stream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	streams := make([]*Stream, 0, len(m.streams))
+	for _, s := range m.streams {
+		streams = append(streams, s)
+	}
+
+	return streams
+}
+
+func (m *StreamManager) getOrCreate(vhost, app, name string) *Stream {
+	key := streamKey(vhost, app, name)
+
+	s, ok := m.streams[key]
+	if !ok {
+		s = newStream(vhost, app, name)
+		m.streams[key] = s
+	}
+
+	return s
+}
+
+// Publish 开始发布一路流 若该流已经有发布者则返回 ErrStreamAlreadyPublished.
+func (m *StreamManager) Publish(vhost, app, name string, p Publisher) (*Stream, error) {
+	m.lock.Lock()
+	s := m.getOrCreate(vhost, app, name)
+
+	s.lock.Lock()
+	if s.publisher != nil {
+		s.lock.Unlock()
+		m.lock.Unlock()
+
+		return nil, ErrStreamAlreadyPublished
+	}
+	s.publisher = p
+	s.publishTime = time.Now()
+	s.metaData = nil
+	s.videoSeqHeader = nil
+	s.audioSeqHeader = nil
+	s.gopCache = nil
+	s.bytesIn, s.videoFrames, s.audioFrames = 0, 0, 0
+	s.videoTag, s.audioTag = 0, 0
+	s.meter = rateMeter{}
+	s.lock.Unlock()
+
+	hooks := m.publishHooks
+	m.lock.Unlock()
+
+	for _, h := range hooks {
+		h(s)
+	}
+
+	return s, nil
+}
+
+// Unpublish 停止发布 只有当前的发布者才能停止.
+func (m *StreamManager) Unpublish(s *Stream, p Publisher) {
+	m.lock.Lock()
+
+	s.lock.Lock()
+	if s.publisher != p {
+		s.lock.Unlock()
+		m.lock.Unlock()
+
+		return
+	}
+	s.publisher = nil
+	s.gopCache = nil
+	idle := s.idle()
+	s.lock.Unlock()
+
+	if idle {
+		m.remove(s)
+	}
+
+	hooks := m.unpublishHooks
+	m.lock.Unlock()
+
+	for _, h := range hooks {
+		h(s)
+	}
+}
+
+// Subscribe 订阅一路流 流还没有发布时也可以订阅，等发布后就会收到数据.
+func (m *StreamManager) Subscribe(vhost, app, name string, sub *Subscriber) *Stream {
+	m.lock.Lock()
+	s := m.getOrCreate(vhost, app, name)
+	s.addSubscriber(sub)
+	hooks := m.subscribeHooks
+	m.lock.Unlock()
+
+	for _, h := range hooks {
+		h(s)
+	}
+
+	return s
+}
+
+func (m *StreamManager) Unsubscribe(s *Stream, sub *Subscriber) {
+	m.lock.Lock()
+	s.removeSubscriber(sub)
+
+	s.lock.RLock()
+	idle := s.idle()
+	s.lock.RUnlock()
+
+	if idle {
+		m.remove(s)
+	}
+
+	hooks := m.unsubscribeHooks
+	m.lock.Unlock()
+
+	for _, h := range hooks {
+		h(s)
+	}
+}
+
+// remove 需要持有 m.lock.
+func (m *StreamManager) remove(s *Stream) {
+	if m.streams[s.Key()] == s {
+		delete(m.streams, s.Key())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"rtmp/mem_pool"
+)
+
+func dataChunk(t byte, body []byte) *Chunk {
+	c := &Chunk{ChunkHeader: &ChunkHeader{}, Body: body}
+	c.MessageTypeID = t
+	c.MessageLength = uint32(len(body))
+	c.MsgData, _ = GetRtmpMsgData(c)
+
+	return c
+}
+
+func TestNewAVPacketData(t *testing.T) {
+	initPoolOnce.Do(mem_pool.InitPool)
+
+	amf := NewAMFEncode()
+	_ = amf.writeString(DataSetDataFrame)
+	setDataFrame := append([]byte(nil), amf.Bytes()...)
+
+	amf = NewAMFEncode()
+	_ = amf.writeString(DataOnMetaData)
+	_ = amf.writeMixedArray(AMFObjects{"width": float64(1280)})
+	onMetaData := append([]byte(nil), amf.Bytes()...)
+	full := append(append([]byte(nil), setDataFrame...), onMetaData...)
+
+	cases := []struct {
+		name    string
+		t       byte
+		body    []byte
+		payload []byte
+	}{
+		{"amf0 setDataFrame", RtmpMsgAMF0Data, full, onMetaData},
+		{"amf0 onMetaData", RtmpMsgAMF0Data, onMetaData, onMetaData},
+		{"amf3 with prefix", RtmpMsgAMF3Data, append([]byte{0}, full...), onMetaData},
+		{"amf3 without prefix", RtmpMsgAMF3Data, full, onMetaData},
+		// 只有 @setDataFrame 的消息 以前会越界
+		{"amf3 only setDataFrame", RtmpMsgAMF3Data, setDataFrame, nil},
+		{"amf0 only setDataFrame", RtmpMsgAMF0Data, setDataFrame, nil},
+		{"truncated", RtmpMsgAMF3Data, setDataFrame[:5], nil},
+	}
+
+	for _, c := range cases {
+		p := newAVPacket(dataChunk(c.t, c.body))
+		if c.payload == nil {
+			if p != nil {
+				t.Errorf("%s: got %x, want nil", c.name, p.Payload)
+			}
+
+			continue
+		}
+		if p == nil || p.Type != RtmpMsgAMF0Data || !bytes.Equal(p.Payload, c.payload) {
+			t.Errorf("%s: got %+v", c.name, p)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var tcURLDefaultPorts = map[string]int{
+	"rtmp":  1935,
+	"rtmpe": 1935,
+	"rtmps": 443,
+	"rtmpt": 80,
+}
+
+// TcURL connect 命令中的 tcUrl 例如 rtmp://host:1935/app/instance?key=value.
+type TcURL struct {
+	Scheme   string
+	Host     string
+	Port     int
+	App      string
+	Instance string
+	Query    url.Values
+}
+
+// ParseTcURL 解析 tcUrl 没有端口时使用协议的默认端口 路径的第一段为app 剩下的为实例.
+func ParseTcURL(raw string) (*TcURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	port, ok := tcURLDefaultPorts[scheme]
+	if !ok {
+		return nil, errors.Errorf("not support scheme %s", u.Scheme)
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, errors.Errorf("invalid port %s", p)
+		}
+	}
+
+	t := &TcURL{
+		Scheme: scheme,
+		Host:   strings.ToLower(u.Hostname()),
+		Port:   port,
+		Query:  u.Query(),
+	}
+	t.App, t.Instance = splitAppInstance(strings.Trim(u.Path, "/"))
+
+	return t, nil
+}
+
+// FullApp 带有实例的app 不同实例中的流互不影响.
+func (t *TcURL) FullApp() string {
+	if t.Instance == "" {
+		return t.App
+	}
+
+	return t.App + "/" + t.Instance
+}
+
+// setApp 使用 connect 中的 app 字段 app 字段可能带有实例和参数 例如 live/room1?token=xxx
+// 参数和 tcUrl 中的参数合并.
+func (t *TcURL) setApp(app string) {
+	if i := strings.IndexByte(app, '?'); i >= 0 {
+		query, _ := url.ParseQuery(app[i+1:])
+		for k, v := range query {
+			t.Query[k] = append(t.Query[k], v...)
+		}
+		app = app[:i]
+	}
+
+	t.App, t.Instance = splitAppInstance(strings.Trim(app, "/"))
+}
+
+func splitAppInstance(path string) (string, string) {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+
+	return path, ""
+}
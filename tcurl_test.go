@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTcURL(t *testing.T) {
+	tests := []struct {
+		raw      string
+		app      string
+		host     string
+		port     int
+		fullApp  string
+		queryKey string
+		query    string
+	}{
+		{raw: "rtmp://Example.com/live", app: "live", host: "example.com", port: 1935, fullApp: "live"},
+		{raw: "rtmps://a.example.com/live/room1", app: "live", host: "a.example.com", port: 443, fullApp: "live/room1"},
+		{raw: "rtmp://127.0.0.1:19350/live?vhost=b.example.org", app: "live", host: "127.0.0.1", port: 19350,
+			fullApp: "live", queryKey: "vhost", query: "b.example.org"},
+		{raw: "rtmpt://host/app/inst/sub/", app: "app", host: "host", port: 80, fullApp: "app/inst/sub"},
+	}
+
+	for _, tt := range tests {
+		u, err := ParseTcURL(tt.raw)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.raw, err)
+		}
+		if u.App != tt.app || u.Host != tt.host || u.Port != tt.port || u.FullApp() != tt.fullApp {
+			t.Errorf("%s: got %+v", tt.raw, u)
+		}
+		if tt.queryKey != "" && u.Query.Get(tt.queryKey) != tt.query {
+			t.Errorf("%s: query %v", tt.raw, u.Query)
+		}
+	}
+
+	if _, err := ParseTcURL("http://host/live"); err == nil {
+		t.Error("http scheme should fail")
+	}
+
+	u, _ := ParseTcURL("rtmp://host/live?a=1")
+	u.setApp("live/room1?token=abc")
+	if u.FullApp() != "live/room1" || u.Query.Get("a") != "1" || u.Query.Get("token") != "abc" {
+		t.Errorf("setApp got %+v", u)
+	}
+}
+
+func TestVhostApps(t *testing.T) {
+	c, err := parseConfig([]byte(`
+apps:
+  - name: live
+vhosts:
+  - name: a.example.com
+    aliases: ["*.a.example.com"]
+    reject_unknown_apps: true
+    defaults:
+      gop_cache: false
+    apps:
+      - name: show
+        chunk_size: 8192
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.MatchVhost("cdn.a.example.com"); v != "a.example.com" {
+		t.Errorf("alias matched %q", v)
+	}
+	if v := c.MatchVhost("other.com"); v != "" {
+		t.Errorf("unknown host matched %q", v)
+	}
+
+	if !c.AppAllowed("", "anything") {
+		t.Error("default vhost should allow unknown apps")
+	}
+	if c.AppAllowed("a.example.com", "live") {
+		t.Error("live is not configured in a.example.com")
+	}
+	if !c.AppAllowed("a.example.com", "show/room1") {
+		t.Error("instance of show should be allowed")
+	}
+
+	show := c.App("a.example.com", "show/room1")
+	if show.ChunkSize != 8192 || show.UseGopCache() {
+		t.Errorf("show %+v", show)
+	}
+
+	if streamKey("", "live", "s") == streamKey("a.example.com", "live", "s") {
+		t.Error("streams in different vhosts must not share a key")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertStore RTMPS 使用的证书 按照 SNI 选择证书 证书文件修改后会自动重新加载.
+type CertStore struct {
+	cfgs []CertConfig
+
+	lock    sync.RWMutex
+	byName  map[string]*tls.Certificate
+	def     *tls.Certificate
+	modTime map[string]time.Time
+}
+
+func newCertStore(cfgs []CertConfig) (*CertStore, error) {
+	s := &CertStore{cfgs: cfgs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload 重新加载所有证书 任何一个失败都会保留原来的证书.
+func (s *CertStore) Reload() error {
+	byName := make(map[string]*tls.Certificate)
+	modTime := make(map[string]time.Time)
+	var def *tls.Certificate
+
+	for _, c := range s.cfgs {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return errors.Wrapf(err, "load certificate %s", c.Cert)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Wrapf(err, "parse certificate %s", c.Cert)
+		}
+		cert.Leaf = leaf
+
+		// 配置了 hosts 就只使用配置的 否则使用证书中的域名
+		hosts := c.Hosts
+		if len(hosts) == 0 {
+			hosts = leaf.DNSNames
+		}
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			if _, ok := byName[h]; !ok {
+				byName[h] = &cert
+			}
+		}
+
+		// 第一个证书作为默认证书 客户端没有发送 SNI 或者没有匹配的时候使用
+		if def == nil {
+			def = &cert
+		}
+
+		for _, f := range []string{c.Cert, c.Key} {
+			if fi, err := os.Stat(f); err == nil {
+				modTime[f] = fi.ModTime()
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.byName = byName
+	s.def = def
+	s.modTime = modTime
+
+	return nil
+}
+
+// changed 证书文件是否有修改.
+func (s *CertStore) changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for f, t := range s.modTime {
+		fi, err := os.Stat(f)
+		if err != nil || !fi.ModTime().Equal(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch 定时检查证书文件 修改后重新加载 例如证书续期.
+func (s *CertStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !s.changed() {
+			continue
+		}
+
+		if err := s.Reload(); err != nil {
+			logger().Error("reload certificate failed", "err", err)
+
+			continue
+		}
+		logger().Info("certificate reloaded")
+	}
+}
+
+// GetCertificate 先精确匹配 再匹配通配符证书 最后使用默认证书.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.def, nil
+}
+
+// listenRtmps 监听 RTMPS 握手之后和普通的 RTMP 连接一样处理.
+func listenRtmps(cfg RtmpsConfig) error {
+	store, err := newCertStore(cfg.Certificates)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ReloadInterval > 0 {
+		go store.watch(cfg.ReloadInterval)
+	}
+
+	inner, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	l := tls.NewListener(newProxyListener(inner, func() ProxyProtocolConfig { return cfg.ProxyProtocol }), &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	logger().Info("rtmps listening", "addr", l.Addr().String())
+
+	go serve(l)
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert 生成 host 的自签名证书 CommonName 用来区分是哪个证书.
+func writeTestCert(t *testing.T, dir, name, host string) CertConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := CertConfig{Cert: filepath.Join(dir, host+".pem"), Key: filepath.Join(dir, host+".key")}
+	if err = ioutil.WriteFile(c.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeTestCert(t, dir, "a", "a.example.com")
+	b := writeTestCert(t, dir, "b", "b.example.com")
+	b.Hosts = []string{"*.b.example.com"}
+	store, err := newCertStore([]CertConfig{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		server string
+		want   string
+	}{
+		{"a.example.com", "a"},
+		{"A.Example.COM.", "a"},
+		{"live.b.example.com", "b"},
+		// 配置了 hosts 就不再使用证书中的域名
+		{"b.example.com", "a"},
+		{"", "a"},
+		{"other.com", "a"},
+	}
+	for _, c := range cases {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: c.server})
+		if err != nil || cert.Leaf.Subject.CommonName != c.want {
+			t.Errorf("%q: got %v %v", c.server, cert.Leaf.Subject.CommonName, err)
+		}
+	}
+
+	if _, err = newCertStore([]CertConfig{{Cert: filepath.Join(dir, "none.pem"), Key: a.Key}}); err == nil {
+		t.Error("missing certificate accepted")
+	}
+}
+
+func TestListenRtmpsReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	c := writeTestCert(t, dir, "old", "rtmps.example.com")
+	if err = listenRtmps(RtmpsConfig{Listen: addr, Certificates: []CertConfig{c}, ReloadInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	served := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "rtmps.example.com", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := served(); name != "old" {
+		t.Fatalf("served %s", name)
+	}
+
+	// 证书续期 修改时间变化后重新加载
+	writeTestCert(t, dir, "new", "rtmps.example.com")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{c.Cert, c.Key} {
+		if err = os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for served() != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertStoreReloadFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := writeTestCert(t, dir, "old", "a.example.com")
+	store, err := newCertStore([]CertConfig{c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.changed() {
+		t.Error("changed without modification")
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err = ioutil.WriteFile(c.Cert, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(c.Cert, later, later)
+	if !store.changed() {
+		t.Error("modification not detected")
+	}
+
+	// 加载失败时保留原来的证书
+	if err = store.Reload(); err == nil {
+		t.Error("broken certificate accepted")
+	}
+	cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if cert == nil || cert.Leaf.Subject.CommonName != "old" {
+		t.Errorf("certificate after failed reload is %v", cert)
+	}
+}